@@ -0,0 +1,153 @@
+package websocket
+
+import (
+	"bytes"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var strXForwardedFor = []byte("X-Forwarded-For")
+
+// handshakeSweepInterval is how often the limiters of the addresses that
+// stopped handshaking are discarded.
+const handshakeSweepInterval = time.Minute
+
+// admission counts the connections upgraded, globally and per client IP, and
+// the handshakes attempted per client IP, for enforcing the limits of the
+// Upgrader.
+type admission struct {
+	mutex      sync.Mutex
+	total      int
+	perIP      map[string]int
+	handshakes map[string]*handshakeLimiter
+	lastSweep  time.Time
+}
+
+type handshakeLimiter struct {
+	limiter  *RateLimiter
+	lastSeen time.Time
+}
+
+// allowHandshake takes a token from the handshake limiter of the ip. A zero
+// rate disables the limit.
+func (a *admission) allowHandshake(ip string, rate float64, burst int) bool {
+	if rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if now.Sub(a.lastSweep) >= handshakeSweepInterval {
+		for addr, h := range a.handshakes {
+			// Once refilled, a limiter is no different from a new one.
+			refill := time.Duration(h.limiter.messages.burst / rate * float64(time.Second))
+			if now.Sub(h.lastSeen) >= refill {
+				delete(a.handshakes, addr)
+			}
+		}
+		a.lastSweep = now
+	}
+	h, ok := a.handshakes[ip]
+	if !ok {
+		if a.handshakes == nil {
+			a.handshakes = make(map[string]*handshakeLimiter)
+		}
+		h = &handshakeLimiter{
+			limiter: NewRateLimiter(RateLimit{
+				MessagesPerSecond: rate,
+				MessagesBurst:     burst,
+			}),
+		}
+		a.handshakes[ip] = h
+	}
+	h.lastSeen = now
+	_, ok = h.limiter.reserve(0)
+	return ok
+}
+
+// check returns the limit reached by a connection from the ip, without taking
+// a slot, or an empty HandshakeFailure. Zero limits are disabled.
+func (a *admission) check(ip string, maxConnections, maxPerIP int) HandshakeFailure {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.limit(ip, maxConnections, maxPerIP)
+}
+
+func (a *admission) limit(ip string, maxConnections, maxPerIP int) HandshakeFailure {
+	if maxConnections > 0 && a.total >= maxConnections {
+		return HandshakeFailureMaxConnections
+	}
+	if maxPerIP > 0 && a.perIP[ip] >= maxPerIP {
+		return HandshakeFailureMaxConnectionsPerIP
+	}
+	return ""
+}
+
+// acquire takes a slot for a connection from the ip. It returns the limit
+// reached, or an empty HandshakeFailure when the slot was taken. Zero limits
+// are disabled.
+func (a *admission) acquire(ip string, maxConnections, maxPerIP int) HandshakeFailure {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	if failure := a.limit(ip, maxConnections, maxPerIP); failure != "" {
+		return failure
+	}
+	if a.perIP == nil {
+		a.perIP = make(map[string]int)
+	}
+	a.total++
+	a.perIP[ip]++
+	return ""
+}
+
+func (a *admission) release(ip string) {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	a.total--
+	if a.perIP[ip] <= 1 {
+		delete(a.perIP, ip)
+	} else {
+		a.perIP[ip]--
+	}
+}
+
+// count returns the number of connections admitted.
+func (a *admission) count() int {
+	a.mutex.Lock()
+	defer a.mutex.Unlock()
+	return a.total
+}
+
+// clientIP returns the address of the client. The X-Forwarded-For header is
+// only taken into account when the request comes from a trusted proxy, then
+// the rightmost address that is not a trusted proxy is the client.
+func clientIP(ctx *fasthttp.RequestCtx, trustedProxies []*net.IPNet) net.IP {
+	ip := ctx.RemoteIP()
+	if !isTrustedProxy(ip, trustedProxies) {
+		return ip
+	}
+	addrs := bytes.Split(ctx.Request.Header.PeekBytes(strXForwardedFor), []byte{','})
+	for i := len(addrs) - 1; i >= 0; i-- {
+		forwarded := net.ParseIP(string(bytes.TrimSpace(addrs[i])))
+		if forwarded == nil {
+			break
+		}
+		ip = forwarded
+		if !isTrustedProxy(ip, trustedProxies) {
+			break
+		}
+	}
+	return ip
+}
+
+func isTrustedProxy(ip net.IP, trustedProxies []*net.IPNet) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,150 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrBackplaneClosed         = errors.New("Backplane closed")
+	ErrInvalidRoom             = errors.New("Invalid room")
+	ErrConnectionNotRegistered = errors.New("Connection not registered")
+)
+
+// BackplaneMessage is the message exchanged between the nodes of a cluster
+// through a Backplane.
+//
+// The Topic is the name of the room the message is addressed to. An empty Topic
+// means the message should be delivered to every connection.
+type BackplaneMessage struct {
+	Topic   string
+	OPCode  MessageType
+	Payload []byte
+}
+
+// BackplaneHandler represents the handler that receives the messages published
+// by the other nodes of the cluster.
+type BackplaneHandler func(msg *BackplaneMessage)
+
+// Backplane connects the managers of different nodes, so broadcasts performed
+// in one node reach the connections held by the others.
+//
+// A message published by a node MUST NOT be delivered back to the subscribers
+// of the same node, since the manager already delivers it locally.
+type Backplane interface {
+	// Publish sends the message to all the other nodes.
+	Publish(msg *BackplaneMessage) error
+	// Subscribe registers the handler that will receive the messages published
+	// by the other nodes.
+	Subscribe(handler BackplaneHandler) error
+	// Close disconnects the node from the cluster.
+	Close() error
+}
+
+// InProcessBus connects InProcessBackplane instances that live in the same
+// process. It is useful for tests and for running many managers inside one
+// binary.
+type InProcessBus struct {
+	mutex sync.RWMutex
+	nodes []*InProcessBackplane
+}
+
+// NewInProcessBus returns a new instance of the websocket.InProcessBus
+func NewInProcessBus() *InProcessBus {
+	return &InProcessBus{
+		nodes: make([]*InProcessBackplane, 0),
+	}
+}
+
+// NewBackplane creates a new node attached to the bus.
+func (b *InProcessBus) NewBackplane() *InProcessBackplane {
+	node := &InProcessBackplane{
+		bus: b,
+	}
+	b.mutex.Lock()
+	b.nodes = append(b.nodes, node)
+	b.mutex.Unlock()
+	return node
+}
+
+func (b *InProcessBus) detach(node *InProcessBackplane) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	for i, n := range b.nodes {
+		if n == node {
+			b.nodes = append(b.nodes[:i], b.nodes[i+1:]...)
+			return
+		}
+	}
+}
+
+func (b *InProcessBus) publish(from *InProcessBackplane, msg *BackplaneMessage) {
+	b.mutex.RLock()
+	nodes := make([]*InProcessBackplane, len(b.nodes))
+	copy(nodes, b.nodes)
+	b.mutex.RUnlock()
+
+	for _, node := range nodes {
+		if node != from {
+			node.deliver(msg)
+		}
+	}
+}
+
+// InProcessBackplane is a websocket.Backplane that delivers the messages to the
+// other nodes attached to the same websocket.InProcessBus.
+type InProcessBackplane struct {
+	bus      *InProcessBus
+	mutex    sync.RWMutex
+	handlers []BackplaneHandler
+	closed   bool
+}
+
+// Publish implements the websocket.Backplane.Publish method
+func (b *InProcessBackplane) Publish(msg *BackplaneMessage) error {
+	b.mutex.RLock()
+	closed := b.closed
+	b.mutex.RUnlock()
+	if closed {
+		return ErrBackplaneClosed
+	}
+	// The publisher is free to reuse the payload after returning.
+	payload := make([]byte, len(msg.Payload))
+	copy(payload, msg.Payload)
+	b.bus.publish(b, &BackplaneMessage{
+		Topic:   msg.Topic,
+		OPCode:  msg.OPCode,
+		Payload: payload,
+	})
+	return nil
+}
+
+// Subscribe implements the websocket.Backplane.Subscribe method
+func (b *InProcessBackplane) Subscribe(handler BackplaneHandler) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrBackplaneClosed
+	}
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+// Close implements the websocket.Backplane.Close method
+func (b *InProcessBackplane) Close() error {
+	b.mutex.Lock()
+	b.closed = true
+	b.handlers = nil
+	b.mutex.Unlock()
+	b.bus.detach(b)
+	return nil
+}
+
+func (b *InProcessBackplane) deliver(msg *BackplaneMessage) {
+	b.mutex.RLock()
+	handlers := b.handlers
+	b.mutex.RUnlock()
+	for _, handler := range handlers {
+		handler(msg)
+	}
+}
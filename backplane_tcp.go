@@ -0,0 +1,299 @@
+package websocket
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"net"
+	"sync"
+	"time"
+)
+
+// The TCP backplane exchanges messages framed as:
+//
+//	+-----------------+-------+--------+-------------------+---------+
+//	| topic len (u16) | topic | opcode | payload len (u32) | payload |
+//	+-----------------+-------+--------+-------------------+---------+
+//
+// All integers are big endian.
+
+var (
+	ErrBackplaneTopicTooLong   = errors.New("Backplane topic too long")
+	ErrBackplanePayloadTooLong = errors.New("Backplane payload too long")
+)
+
+// MaxBackplanePayloadSize is the maximum size of the payloads exchanged by the
+// TCP backplane. The peers declaring longer payloads are dropped, before the
+// payload is allocated.
+const MaxBackplanePayloadSize = 16 * 1024 * 1024
+
+// DefaultBackplaneWriteTimeout is the time the TCP backplane relay waits for a
+// node to take a message, before dropping it.
+const DefaultBackplaneWriteTimeout = 5 * time.Second
+
+func encodeBackplaneMessage(msg *BackplaneMessage) ([]byte, error) {
+	if len(msg.Topic) > math.MaxUint16 {
+		return nil, ErrBackplaneTopicTooLong
+	}
+	if len(msg.Payload) > MaxBackplanePayloadSize {
+		return nil, ErrBackplanePayloadTooLong
+	}
+	buff := make([]byte, 2+len(msg.Topic)+1+4+len(msg.Payload))
+	binary.BigEndian.PutUint16(buff, uint16(len(msg.Topic)))
+	i := 2 + copy(buff[2:], msg.Topic)
+	buff[i] = byte(msg.OPCode)
+	i++
+	binary.BigEndian.PutUint32(buff[i:], uint32(len(msg.Payload)))
+	i += 4
+	copy(buff[i:], msg.Payload)
+	return buff, nil
+}
+
+// readBackplaneMessage reads a message from the reader returning the message
+// decoded and its raw representation, which is forwarded as is by the relay.
+func readBackplaneMessage(reader io.Reader) (*BackplaneMessage, []byte, error) {
+	var header [2]byte
+	if _, err := io.ReadFull(reader, header[:]); err != nil {
+		return nil, nil, err
+	}
+	topicLen := int(binary.BigEndian.Uint16(header[:]))
+	middle := make([]byte, topicLen+1+4)
+	if _, err := io.ReadFull(reader, middle); err != nil {
+		return nil, nil, err
+	}
+	payloadLen := binary.BigEndian.Uint32(middle[topicLen+1:])
+	if payloadLen > MaxBackplanePayloadSize {
+		return nil, nil, ErrBackplanePayloadTooLong
+	}
+	raw := make([]byte, 2+len(middle)+int(payloadLen))
+	copy(raw, header[:])
+	copy(raw[2:], middle)
+	payload := raw[2+len(middle):]
+	if _, err := io.ReadFull(reader, payload); err != nil {
+		return nil, nil, err
+	}
+	return &BackplaneMessage{
+		Topic:   string(middle[:topicLen]),
+		OPCode:  MessageType(middle[topicLen]),
+		Payload: payload,
+	}, raw, nil
+}
+
+// TCPBackplaneServer is the relay of the TCP reference backplane. Every message
+// published by a websocket.TCPBackplane is forwarded to all the other nodes
+// connected to the server.
+//
+// The nodes that do not take a message within the write timeout are dropped,
+// so a stalled node does not hold the relay.
+type TCPBackplaneServer struct {
+	listener     net.Listener
+	mutex        sync.Mutex
+	peers        map[*tcpBackplanePeer]struct{}
+	closed       bool
+	writeTimeout time.Duration
+	wg           sync.WaitGroup
+}
+
+type tcpBackplanePeer struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+}
+
+func (p *tcpBackplanePeer) write(raw []byte, timeout time.Duration) error {
+	p.writeMutex.Lock()
+	defer p.writeMutex.Unlock()
+	if err := p.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
+		return err
+	}
+	_, err := p.conn.Write(raw)
+	return err
+}
+
+// NewTCPBackplaneServer starts a relay listening at the given address. Use
+// "127.0.0.1:0" for picking a random port, that can be checked at Addr.
+func NewTCPBackplaneServer(address string) (*TCPBackplaneServer, error) {
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	s := &TCPBackplaneServer{
+		listener:     listener,
+		peers:        make(map[*tcpBackplanePeer]struct{}),
+		writeTimeout: DefaultBackplaneWriteTimeout,
+	}
+	s.wg.Add(1)
+	go s.serve()
+	return s, nil
+}
+
+// SetWriteTimeout configures the time the relay waits for a node to take a
+// message, before dropping it. Zero restores the
+// websocket.DefaultBackplaneWriteTimeout.
+func (s *TCPBackplaneServer) SetWriteTimeout(timeout time.Duration) {
+	if timeout == 0 {
+		timeout = DefaultBackplaneWriteTimeout
+	}
+	s.mutex.Lock()
+	s.writeTimeout = timeout
+	s.mutex.Unlock()
+}
+
+// Addr returns the address the relay is listening to.
+func (s *TCPBackplaneServer) Addr() net.Addr {
+	return s.listener.Addr()
+}
+
+func (s *TCPBackplaneServer) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		peer := &tcpBackplanePeer{
+			conn: conn,
+		}
+		s.mutex.Lock()
+		if s.closed {
+			s.mutex.Unlock()
+			conn.Close()
+			return
+		}
+		s.peers[peer] = struct{}{}
+		s.mutex.Unlock()
+		s.wg.Add(1)
+		go s.handle(peer)
+	}
+}
+
+func (s *TCPBackplaneServer) handle(peer *tcpBackplanePeer) {
+	defer func() {
+		s.mutex.Lock()
+		delete(s.peers, peer)
+		s.mutex.Unlock()
+		peer.conn.Close()
+		s.wg.Done()
+	}()
+	reader := bufio.NewReader(peer.conn)
+	for {
+		_, raw, err := readBackplaneMessage(reader)
+		if err != nil {
+			return
+		}
+		s.mutex.Lock()
+		peers := make([]*tcpBackplanePeer, 0, len(s.peers))
+		for p := range s.peers {
+			if p != peer {
+				peers = append(peers, p)
+			}
+		}
+		timeout := s.writeTimeout
+		s.mutex.Unlock()
+		for _, p := range peers {
+			if err := p.write(raw, timeout); err != nil {
+				// The message may be written partially, the node is
+				// dropped by its handler once the connection is closed.
+				p.conn.Close()
+			}
+		}
+	}
+}
+
+// Close stops the relay, disconnecting all nodes.
+func (s *TCPBackplaneServer) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	for peer := range s.peers {
+		peer.conn.Close()
+	}
+	s.mutex.Unlock()
+	err := s.listener.Close()
+	s.wg.Wait()
+	return err
+}
+
+// TCPBackplane is a reference websocket.Backplane implementation that exchanges
+// the messages through a websocket.TCPBackplaneServer.
+//
+// It does not reconnect nor buffers messages while disconnected, for production
+// environments consider an implementation on top of a message broker.
+type TCPBackplane struct {
+	conn       net.Conn
+	writeMutex sync.Mutex
+	mutex      sync.RWMutex
+	handlers   []BackplaneHandler
+	closed     bool
+	done       chan struct{}
+}
+
+// NewTCPBackplane connects a new node to the relay at the given address.
+func NewTCPBackplane(address string) (*TCPBackplane, error) {
+	conn, err := net.Dial("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	b := &TCPBackplane{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+	go b.read()
+	return b, nil
+}
+
+func (b *TCPBackplane) read() {
+	defer close(b.done)
+	reader := bufio.NewReader(b.conn)
+	for {
+		msg, _, err := readBackplaneMessage(reader)
+		if err != nil {
+			return
+		}
+		b.mutex.RLock()
+		handlers := b.handlers
+		b.mutex.RUnlock()
+		for _, handler := range handlers {
+			handler(msg)
+		}
+	}
+}
+
+// Publish implements the websocket.Backplane.Publish method
+func (b *TCPBackplane) Publish(msg *BackplaneMessage) error {
+	raw, err := encodeBackplaneMessage(msg)
+	if err != nil {
+		return err
+	}
+	b.writeMutex.Lock()
+	defer b.writeMutex.Unlock()
+	if b.closed {
+		return ErrBackplaneClosed
+	}
+	_, err = b.conn.Write(raw)
+	return err
+}
+
+// Subscribe implements the websocket.Backplane.Subscribe method
+func (b *TCPBackplane) Subscribe(handler BackplaneHandler) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	if b.closed {
+		return ErrBackplaneClosed
+	}
+	b.handlers = append(b.handlers, handler)
+	return nil
+}
+
+// Close implements the websocket.Backplane.Close method
+func (b *TCPBackplane) Close() error {
+	b.writeMutex.Lock()
+	b.mutex.Lock()
+	b.closed = true
+	b.handlers = nil
+	b.mutex.Unlock()
+	err := b.conn.Close()
+	b.writeMutex.Unlock()
+	<-b.done
+	return err
+}
@@ -0,0 +1,275 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io"
+	"net"
+	"time"
+)
+
+// pipeClient registers a connection backed by a net.Pipe in the manager and
+// returns a channel with the payloads of the frames received by the client
+// side, and a function for closing the pipe.
+func pipeClient(manager *ListenableManager) (Connection, chan string, func()) {
+	server, client := net.Pipe()
+	conn := NewSimpleConn(nil)
+	conn.Init(&ConnectionContext{
+		Conn: server,
+	})
+	manager.rooms.add(conn)
+	received := make(chan string, 10)
+	go func() {
+		buff := make([]byte, 1024)
+		for {
+			n, err := client.Read(buff)
+			if err != nil {
+				close(received)
+				return
+			}
+			_, _, _, _, _, _, _, payload, err := DecodePacket(buff[:n])
+			if err == nil {
+				received <- string(payload)
+			}
+		}
+	}()
+	return conn, received, func() {
+		manager.rooms.remove(conn)
+		server.Close()
+		client.Close()
+	}
+}
+
+var _ = Describe("Backplane", func() {
+	Describe("InProcessBackplane", func() {
+		It("should deliver messages to the other nodes only", func() {
+			bus := NewInProcessBus()
+			node1, node2, node3 := bus.NewBackplane(), bus.NewBackplane(), bus.NewBackplane()
+			received := make([]int, 3)
+			for i, node := range []*InProcessBackplane{node1, node2, node3} {
+				i := i
+				Expect(node.Subscribe(func(msg *BackplaneMessage) {
+					Expect(msg.Topic).To(Equal("room"))
+					Expect(msg.OPCode).To(Equal(MessageTypeText))
+					Expect(string(msg.Payload)).To(Equal("Hello"))
+					received[i]++
+				})).To(Succeed())
+			}
+			Expect(node1.Publish(&BackplaneMessage{"room", MessageTypeText, []byte("Hello")})).To(Succeed())
+			Expect(received).To(Equal([]int{0, 1, 1}))
+		})
+
+		It("should stop delivering messages to closed nodes", func() {
+			bus := NewInProcessBus()
+			node1, node2 := bus.NewBackplane(), bus.NewBackplane()
+			received := 0
+			Expect(node2.Subscribe(func(msg *BackplaneMessage) {
+				received++
+			})).To(Succeed())
+			Expect(node2.Close()).To(Succeed())
+			Expect(node1.Publish(&BackplaneMessage{"", MessageTypeText, []byte("Hello")})).To(Succeed())
+			Expect(received).To(BeZero())
+			Expect(node2.Publish(&BackplaneMessage{"", MessageTypeText, []byte("Hello")})).To(Equal(ErrBackplaneClosed))
+		})
+	})
+
+	Describe("TCPBackplane", func() {
+		It("should relay messages between nodes", func() {
+			server, err := NewTCPBackplaneServer("127.0.0.1:0")
+			Expect(err).To(BeNil())
+			defer server.Close()
+
+			nodes := make([]*TCPBackplane, 3)
+			received := make([]chan *BackplaneMessage, 3)
+			for i := range nodes {
+				nodes[i], err = NewTCPBackplane(server.Addr().String())
+				Expect(err).To(BeNil())
+				defer nodes[i].Close()
+				ch := make(chan *BackplaneMessage, 10)
+				received[i] = ch
+				Expect(nodes[i].Subscribe(func(msg *BackplaneMessage) {
+					ch <- msg
+				})).To(Succeed())
+			}
+			Eventually(func() int {
+				server.mutex.Lock()
+				defer server.mutex.Unlock()
+				return len(server.peers)
+			}).Should(Equal(3))
+
+			Expect(nodes[0].Publish(&BackplaneMessage{"room", MessageTypeBinary, []byte{1, 2, 3}})).To(Succeed())
+			for _, i := range []int{1, 2} {
+				var msg *BackplaneMessage
+				Eventually(received[i]).Should(Receive(&msg))
+				Expect(msg.Topic).To(Equal("room"))
+				Expect(msg.OPCode).To(Equal(MessageTypeBinary))
+				Expect(msg.Payload).To(Equal([]byte{1, 2, 3}))
+			}
+			Consistently(received[0], time.Millisecond*50).ShouldNot(Receive())
+		})
+	})
+
+	Describe("TCPBackplaneServer", func() {
+		It("should drop the peers declaring payloads too long", func() {
+			server, err := NewTCPBackplaneServer("127.0.0.1:0")
+			Expect(err).To(BeNil())
+			defer server.Close()
+			conn, err := net.Dial("tcp", server.Addr().String())
+			Expect(err).To(BeNil())
+			defer conn.Close()
+			// No topic, a text message of 4 GiB.
+			_, err = conn.Write([]byte{0, 0, byte(MessageTypeText), 0xff, 0xff, 0xff, 0xff})
+			Expect(err).To(BeNil())
+			Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			_, err = conn.Read(make([]byte, 1))
+			Expect(err).To(Equal(io.EOF))
+		})
+
+		It("should drop the peers that do not take the messages", func() {
+			server, err := NewTCPBackplaneServer("127.0.0.1:0")
+			Expect(err).To(BeNil())
+			defer server.Close()
+			server.SetWriteTimeout(time.Millisecond * 50)
+			// Nothing is read from the stalled peer.
+			stalled, err := net.Dial("tcp", server.Addr().String())
+			Expect(err).To(BeNil())
+			defer stalled.Close()
+			publisher, err := NewTCPBackplane(server.Addr().String())
+			Expect(err).To(BeNil())
+			defer publisher.Close()
+			peers := func() int {
+				server.mutex.Lock()
+				defer server.mutex.Unlock()
+				return len(server.peers)
+			}
+			Eventually(peers).Should(Equal(2))
+
+			// Fills the buffers of the stalled peer, until the relay drops it.
+			payload := make([]byte, 1024*1024)
+			for i := 0; i < 256 && peers() == 2; i++ {
+				Expect(publisher.Publish(&BackplaneMessage{"", MessageTypeBinary, payload})).To(Succeed())
+			}
+			Eventually(peers).Should(Equal(1))
+		})
+
+		It("should not encode payloads too long", func() {
+			_, err := encodeBackplaneMessage(&BackplaneMessage{"", MessageTypeBinary, make([]byte, MaxBackplanePayloadSize+1)})
+			Expect(err).To(Equal(ErrBackplanePayloadTooLong))
+		})
+	})
+
+	Describe("ListenableManager", func() {
+		It("should broadcast to all connections of all nodes", func() {
+			bus := NewInProcessBus()
+			manager1, manager2 := NewListeableManager(), NewListeableManager()
+			Expect(manager1.SetBackplane(bus.NewBackplane())).To(Succeed())
+			Expect(manager2.SetBackplane(bus.NewBackplane())).To(Succeed())
+			_, received1, close1 := pipeClient(manager1)
+			defer close1()
+			_, received2, close2 := pipeClient(manager2)
+			defer close2()
+
+			Expect(manager1.Broadcast(MessageTypeText, []byte("Hello"))).To(Succeed())
+			Eventually(received1).Should(Receive(Equal("Hello")))
+			Eventually(received2).Should(Receive(Equal("Hello")))
+		})
+
+		It("should not let a connection that does not read hold the broadcast", func() {
+			manager := NewListeableManager()
+			manager.BroadcastTimeout = time.Millisecond * 50
+			errs := make(chan error, 10)
+			manager.OnMessageError = func(conn Connection, err error) {
+				errs <- err
+			}
+			// Nothing is read from the client side of the pipe.
+			client, done := acceptPipe(manager)
+			defer client.Close()
+			Eventually(func() int {
+				return len(manager.rooms.members(""))
+			}).Should(Equal(1))
+			_, received, closeClient := pipeClient(manager)
+			defer closeClient()
+
+			Expect(manager.Broadcast(MessageTypeText, []byte("Hello"))).To(Succeed())
+			Eventually(received).Should(Receive(Equal("Hello")))
+			var err error
+			Expect(errs).To(Receive(&err))
+			Expect(isTimeout(err)).To(BeTrue())
+			// The reader terminates the connection.
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(errs).NotTo(Receive())
+		})
+
+		It("should broadcast only to the connections that joined the room", func() {
+			server, err := NewTCPBackplaneServer("127.0.0.1:0")
+			Expect(err).To(BeNil())
+			defer server.Close()
+			manager1, manager2 := NewListeableManager(), NewListeableManager()
+			for _, manager := range []*ListenableManager{manager1, manager2} {
+				backplane, err := NewTCPBackplane(server.Addr().String())
+				Expect(err).To(BeNil())
+				defer backplane.Close()
+				Expect(manager.SetBackplane(backplane)).To(Succeed())
+			}
+			Eventually(func() int {
+				server.mutex.Lock()
+				defer server.mutex.Unlock()
+				return len(server.peers)
+			}).Should(Equal(2))
+
+			conn1, received1, close1 := pipeClient(manager1)
+			defer close1()
+			_, received2, close2 := pipeClient(manager1)
+			defer close2()
+			conn3, received3, close3 := pipeClient(manager2)
+			defer close3()
+			Expect(manager1.Join(conn1, "room")).To(Succeed())
+			Expect(manager2.Join(conn3, "room")).To(Succeed())
+
+			Expect(manager2.BroadcastTo("room", MessageTypeText, []byte("Hello"))).To(Succeed())
+			Eventually(received1).Should(Receive(Equal("Hello")))
+			Eventually(received3).Should(Receive(Equal("Hello")))
+			Consistently(received2, time.Millisecond*50).ShouldNot(Receive())
+
+			manager1.Leave(conn1, "room")
+			Expect(manager2.BroadcastTo("room", MessageTypeText, []byte("Bye"))).To(Succeed())
+			Eventually(received3).Should(Receive(Equal("Bye")))
+			Consistently(received1, time.Millisecond*50).ShouldNot(Receive())
+		})
+
+		It("should not deliver to a connection reused since it was registered", func() {
+			manager := NewListeableManager()
+			errs := make(chan error, 1)
+			manager.OnMessageError = func(conn Connection, err error) {
+				errs <- err
+			}
+			conn, _, closeClient := pipeClient(manager)
+			defer closeClient()
+			// The connection is released and reused, while still registered
+			// in the snapshot of a broadcast.
+			conn.Reset()
+			server, client := net.Pipe()
+			defer client.Close()
+			conn.Init(&ConnectionContext{
+				Conn: server,
+			})
+			received := make(chan []byte, 1)
+			go func() {
+				buff := make([]byte, 1024)
+				if n, err := client.Read(buff); err == nil {
+					received <- buff[:n]
+				}
+			}()
+
+			Expect(manager.Broadcast(MessageTypeText, []byte("Hello"))).To(Succeed())
+			Consistently(received, time.Millisecond*50).ShouldNot(Receive())
+			Expect(errs).NotTo(Receive())
+		})
+
+		It("should not join unregistered connections", func() {
+			manager := NewListeableManager()
+			Expect(manager.Join(NewSimpleConn(nil), "room")).To(Equal(ErrConnectionNotRegistered))
+		})
+	})
+})
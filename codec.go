@@ -0,0 +1,121 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+var (
+	ErrUnexpectedMessageType = errors.New("Unexpected message type")
+)
+
+// Codec encodes and decodes the values exchanged through a connection.
+type Codec interface {
+	// MessageType is the type of the messages carrying the encoded values.
+	MessageType() MessageType
+	// Encode writes the encoded value to the writer.
+	Encode(w io.Writer, v interface{}) error
+	// Decode decodes the data into the value.
+	Decode(data []byte, v interface{}) error
+}
+
+// JSONCodec encodes the values as JSON into text messages. As the
+// json.Encoder does, the encoded values are followed by a newline.
+type JSONCodec struct{}
+
+// MessageType implements the websocket.Codec.MessageType method
+func (JSONCodec) MessageType() MessageType {
+	return MessageTypeText
+}
+
+// Encode implements the websocket.Codec.Encode method
+func (JSONCodec) Encode(w io.Writer, v interface{}) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// Decode implements the websocket.Codec.Decode method
+func (JSONCodec) Decode(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+// MsgPackCodec encodes the values as MessagePack into binary messages.
+type MsgPackCodec struct{}
+
+// MessageType implements the websocket.Codec.MessageType method
+func (MsgPackCodec) MessageType() MessageType {
+	return MessageTypeBinary
+}
+
+// Encode implements the websocket.Codec.Encode method
+func (MsgPackCodec) Encode(w io.Writer, v interface{}) error {
+	return msgpack.NewEncoder(w).Encode(v)
+}
+
+// Decode implements the websocket.Codec.Decode method
+func (MsgPackCodec) Decode(data []byte, v interface{}) error {
+	return msgpack.Unmarshal(data, v)
+}
+
+// CBORCodec encodes the values as CBOR (RFC 8949) into binary messages.
+type CBORCodec struct{}
+
+// MessageType implements the websocket.Codec.MessageType method
+func (CBORCodec) MessageType() MessageType {
+	return MessageTypeBinary
+}
+
+// Encode implements the websocket.Codec.Encode method
+func (CBORCodec) Encode(w io.Writer, v interface{}) error {
+	return cbor.NewEncoder(w).Encode(v)
+}
+
+// Decode implements the websocket.Codec.Decode method
+func (CBORCodec) Decode(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+// codecBuffers keeps the buffers used for encoding the values written.
+var codecBuffers = sync.Pool{
+	New: func() interface{} {
+		return new(bytes.Buffer)
+	},
+}
+
+// writeValue encodes the value and writes it as a single message.
+func writeValue(conn Connection, codec Codec, v interface{}) error {
+	buff := codecBuffers.Get().(*bytes.Buffer)
+	defer codecBuffers.Put(buff)
+	buff.Reset()
+	if err := codec.Encode(buff, v); err != nil {
+		return err
+	}
+	return conn.WriteMessage(codec.MessageType(), buff.Bytes())
+}
+
+// readValue reads a message and decodes it into the value. Messages of a type
+// other than the one of the codec are rejected with ErrUnexpectedMessageType.
+func readValue(conn Connection, codec Codec, v interface{}) error {
+	var (
+		opcode  MessageType
+		payload []byte
+		err     error
+	)
+	// The control frames (pings and pongs) are read without a payload, so
+	// the reading goes on until a data message arrives.
+	for payload == nil {
+		opcode, payload, err = conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+	}
+	if opcode != codec.MessageType() {
+		return ErrUnexpectedMessageType
+	}
+	return codec.Decode(payload, v)
+}
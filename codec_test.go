@@ -0,0 +1,96 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"net"
+)
+
+type codecValue struct {
+	Name  string `json:"name" msgpack:"name" cbor:"name"`
+	Count int    `json:"count" msgpack:"count" cbor:"count"`
+}
+
+var _ = Describe("Codec", func() {
+	var (
+		server, client net.Conn
+		conn           *SimpleConnection
+	)
+
+	BeforeEach(func() {
+		server, client = net.Pipe()
+		conn = NewSimpleConn(server)
+		conn.Init(&ConnectionContext{
+			Conn: server,
+		})
+	})
+
+	AfterEach(func() {
+		server.Close()
+		client.Close()
+	})
+
+	for _, codec := range []Codec{JSONCodec{}, MsgPackCodec{}, CBORCodec{}} {
+		codec := codec
+
+		It("should encode and decode values", func() {
+			var buff bytes.Buffer
+			Expect(codec.Encode(&buff, &codecValue{"foo", 3})).To(Succeed())
+			var value codecValue
+			Expect(codec.Decode(buff.Bytes(), &value)).To(Succeed())
+			Expect(value).To(Equal(codecValue{"foo", 3}))
+		})
+
+		It("should write values as messages of the codec type", func() {
+			done := make(chan error, 1)
+			go func() {
+				done <- conn.WriteValue(codec, &codecValue{"foo", 3})
+			}()
+			frames := readFrames(client, 1)
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(frames[0].opcode).To(Equal(byte(codec.MessageType())))
+			var value codecValue
+			Expect(codec.Decode([]byte(frames[0].payload), &value)).To(Succeed())
+			Expect(value).To(Equal(codecValue{"foo", 3}))
+		})
+
+		It("should read values from messages", func() {
+			var buff bytes.Buffer
+			Expect(codec.Encode(&buff, &codecValue{"bar", 7})).To(Succeed())
+			writeFrames(client, maskedFrame(true, byte(codec.MessageType()), buff.Bytes()))
+			var value codecValue
+			Expect(conn.ReadValue(codec, &value)).To(Succeed())
+			Expect(value).To(Equal(codecValue{"bar", 7}))
+		})
+	}
+
+	It("should write JSON as text", func() {
+		go conn.WriteJSON(map[string]string{"type": "ping"})
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "{\"type\":\"ping\"}\n"}}))
+	})
+
+	It("should read JSON", func() {
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte(`{"name":"baz","count":1}`)))
+		var value codecValue
+		Expect(conn.ReadJSON(&value)).To(Succeed())
+		Expect(value).To(Equal(codecValue{"baz", 1}))
+	})
+
+	It("should skip the control frames until a message arrives", func() {
+		writeFrames(client,
+			maskedFrame(true, OPCodePongFrame, []byte("pong")),
+			maskedFrame(true, OPCodeTextFrame, []byte(`{"name":"baz","count":1}`)),
+		)
+		var value codecValue
+		Expect(conn.ReadJSON(&value)).To(Succeed())
+		Expect(value).To(Equal(codecValue{"baz", 1}))
+	})
+
+	It("should reject messages of other types", func() {
+		writeFrames(client, maskedFrame(true, OPCodeBinaryFrame, []byte(`{}`)))
+		var value codecValue
+		Expect(conn.ReadJSON(&value)).To(Equal(ErrUnexpectedMessageType))
+	})
+})
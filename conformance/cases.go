@@ -0,0 +1,751 @@
+package conformance
+
+import (
+	"bytes"
+	"fmt"
+	"time"
+
+	"github.com/jamillosantos/websocket"
+	"github.com/jamillosantos/websocket/wstest"
+)
+
+// failFastTimeout is how long a manager has for failing a connection before
+// the rest of the message is sent.
+const failFastTimeout = 100 * time.Millisecond
+
+// Cases are the cases ported from the Autobahn Test Suite. Their IDs follow
+// the sections of the suite: 1 framing, 2 pings and pongs, 3 reserved bits, 4
+// opcodes, 5 fragmentation, 6 UTF-8, 7 close handling, 9 limits and 12
+// compression.
+var Cases = concat(
+	framingCases(),
+	pingCases(),
+	reservedBitsCases(),
+	opcodeCases(),
+	fragmentationCases(),
+	utf8Cases(),
+	closeCases(),
+	limitsCases(),
+	compressionCases(),
+)
+
+func concat(sections ...[]Case) []Case {
+	var cases []Case
+	for _, section := range sections {
+		cases = append(cases, section...)
+	}
+	return cases
+}
+
+func frame(fin bool, opcode byte, payload []byte) wstest.Frame {
+	return wstest.Frame{
+		Fin:     fin,
+		OPCode:  opcode,
+		Payload: payload,
+	}
+}
+
+// rsvFrame returns a frame with the reserved bits set as in the Autobahn Test
+// Suite, where RSV=4 is the rsv1 and RSV=1 is the rsv3.
+func rsvFrame(rsv byte, opcode byte, payload []byte) wstest.Frame {
+	f := frame(true, opcode, payload)
+	f.Rsv1 = rsv&4 == 4
+	f.Rsv2 = rsv&2 == 2
+	f.Rsv3 = rsv&1 == 1
+	return f
+}
+
+// payload returns a deterministic payload of the given size.
+func payload(size int) []byte {
+	const pattern = "BAsd7&jh23-*lorem ipsum dolor sit amet "
+	return bytes.Repeat([]byte(pattern), size/len(pattern)+1)[:size]
+}
+
+func echo(t *T, opcode websocket.MessageType, payload []byte) {
+	t.Send(opcode, payload)
+	t.ExpectMessage(opcode, payload)
+}
+
+func framingCases() []Case {
+	var cases []Case
+	sizes := []int{0, 125, 126, 127, 128, 65535, 65536}
+	for i, opcode := range []websocket.MessageType{websocket.MessageTypeText, websocket.MessageTypeBinary} {
+		name := map[websocket.MessageType]string{websocket.MessageTypeText: "text", websocket.MessageTypeBinary: "binary"}[opcode]
+		opcode := opcode
+		for j, size := range sizes {
+			p := payload(size)
+			cases = append(cases, Case{
+				ID:          fmt.Sprintf("1.%d.%d", i+1, j+1),
+				Description: fmt.Sprintf("Send %s message with payload of length %d", name, size),
+				Run: func(t *T) {
+					echo(t, opcode, p)
+					t.CloseNormally()
+				},
+			})
+		}
+		p := payload(65536)
+		cases = append(cases, Case{
+			ID:          fmt.Sprintf("1.%d.%d", i+1, len(sizes)+1),
+			Description: fmt.Sprintf("Send %s message with payload of length 65536, sent in chops of 997 octets", name),
+			Run: func(t *T) {
+				t.SendSlowly(frame(true, byte(opcode), p), 997)
+				t.ExpectMessage(opcode, p)
+				t.CloseNormally()
+			},
+		})
+	}
+	return cases
+}
+
+func pingCases() []Case {
+	binary := []byte{0x00, 0xff, 0xfe, 0xfd, 0xfc, 0xfb, 0x00, 0xff}
+	return []Case{
+		{
+			ID:          "2.1",
+			Description: "Send ping without payload",
+			Run: func(t *T) {
+				t.Ping(nil)
+				t.ExpectPong(nil)
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "2.2",
+			Description: "Send ping with small text payload",
+			Run: func(t *T) {
+				t.Ping([]byte("Hello, world!"))
+				t.ExpectPong([]byte("Hello, world!"))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "2.3",
+			Description: "Send ping with small binary payload",
+			Run: func(t *T) {
+				t.Ping(binary)
+				t.ExpectPong(binary)
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "2.4",
+			Description: "Send ping with payload of length 125",
+			Run: func(t *T) {
+				t.Ping(payload(125))
+				t.ExpectPong(payload(125))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "2.5",
+			Description: "Send ping with payload of length 126",
+			Run: func(t *T) {
+				t.Ping(payload(126))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "2.6",
+			Description: "Send ping with payload of length 125, sent in chops of 1 octet",
+			Run: func(t *T) {
+				t.SendSlowly(frame(true, websocket.OPCodePingFrame, payload(125)), 1)
+				t.ExpectPong(payload(125))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "2.7",
+			Description: "Send unsolicited pong without payload",
+			Run: func(t *T) {
+				t.SendFrame(frame(true, websocket.OPCodePongFrame, nil))
+				t.ExpectNothing(failFastTimeout)
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "2.8",
+			Description: "Send unsolicited pong with payload",
+			Run: func(t *T) {
+				t.SendFrame(frame(true, websocket.OPCodePongFrame, []byte("unsolicited pong payload")))
+				t.ExpectNothing(failFastTimeout)
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "2.9",
+			Description: "Send unsolicited pong with payload, then ping with payload",
+			Run: func(t *T) {
+				t.SendFrame(frame(true, websocket.OPCodePongFrame, []byte("unsolicited pong payload")))
+				t.Ping([]byte("ping payload"))
+				t.ExpectPong([]byte("ping payload"))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "2.10",
+			Description: "Send 10 pings with payload",
+			Run: func(t *T) {
+				for i := 0; i < 10; i++ {
+					t.Ping([]byte(fmt.Sprintf("payload-%d", i)))
+				}
+				for i := 0; i < 10; i++ {
+					t.ExpectPong([]byte(fmt.Sprintf("payload-%d", i)))
+				}
+				t.CloseNormally()
+			},
+		},
+	}
+}
+
+func reservedBitsCases() []Case {
+	hello := []byte("Hello, world!")
+	return []Case{
+		{
+			ID:          "3.1",
+			Description: "Send small text message with RSV = 1",
+			Run: func(t *T) {
+				t.SendFrame(rsvFrame(1, websocket.OPCodeTextFrame, hello))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "3.2",
+			Description: "Send small text message, then small text message with RSV = 2, then ping",
+			Run: func(t *T) {
+				echo(t, websocket.MessageTypeText, hello)
+				t.SendFrame(rsvFrame(2, websocket.OPCodeTextFrame, hello))
+				t.Ping(nil)
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "3.3",
+			Description: "Send small text message, then small text message with RSV = 3, then ping, at once",
+			Run: func(t *T) {
+				t.Send(websocket.MessageTypeText, hello)
+				t.SendFrame(rsvFrame(3, websocket.OPCodeTextFrame, hello))
+				t.Ping(nil)
+				t.ExpectMessage(websocket.MessageTypeText, hello)
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "3.4",
+			Description: "Send small text message with RSV = 4, sent in chops of 1 octet",
+			Run: func(t *T) {
+				t.SendSlowly(rsvFrame(4, websocket.OPCodeTextFrame, hello), 1)
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "3.5",
+			Description: "Send small binary message with RSV = 5",
+			Run: func(t *T) {
+				t.SendFrame(rsvFrame(5, websocket.OPCodeBinaryFrame, []byte{0x00, 0xff, 0xfe}))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "3.6",
+			Description: "Send ping with RSV = 6",
+			Run: func(t *T) {
+				t.SendFrame(rsvFrame(6, websocket.OPCodePingFrame, hello))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "3.7",
+			Description: "Send close with RSV = 7",
+			Run: func(t *T) {
+				t.SendFrame(rsvFrame(7, websocket.OPCodeConnectionCloseFrame, nil))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+	}
+}
+
+func opcodeCases() []Case {
+	var cases []Case
+	for i, opcodes := range [][]byte{{3, 4, 5, 6, 7}, {11, 12, 13, 14, 15}} {
+		kind := []string{"non-control", "control"}[i]
+		for j, opcode := range opcodes {
+			opcode := opcode
+			c := Case{
+				ID: fmt.Sprintf("4.%d.%d", i+1, j+1),
+			}
+			switch j {
+			case 0:
+				c.Description = fmt.Sprintf("Send frame with reserved %s opcode = %d", kind, opcode)
+				c.Run = func(t *T) {
+					t.SendFrame(frame(true, opcode, nil))
+					t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+				}
+			case 2:
+				c.Description = fmt.Sprintf("Send small text message, then frame with reserved %s opcode = %d, then ping", kind, opcode)
+				c.Run = func(t *T) {
+					echo(t, websocket.MessageTypeText, []byte("Hello, world!"))
+					t.SendFrame(frame(true, opcode, nil))
+					t.Ping(nil)
+					t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+				}
+			default:
+				c.Description = fmt.Sprintf("Send frame with reserved %s opcode = %d and non-empty payload", kind, opcode)
+				c.Run = func(t *T) {
+					t.SendFrame(frame(true, opcode, []byte("reserved opcode payload")))
+					t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+				}
+			}
+			cases = append(cases, c)
+		}
+	}
+	return cases
+}
+
+func fragmentationCases() []Case {
+	return []Case{
+		{
+			ID:          "5.1",
+			Description: "Send ping fragmented into 2 fragments",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodePingFrame, []byte("fragment1")))
+				t.SendFrame(frame(true, websocket.OPCodeContinuationFrame, []byte("fragment2")))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "5.2",
+			Description: "Send pong fragmented into 2 fragments",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodePongFrame, []byte("fragment1")))
+				t.SendFrame(frame(true, websocket.OPCodeContinuationFrame, []byte("fragment2")))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "5.3",
+			Description: "Send text message fragmented into 2 fragments",
+			Run: func(t *T) {
+				t.SendFragments(websocket.MessageTypeText, []byte("fragment1"), []byte("fragment2"))
+				t.ExpectMessage(websocket.MessageTypeText, []byte("fragment1fragment2"))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "5.4",
+			Description: "Send text message fragmented into 2 fragments, sent in chops of 1 octet",
+			Run: func(t *T) {
+				t.SendSlowly(frame(false, websocket.OPCodeTextFrame, []byte("fragment1")), 1)
+				t.SendSlowly(frame(true, websocket.OPCodeContinuationFrame, []byte("fragment2")), 1)
+				t.ExpectMessage(websocket.MessageTypeText, []byte("fragment1fragment2"))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "5.6",
+			Description: "Send text message fragmented into 2 fragments, with a ping in between",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodeTextFrame, []byte("fragment1")))
+				t.Ping([]byte("ping payload"))
+				t.SendFrame(frame(true, websocket.OPCodeContinuationFrame, []byte("fragment2")))
+				t.ExpectPong([]byte("ping payload"))
+				t.ExpectMessage(websocket.MessageTypeText, []byte("fragment1fragment2"))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "5.9",
+			Description: "Send unfragmented text message after a final continuation frame with nothing to continue",
+			Run: func(t *T) {
+				t.SendFrame(frame(true, websocket.OPCodeContinuationFrame, []byte("non-continuation payload")))
+				t.Send(websocket.MessageTypeText, []byte("Hello, world!"))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "5.10",
+			Description: "Send unfragmented text message after a non-final continuation frame with nothing to continue",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodeContinuationFrame, []byte("non-continuation payload")))
+				t.Send(websocket.MessageTypeText, []byte("Hello, world!"))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "5.15",
+			Description: "Send text message fragmented into 2 fragments, then a continuation frame with nothing to continue",
+			Run: func(t *T) {
+				t.SendFragments(websocket.MessageTypeText, []byte("fragment1"), []byte("fragment2"))
+				t.SendFrame(frame(false, websocket.OPCodeContinuationFrame, []byte("fragment3")))
+				t.SendFrame(frame(true, websocket.OPCodeTextFrame, []byte("fragment4")))
+				t.ExpectMessage(websocket.MessageTypeText, []byte("fragment1fragment2"))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "5.18",
+			Description: "Send text message fragmented into 2 fragments, with both frame opcodes set to text",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodeTextFrame, []byte("fragment1")))
+				t.SendFrame(frame(true, websocket.OPCodeTextFrame, []byte("fragment2")))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "5.19",
+			Description: "Send text message fragmented into 5 fragments, with pings in between",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodeTextFrame, []byte("fragment1")))
+				t.SendFrame(frame(false, websocket.OPCodeContinuationFrame, []byte("fragment2")))
+				t.Ping([]byte("pongme 1!"))
+				t.ExpectPong([]byte("pongme 1!"))
+				t.SendFrame(frame(false, websocket.OPCodeContinuationFrame, []byte("fragment3")))
+				t.SendFrame(frame(false, websocket.OPCodeContinuationFrame, []byte("fragment4")))
+				t.Ping([]byte("pongme 2!"))
+				t.ExpectPong([]byte("pongme 2!"))
+				t.SendFrame(frame(true, websocket.OPCodeContinuationFrame, []byte("fragment5")))
+				t.ExpectMessage(websocket.MessageTypeText, []byte("fragment1fragment2fragment3fragment4fragment5"))
+				t.CloseNormally()
+			},
+		},
+	}
+}
+
+// bytewise splits the payload in fragments of 1 octet.
+func bytewise(payload []byte) [][]byte {
+	fragments := make([][]byte, len(payload))
+	for i := range payload {
+		fragments[i] = payload[i : i+1]
+	}
+	return fragments
+}
+
+func utf8Cases() []Case {
+	kosme := []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5")
+	hello := []byte("Hello-\xc2\xb5@\xc3\x9f\xc3\xb6\xc3\xa4\xc3\xbc\xc3\xa0\xc3\xa1-UTF-8!!")
+	invalid := []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80edited")
+	cases := []Case{
+		{
+			ID:          "6.1.1",
+			Description: "Send text message of length 0",
+			Run: func(t *T) {
+				echo(t, websocket.MessageTypeText, []byte{})
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "6.1.2",
+			Description: "Send text message fragmented into 3 fragments, each of length 0",
+			Run: func(t *T) {
+				t.SendFragments(websocket.MessageTypeText, nil, nil, nil)
+				t.ExpectMessage(websocket.MessageTypeText, []byte{})
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "6.1.3",
+			Description: "Send text message fragmented into 3 fragments, the first and the last of length 0",
+			Run: func(t *T) {
+				t.SendFragments(websocket.MessageTypeText, nil, []byte("middle frame payload"), nil)
+				t.ExpectMessage(websocket.MessageTypeText, []byte("middle frame payload"))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "6.2.1",
+			Description: "Send valid UTF-8 text message in one fragment",
+			Run: func(t *T) {
+				echo(t, websocket.MessageTypeText, hello)
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "6.2.2",
+			Description: "Send valid UTF-8 text message in 2 fragments, fragmented on a code point boundary",
+			Run: func(t *T) {
+				t.SendFragments(websocket.MessageTypeText, hello[:8], hello[8:])
+				t.ExpectMessage(websocket.MessageTypeText, hello)
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "6.2.3",
+			Description: "Send valid UTF-8 text message in fragments of 1 octet",
+			Run: func(t *T) {
+				t.SendFragments(websocket.MessageTypeText, bytewise(hello)...)
+				t.ExpectMessage(websocket.MessageTypeText, hello)
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "6.2.4",
+			Description: "Send valid UTF-8 text message in fragments of 1 octet, splitting every code point",
+			Run: func(t *T) {
+				t.SendFragments(websocket.MessageTypeText, bytewise(kosme)...)
+				t.ExpectMessage(websocket.MessageTypeText, kosme)
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "6.3.1",
+			Description: "Send invalid UTF-8 text message unfragmented",
+			Run: func(t *T) {
+				t.Send(websocket.MessageTypeText, invalid)
+				t.ExpectFailure(websocket.ConnectionCloseReasonInconsistentType)
+			},
+		},
+		{
+			ID:          "6.3.2",
+			Description: "Send invalid UTF-8 text message in fragments of 1 octet",
+			Run: func(t *T) {
+				t.SendFragments(websocket.MessageTypeText, bytewise(invalid)...)
+				t.ExpectFailure(websocket.ConnectionCloseReasonInconsistentType)
+			},
+		},
+		{
+			ID:          "6.4.1",
+			Description: "Send invalid UTF-8 text message in 3 fragments, the invalid code point in the second one",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodeTextFrame, kosme))
+				t.SendFrame(frame(false, websocket.OPCodeContinuationFrame, []byte("\xf4\x90\x80\x80")))
+				t.ExpectFailFast(websocket.ConnectionCloseReasonInconsistentType, failFastTimeout, func() {
+					t.SendFrame(frame(true, websocket.OPCodeContinuationFrame, []byte("edited")))
+				})
+			},
+		},
+		{
+			ID:          "6.4.2",
+			Description: "Send invalid UTF-8 text message in 3 fragments, the invalid code point split between the first and the second",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodeTextFrame, append(append([]byte{}, kosme...), 0xf4)))
+				t.SendFrame(frame(false, websocket.OPCodeContinuationFrame, []byte("\x90\x80\x80")))
+				t.ExpectFailFast(websocket.ConnectionCloseReasonInconsistentType, failFastTimeout, func() {
+					t.SendFrame(frame(true, websocket.OPCodeContinuationFrame, []byte("edited")))
+				})
+			},
+		},
+	}
+	valid := []string{
+		"\x00", "\x7f", "\xc2\x80", "\xdf\xbf", "\xe0\xa0\x80", "\xed\x9f\xbf",
+		"\xee\x80\x80", "\xef\xbf\xbd", "\xf0\x90\x80\x80", "\xf4\x8f\xbf\xbf",
+	}
+	for i, sequence := range valid {
+		p := []byte(sequence)
+		cases = append(cases, Case{
+			ID:          fmt.Sprintf("6.5.%d", i+1),
+			Description: fmt.Sprintf("Send text message with the valid UTF-8 sequence %q", sequence),
+			Run: func(t *T) {
+				echo(t, websocket.MessageTypeText, p)
+				t.CloseNormally()
+			},
+		})
+	}
+	invalids := []string{
+		"\x80", "\xbf", "\xc0\xaf", "\xe0\x80\xaf", "\xf0\x80\x80\xaf",
+		"\xed\xa0\x80", "\xed\xbf\xbf", "\xf4\x90\x80\x80", "\xfe", "\xff",
+		"\xc2", "\xe0\xa0",
+	}
+	for i, sequence := range invalids {
+		p := append([]byte("Hello"), sequence...)
+		cases = append(cases, Case{
+			ID:          fmt.Sprintf("6.8.%d", i+1),
+			Description: fmt.Sprintf("Send text message with the invalid UTF-8 sequence %q", sequence),
+			Run: func(t *T) {
+				t.Send(websocket.MessageTypeText, p)
+				t.ExpectFailure(websocket.ConnectionCloseReasonInconsistentType)
+			},
+		})
+	}
+	return cases
+}
+
+func closeCases() []Case {
+	cases := []Case{
+		{
+			ID:          "7.1.1",
+			Description: "Send a message followed by a close frame",
+			Run: func(t *T) {
+				echo(t, websocket.MessageTypeText, []byte("Hello World!"))
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "7.1.2",
+			Description: "Send two close frames",
+			Run: func(t *T) {
+				t.Close(websocket.ConnectionCloseReasonNormal, "")
+				t.Close(websocket.ConnectionCloseReasonNormal, "")
+				t.ExpectClose(websocket.ConnectionCloseReasonNormal)
+			},
+		},
+		{
+			ID:          "7.1.3",
+			Description: "Send a ping after a close frame",
+			Run: func(t *T) {
+				t.Close(websocket.ConnectionCloseReasonNormal, "")
+				t.Ping([]byte("Hello World!"))
+				t.ExpectClose(websocket.ConnectionCloseReasonNormal)
+			},
+		},
+		{
+			ID:          "7.1.4",
+			Description: "Send a text message after a close frame",
+			Run: func(t *T) {
+				t.Close(websocket.ConnectionCloseReasonNormal, "")
+				t.Send(websocket.MessageTypeText, []byte("Hello World!"))
+				t.ExpectClose(websocket.ConnectionCloseReasonNormal)
+			},
+		},
+		{
+			ID:          "7.1.5",
+			Description: "Send the first fragment of a text message, followed by a close frame",
+			Run: func(t *T) {
+				t.SendFrame(frame(false, websocket.OPCodeTextFrame, []byte("fragment1")))
+				t.Close(websocket.ConnectionCloseReasonNormal, "")
+				t.ExpectClose(websocket.ConnectionCloseReasonNormal)
+			},
+		},
+		{
+			ID:          "7.3.1",
+			Description: "Send close with payload of length 0",
+			Run: func(t *T) {
+				t.SendFrame(frame(true, websocket.OPCodeConnectionCloseFrame, nil))
+				t.ExpectClose(websocket.ConnectionCloseReasonNormal)
+			},
+		},
+		{
+			ID:          "7.3.2",
+			Description: "Send close with payload of length 1",
+			Run: func(t *T) {
+				t.SendFrame(frame(true, websocket.OPCodeConnectionCloseFrame, []byte{0x03}))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "7.3.3",
+			Description: "Send close with the normal code and no reason",
+			Run: func(t *T) {
+				t.CloseNormally()
+			},
+		},
+		{
+			ID:          "7.3.4",
+			Description: "Send close with the normal code and a reason",
+			Run: func(t *T) {
+				t.Close(websocket.ConnectionCloseReasonNormal, "Hello World!")
+				t.ExpectClose(websocket.ConnectionCloseReasonNormal)
+			},
+		},
+		{
+			ID:          "7.3.5",
+			Description: "Send close with the normal code and a reason of length 123",
+			Run: func(t *T) {
+				t.Close(websocket.ConnectionCloseReasonNormal, string(payload(123)))
+				t.ExpectClose(websocket.ConnectionCloseReasonNormal)
+			},
+		},
+		{
+			ID:          "7.3.6",
+			Description: "Send close with the normal code and a reason of length 124",
+			Run: func(t *T) {
+				t.Close(websocket.ConnectionCloseReasonNormal, string(payload(124)))
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		},
+		{
+			ID:          "7.5.1",
+			Description: "Send close with invalid UTF-8 reason",
+			Run: func(t *T) {
+				t.Close(websocket.ConnectionCloseReasonNormal, "\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xed\xa0\x80edited")
+				t.ExpectFailure(websocket.ConnectionCloseReasonInconsistentType)
+			},
+		},
+	}
+	valid := []websocket.ConnectionCloseReason{1000, 1001, 1002, 1003, 1007, 1008, 1009, 1010, 1011, 3000, 3999, 4000, 4999}
+	for i, code := range valid {
+		code := code
+		cases = append(cases, Case{
+			ID:          fmt.Sprintf("7.7.%d", i+1),
+			Description: fmt.Sprintf("Send close with valid close code %d", code),
+			Run: func(t *T) {
+				t.Close(code, "")
+				t.ExpectClose(websocket.ConnectionCloseReasonNormal, code)
+			},
+		})
+	}
+	invalid := []websocket.ConnectionCloseReason{0, 999, 1004, 1005, 1006, 1015, 1016, 1100, 2000, 2999}
+	for i, code := range invalid {
+		code := code
+		cases = append(cases, Case{
+			ID:          fmt.Sprintf("7.9.%d", i+1),
+			Description: fmt.Sprintf("Send close with invalid close code %d", code),
+			Run: func(t *T) {
+				t.Close(code, "")
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		})
+	}
+	for i, code := range []websocket.ConnectionCloseReason{5000, 65535} {
+		code := code
+		cases = append(cases, Case{
+			ID:          fmt.Sprintf("7.13.%d", i+1),
+			Description: fmt.Sprintf("Send close with close code %d, out of the range of the RFC", code),
+			Run: func(t *T) {
+				t.Close(code, "")
+				t.ExpectFailure(websocket.ConnectionCloseReasonProtocolError)
+			},
+		})
+	}
+	return cases
+}
+
+func limitsCases() []Case {
+	var cases []Case
+	for i, opcode := range []websocket.MessageType{websocket.MessageTypeText, websocket.MessageTypeBinary} {
+		name := map[websocket.MessageType]string{websocket.MessageTypeText: "text", websocket.MessageTypeBinary: "binary"}[opcode]
+		opcode := opcode
+		for j, size := range []int{64 * 1024, 256 * 1024, 1024 * 1024} {
+			p := payload(size)
+			cases = append(cases, Case{
+				ID:          fmt.Sprintf("9.%d.%d", i+1, j+1),
+				Description: fmt.Sprintf("Send %s message with payload of length %d", name, size),
+				Run: func(t *T) {
+					echo(t, opcode, p)
+					t.CloseNormally()
+				},
+			})
+		}
+	}
+	return cases
+}
+
+func compressionCases() []Case {
+	var cases []Case
+	for i, opcode := range []websocket.MessageType{websocket.MessageTypeText, websocket.MessageTypeBinary} {
+		name := map[websocket.MessageType]string{websocket.MessageTypeText: "text", websocket.MessageTypeBinary: "binary"}[opcode]
+		opcode := opcode
+		for j, size := range []int{16, 64, 256, 1024, 4096, 65536} {
+			p := payload(size)
+			cases = append(cases, Case{
+				ID:          fmt.Sprintf("12.%d.%d", i+1, j+1),
+				Description: fmt.Sprintf("Send compressed %s message with payload of length %d", name, size),
+				Compressed:  true,
+				Run: func(t *T) {
+					echo(t, opcode, p)
+					t.CloseNormally()
+				},
+			})
+		}
+	}
+	p := payload(4096)
+	cases = append(cases, Case{
+		ID:          "12.3.1",
+		Description: "Send compressed text message fragmented into 2 fragments",
+		Compressed:  true,
+		Run: func(t *T) {
+			t.SendFragments(websocket.MessageTypeText, p[:2048], p[2048:])
+			t.ExpectMessage(websocket.MessageTypeText, p)
+			t.CloseNormally()
+		},
+	})
+	return cases
+}
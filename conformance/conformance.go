@@ -0,0 +1,377 @@
+// Package conformance is a port of the core cases of the Autobahn Test Suite
+// (https://github.com/crossbario/autobahn-testsuite) fuzzing client. The cases
+// drive a websocket.Manager through the in-memory connections of the wstest
+// package, so no Docker or Python is required:
+//
+//	report := conformance.Run("ListenableManager", func() websocket.Manager {
+//		manager := websocket.NewListeableManager()
+//		manager.OnMessage = echo
+//		return manager
+//	}, conformance.Cases)
+//	report.WriteHTML(w)
+//
+// The manager must echo the text and binary messages, like the Autobahn
+// echo server.
+package conformance
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/jamillosantos/websocket"
+	"github.com/jamillosantos/websocket/wstest"
+)
+
+// Behavior is the result of a case, following the Autobahn Test Suite.
+type Behavior string
+
+const (
+	// BehaviorOK means the manager behaved as the RFC requires.
+	BehaviorOK Behavior = "OK"
+	// BehaviorInformational means the case only collects information.
+	BehaviorInformational Behavior = "INFORMATIONAL"
+	// BehaviorNonStrict means the manager behaved in a way the RFC allows,
+	// but it is not the strict behavior (eg. failing a connection late).
+	BehaviorNonStrict Behavior = "NON-STRICT"
+	// BehaviorFailed means the manager violated the RFC.
+	BehaviorFailed Behavior = "FAILED"
+)
+
+// severity orders the behaviors, so a case keeps the worst one.
+func (b Behavior) severity() int {
+	switch b {
+	case BehaviorOK:
+		return 0
+	case BehaviorInformational:
+		return 1
+	case BehaviorNonStrict:
+		return 2
+	}
+	return 3
+}
+
+// Case is a conformance case.
+type Case struct {
+	// ID is the identifier of the case in the Autobahn Test Suite.
+	ID          string
+	Description string
+	// Compressed runs the case with the permessage-deflate negotiated.
+	Compressed bool
+	Run        func(t *T)
+}
+
+// Timeout is the time the manager has for answering each frame of a case.
+var Timeout = time.Second
+
+// T drives a conformance case. The frames are sent from another goroutine,
+// so the case can send many frames without reading the answers, as the
+// connections are not buffered.
+type T struct {
+	client   *wstest.Client
+	behavior Behavior
+	log      []string
+	writes   chan func() error
+	wg       sync.WaitGroup
+	mutex    sync.Mutex
+	writeErr error
+}
+
+// failNow stops a case that failed.
+type failNow struct{}
+
+func newT(client *wstest.Client) *T {
+	t := &T{
+		client:   client,
+		behavior: BehaviorOK,
+		writes:   make(chan func() error, 64),
+	}
+	t.wg.Add(1)
+	go t.write()
+	return t
+}
+
+func (t *T) write() {
+	defer t.wg.Done()
+	for write := range t.writes {
+		t.mutex.Lock()
+		failed := t.writeErr != nil
+		t.mutex.Unlock()
+		if failed {
+			// The connection was failed by the manager.
+			continue
+		}
+		if err := write(); err != nil {
+			t.mutex.Lock()
+			t.writeErr = err
+			t.mutex.Unlock()
+		}
+	}
+}
+
+// Logf adds a line to the log of the case.
+func (t *T) Logf(format string, args ...interface{}) {
+	t.log = append(t.log, fmt.Sprintf(format, args...))
+}
+
+// Result sets the behavior of the case, unless it is already worse. A failed
+// case stops right away.
+func (t *T) Result(behavior Behavior, format string, args ...interface{}) {
+	t.Logf("%s: %s", behavior, fmt.Sprintf(format, args...))
+	if behavior.severity() > t.behavior.severity() {
+		t.behavior = behavior
+	}
+	if behavior == BehaviorFailed {
+		panic(failNow{})
+	}
+}
+
+// Fail fails the case.
+func (t *T) Fail(format string, args ...interface{}) {
+	t.Result(BehaviorFailed, format, args...)
+}
+
+// Send sends a message.
+func (t *T) Send(opcode websocket.MessageType, payload []byte) {
+	t.writes <- func() error {
+		return t.client.Send(opcode, payload)
+	}
+}
+
+// SendFragments sends a message fragmented in a frame per fragment.
+func (t *T) SendFragments(opcode websocket.MessageType, fragments ...[]byte) {
+	t.writes <- func() error {
+		return t.client.SendFragments(opcode, fragments...)
+	}
+}
+
+// SendFrame sends a frame as it is.
+func (t *T) SendFrame(frame wstest.Frame) {
+	t.writes <- func() error {
+		return t.client.SendFrame(frame)
+	}
+}
+
+// SendSlowly sends a frame in chunks of the given size.
+func (t *T) SendSlowly(frame wstest.Frame, chunk int) {
+	t.writes <- func() error {
+		return t.client.SendSlowly(frame, chunk, time.Millisecond)
+	}
+}
+
+// Ping sends a ping frame.
+func (t *T) Ping(payload []byte) {
+	t.SendFrame(wstest.Frame{
+		Fin:     true,
+		OPCode:  websocket.OPCodePingFrame,
+		Payload: payload,
+	})
+}
+
+// Close sends a close frame.
+func (t *T) Close(reason websocket.ConnectionCloseReason, text string) {
+	t.writes <- func() error {
+		return t.client.Close(reason, text)
+	}
+}
+
+func (t *T) read(timeout time.Duration) (websocket.MessageType, []byte, error) {
+	opcode, payload, err := t.client.ReadMessageTimeout(timeout)
+	if err == nil {
+		t.Logf("received %s", describe(opcode, payload))
+	}
+	return opcode, payload, err
+}
+
+// ExpectMessage fails the case if the next message is not the given one.
+func (t *T) ExpectMessage(opcode websocket.MessageType, payload []byte) {
+	gotOpcode, gotPayload, err := t.read(Timeout)
+	if err != nil {
+		t.Fail("expected %s, got %s", describe(opcode, payload), err)
+	}
+	if gotOpcode != opcode || string(gotPayload) != string(payload) {
+		t.Fail("expected %s, got %s", describe(opcode, payload), describe(gotOpcode, gotPayload))
+	}
+}
+
+// ExpectPong fails the case if the next message is not a pong with the
+// payload.
+func (t *T) ExpectPong(payload []byte) {
+	t.ExpectMessage(websocket.MessageTypePong, payload)
+}
+
+// ExpectNothing fails the case if a message arrives within the duration.
+func (t *T) ExpectNothing(d time.Duration) {
+	opcode, payload, err := t.read(d)
+	if err == nil {
+		t.Fail("expected nothing, got %s", describe(opcode, payload))
+	}
+	if !isTimeout(err) {
+		t.Fail("expected nothing, got %s", err)
+	}
+}
+
+// ExpectClose fails the case if the manager does not close the connection
+// cleanly, with one of the reasons, after the close sent by the client.
+func (t *T) ExpectClose(reasons ...websocket.ConnectionCloseReason) {
+	opcode, payload, err := t.read(Timeout)
+	if err != nil {
+		t.Fail("expected a close frame, got %s", err)
+	}
+	if opcode != websocket.MessageTypeConnectionClose {
+		t.Fail("expected a close frame, got %s", describe(opcode, payload))
+	}
+	if reason := closeReason(payload); !hasReason(reasons, reason) {
+		t.Fail("expected the close reasons %v, got %d", reasons, reason)
+	}
+	t.expectDropped()
+}
+
+// CloseNormally runs the close handshake with the normal reason.
+func (t *T) CloseNormally() {
+	t.Close(websocket.ConnectionCloseReasonNormal, "")
+	t.ExpectClose(websocket.ConnectionCloseReasonNormal)
+}
+
+// ExpectFailure fails the case if the manager does not fail the connection
+// with the reason. Dropping the connection without a close frame is also
+// accepted, as the Autobahn Test Suite does.
+func (t *T) ExpectFailure(reason websocket.ConnectionCloseReason) {
+	t.expectFailure(reason, Timeout, false)
+}
+
+// ExpectFailFast expects the manager to fail the connection with the reason
+// within the duration. Otherwise, the rest is sent and failing the connection
+// afterwards is NON-STRICT.
+func (t *T) ExpectFailFast(reason websocket.ConnectionCloseReason, d time.Duration, rest func()) {
+	if t.expectFailure(reason, d, true) {
+		return
+	}
+	t.Result(BehaviorNonStrict, "the connection was not failed fast")
+	rest()
+	t.ExpectFailure(reason)
+}
+
+// expectFailure returns false if nothing arrives within the timeout of a
+// fast failure.
+func (t *T) expectFailure(reason websocket.ConnectionCloseReason, timeout time.Duration, fast bool) bool {
+	for {
+		opcode, payload, err := t.read(timeout)
+		if fast && isTimeout(err) {
+			return false
+		}
+		if isClosed(err) {
+			t.Logf("the connection was dropped")
+			return true
+		}
+		if err != nil {
+			t.Fail("expected the connection to be failed, got %s", err)
+		}
+		switch opcode {
+		case websocket.MessageTypePong:
+			// Answers to the pings sent before the failure.
+			continue
+		case websocket.MessageTypeConnectionClose:
+			if got := closeReason(payload); got != reason {
+				t.Fail("expected the close reason %d, got %d", reason, got)
+			}
+			t.expectDropped()
+			return true
+		}
+		t.Fail("expected the connection to be failed, got %s", describe(opcode, payload))
+	}
+}
+
+// expectDropped checks the manager closes the TCP connection after the close
+// frames.
+func (t *T) expectDropped() {
+	opcode, payload, err := t.read(Timeout)
+	if err == nil {
+		t.Fail("expected the connection to be closed, got %s", describe(opcode, payload))
+	}
+	if !isClosed(err) {
+		t.Result(BehaviorNonStrict, "the connection was not closed after the close frames: %s", err)
+	}
+}
+
+func closeReason(payload []byte) websocket.ConnectionCloseReason {
+	if len(payload) < 2 {
+		return websocket.ConnectionCloseReasonNormal
+	}
+	return websocket.ConnectionCloseReason(uint16(payload[0])<<8 | uint16(payload[1]))
+}
+
+func hasReason(reasons []websocket.ConnectionCloseReason, reason websocket.ConnectionCloseReason) bool {
+	for _, r := range reasons {
+		if r == reason {
+			return true
+		}
+	}
+	return false
+}
+
+func isTimeout(err error) bool {
+	ne, ok := err.(net.Error)
+	return ok && ne.Timeout()
+}
+
+func isClosed(err error) bool {
+	return err == io.EOF || err == io.ErrClosedPipe || err == io.ErrUnexpectedEOF
+}
+
+func describe(opcode websocket.MessageType, payload []byte) string {
+	const max = 32
+	if len(payload) > max {
+		return fmt.Sprintf("opcode %d with %d bytes %q...", opcode, len(payload), payload[:max])
+	}
+	return fmt.Sprintf("opcode %d with %d bytes %q", opcode, len(payload), payload)
+}
+
+// RunCase runs the case against the manager.
+func RunCase(manager websocket.Manager, c Case) (result Result) {
+	client := wstest.PipeContext(manager, &websocket.ConnectionContext{
+		Compressed: c.Compressed,
+	})
+	client.Timeout = Timeout
+	t := newT(client)
+	start := time.Now()
+	defer func() {
+		close(t.writes)
+		client.Terminate()
+		t.wg.Wait()
+		if client.Wait() == wstest.ErrAcceptTimeout {
+			t.behavior = BehaviorFailed
+			t.Logf("%s: the manager did not release the connection", BehaviorFailed)
+		}
+		result = Result{
+			ID:          c.ID,
+			Description: c.Description,
+			Behavior:    t.behavior,
+			Duration:    time.Since(start),
+			Log:         t.log,
+		}
+	}()
+	defer func() {
+		if r := recover(); r != nil {
+			if _, ok := r.(failNow); !ok {
+				panic(r)
+			}
+		}
+	}()
+	c.Run(t)
+	return
+}
+
+// Run runs the cases, each one against a new manager.
+func Run(agent string, newManager func() websocket.Manager, cases []Case) *Report {
+	report := &Report{
+		Agent:   agent,
+		Started: time.Now(),
+	}
+	for _, c := range cases {
+		report.Results = append(report.Results, RunCase(newManager(), c))
+	}
+	return report
+}
@@ -0,0 +1,107 @@
+package conformance
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"github.com/jamillosantos/websocket"
+)
+
+var reportDir = flag.String("conformance.report", "", "directory for the report.json and report.html of the conformance cases")
+
+func TestConformance(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Conformance Suite")
+}
+
+// knownFailures are the cases the ListenableManager fails, with the reason.
+var knownFailures = map[string]string{}
+
+// report collects the results of the cases, written by the AfterSuite when the
+// -conformance.report is given.
+var report = &Report{
+	Agent: "ListenableManager",
+}
+
+func newEchoManager() websocket.Manager {
+	manager := websocket.NewListeableManager()
+	manager.OnMessage = func(conn websocket.Connection, opcode websocket.MessageType, payload []byte) error {
+		return conn.WriteMessage(opcode, payload)
+	}
+	return manager
+}
+
+var _ = AfterSuite(func() {
+	if *reportDir == "" {
+		return
+	}
+	Expect(os.MkdirAll(*reportDir, 0755)).To(Succeed())
+	for name, write := range map[string]func(io.Writer) error{
+		"report.json": report.WriteJSON,
+		"report.html": report.WriteHTML,
+	} {
+		f, err := os.Create(filepath.Join(*reportDir, name))
+		Expect(err).ToNot(HaveOccurred())
+		Expect(write(f)).To(Succeed())
+		Expect(f.Close()).To(Succeed())
+	}
+})
+
+var _ = Describe("Conformance", func() {
+	Describe("ListenableManager", func() {
+		for _, c := range Cases {
+			c := c
+			It("should pass the case "+c.ID+": "+c.Description, func() {
+				result := RunCase(newEchoManager(), c)
+				report.Results = append(report.Results, result)
+				if reason, ok := knownFailures[c.ID]; ok {
+					Skip("known failure: " + reason)
+				}
+				Expect(result.Behavior).ToNot(Equal(BehaviorFailed), strings.Join(result.Log, "\n"))
+			})
+		}
+	})
+
+	Describe("Report", func() {
+		report := &Report{
+			Agent: "manager",
+			Results: []Result{
+				{ID: "1.1.1", Description: "Send <text>", Behavior: BehaviorOK},
+				{ID: "2.1", Description: "Send ping", Behavior: BehaviorFailed, Log: []string{"FAILED: expected a pong"}},
+			},
+		}
+
+		It("should summarize the behaviors", func() {
+			Expect(report.Summary()).To(Equal(map[Behavior]int{
+				BehaviorOK:     1,
+				BehaviorFailed: 1,
+			}))
+		})
+
+		It("should write the JSON", func() {
+			var buff bytes.Buffer
+			Expect(report.WriteJSON(&buff)).To(Succeed())
+			var decoded Report
+			Expect(json.Unmarshal(buff.Bytes(), &decoded)).To(Succeed())
+			Expect(decoded.Agent).To(Equal("manager"))
+			Expect(decoded.Results).To(Equal(report.Results))
+		})
+
+		It("should write the HTML escaping the descriptions", func() {
+			var buff bytes.Buffer
+			Expect(report.WriteHTML(&buff)).To(Succeed())
+			Expect(buff.String()).To(ContainSubstring(`<td class="FAILED">FAILED</td>`))
+			Expect(buff.String()).To(ContainSubstring("Send &lt;text&gt;"))
+			Expect(buff.String()).To(ContainSubstring("FAILED: expected a pong"))
+		})
+	})
+})
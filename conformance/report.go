@@ -0,0 +1,90 @@
+package conformance
+
+import (
+	"encoding/json"
+	"html/template"
+	"io"
+	"time"
+)
+
+// Result is the result of a case.
+type Result struct {
+	ID          string        `json:"id"`
+	Description string        `json:"description"`
+	Behavior    Behavior      `json:"behavior"`
+	Duration    time.Duration `json:"duration"`
+	// Log has the frames received and the reasons of the behavior.
+	Log []string `json:"log,omitempty"`
+}
+
+// Report is the result of running the cases against a manager.
+type Report struct {
+	// Agent identifies the manager tested.
+	Agent   string    `json:"agent"`
+	Started time.Time `json:"started"`
+	Results []Result  `json:"results"`
+}
+
+// Summary counts the cases by behavior.
+func (r *Report) Summary() map[Behavior]int {
+	summary := make(map[Behavior]int)
+	for _, result := range r.Results {
+		summary[result.Behavior]++
+	}
+	return summary
+}
+
+// WriteJSON writes the report as JSON.
+func (r *Report) WriteJSON(w io.Writer) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(r)
+}
+
+// WriteHTML writes the report as a HTML page.
+func (r *Report) WriteHTML(w io.Writer) error {
+	return reportTemplate.Execute(w, struct {
+		*Report
+		Summary   map[Behavior]int
+		Behaviors []Behavior
+	}{r, r.Summary(), []Behavior{BehaviorOK, BehaviorNonStrict, BehaviorInformational, BehaviorFailed}})
+}
+
+var reportTemplate = template.Must(template.New("report").Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<title>Conformance report: {{.Agent}}</title>
+<style>
+body { font-family: sans-serif; }
+table { border-collapse: collapse; }
+td, th { border: 1px solid #ccc; padding: 4px 8px; text-align: left; vertical-align: top; }
+.OK { background: #0a0; color: #fff; }
+.NON-STRICT { background: #aa0; color: #fff; }
+.INFORMATIONAL { background: #48c; color: #fff; }
+.FAILED { background: #c00; color: #fff; }
+pre { margin: 0; }
+</style>
+</head>
+<body>
+<h1>Conformance report: {{.Agent}}</h1>
+<p>Started at {{.Started.Format "2006-01-02 15:04:05 MST"}}.</p>
+<table>
+<tr>{{range .Behaviors}}<th class="{{.}}">{{.}}</th>{{end}}</tr>
+<tr>{{range .Behaviors}}<td>{{index $.Summary .}}</td>{{end}}</tr>
+</table>
+<h2>Cases</h2>
+<table>
+<tr><th>Case</th><th>Description</th><th>Behavior</th><th>Duration</th><th>Log</th></tr>
+{{range .Results}}<tr id="case-{{.ID}}">
+<td>{{.ID}}</td>
+<td>{{.Description}}</td>
+<td class="{{.Behavior}}">{{.Behavior}}</td>
+<td>{{.Duration}}</td>
+<td><pre>{{range .Log}}{{.}}
+{{end}}</pre></td>
+</tr>
+{{end}}</table>
+</body>
+</html>
+`))
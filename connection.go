@@ -1,8 +1,13 @@
 package websocket
 
 import (
+	"compress/flate"
+	"context"
 	"encoding/binary"
+	"errors"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -20,6 +25,10 @@ const (
 	ConnectionStateClosed
 )
 
+// errConnectionAborted is returned by the reads of a connection aborted by a
+// write timing out, so the reader terminates it.
+var errConnectionAborted = errors.New("Connection aborted")
+
 // ConnectionCloseReason represents the reason informed by the endpoint for
 // closing the connection.
 type ConnectionCloseReason uint16
@@ -52,8 +61,27 @@ const (
 	// ConnectionCloseReasonUnexpected happens when the server is terminating
 	// the connection because it encoutered an unexpected condition
 	ConnectionCloseReasonUnexpected ConnectionCloseReason = 1011
+	// ConnectionCloseReasonTryAgainLater happens when the server is
+	// overloaded and the client should reconnect later.
+	ConnectionCloseReasonTryAgainLater ConnectionCloseReason = 1013
 )
 
+// DefaultMaxDecompressedSize is the default maximum size of a compressed
+// packet once decompressed.
+const DefaultMaxDecompressedSize = 16 * 1024 * 1024
+
+// DefaultMaxMessageSize is the default maximum size of a message received,
+// its fragments together.
+const DefaultMaxMessageSize = 16 * 1024 * 1024
+
+// DefaultWriteBufferSize is the default size of the buffer the frames are
+// written through.
+const DefaultWriteBufferSize = 4096
+
+// DefaultCloseTimeout is the default time waited for the close frame of the
+// peer, after sending one, before closing the TCP connection.
+const DefaultCloseTimeout = 5 * time.Second
+
 // MessageType represents the type of message defined by the RFC 6455
 type MessageType byte
 
@@ -73,6 +101,16 @@ const (
 	MessageTypePong MessageType = 10
 )
 
+// WriteMessageOptions are the options of a single message written with the
+// websocket.Connection.WriteMessageWithOptions.
+type WriteMessageOptions struct {
+	// Compress compresses the message when the permessage-deflate is
+	// negotiated, as WriteMessage does. Messages not worth compressing, like
+	// images or tiny acks, can be sent uncompressed on the same connection
+	// (RFC 7692, section 6).
+	Compress bool
+}
+
 // Connection is the minimum representation of a websocket connection
 type Connection interface {
 	Init(context *ConnectionContext)
@@ -98,6 +136,17 @@ type Connection interface {
 	ReadMessageTimeout(timeout time.Duration) (MessageType, []byte, error)
 	WriteMessage(opcode MessageType, payload []byte) error
 	WriteMessageTimeout(timeout time.Duration, opcode MessageType, payload []byte) error
+	WriteMessageWithOptions(opcode MessageType, payload []byte, options WriteMessageOptions) error
+
+	ReadValue(codec Codec, v interface{}) error
+	WriteValue(codec Codec, v interface{}) error
+	ReadJSON(v interface{}) error
+	WriteJSON(v interface{}) error
+
+	Stats() ConnectionStats
+	// TraceContext returns the span context of the connection or, while the
+	// OnMessage handler runs, of the message being handled.
+	TraceContext() context.Context
 
 	IsClosed() bool
 	Close() error
@@ -113,20 +162,212 @@ type BaseConnection struct {
 	conn           net.Conn
 	state          ConnectionState
 	compressed     bool
+	writeMutex     sync.Mutex
+	// frameRead counts the bytes read of the frame being decoded, telling a
+	// timeout between frames from one in the middle of a frame.
+	frameRead int
+	// aborted is set, atomically, when a write times out.
+	aborted int32
+	// generation counts the Init calls, telling the uses of a pooled
+	// connection apart. It is guarded by the writeMutex.
+	generation uint64
+	// maxMessageSize limits the messages received, zero meaning no limit.
+	maxMessageSize int
+	// maxDeflateSize and maxDeflateRatio limit the decompressed packets.
+	maxDeflateSize  int
+	maxDeflateRatio float64
+	// compressionLevel and compressionThreshold configure the compressed
+	// packets sent.
+	compressionLevel     int
+	compressionThreshold int
+	writeBufferSize      int
+	// closeSent and closeDeadline track the close handshake, guarded by the
+	// writeMutex.
+	closeTimeout  time.Duration
+	closeSent     bool
+	closeDeadline time.Time
+	stats         connStats
+	metrics       MetricsSink
+	logger        Logger
+	trace         connTrace
 }
 
 // NewConn initialized and return a new websocket.BaseConnection instance
 func NewConn(conn net.Conn) *BaseConnection {
 	return &BaseConnection{
-		readHeaderBuff: make([]byte, 2),
-		readBuff:       make([]byte, 1024*8),
-		conn:           conn,
+		readHeaderBuff:   make([]byte, 2),
+		readBuff:         make([]byte, 1024*8),
+		conn:             conn,
+		maxMessageSize:   DefaultMaxMessageSize,
+		maxDeflateSize:   DefaultMaxDecompressedSize,
+		compressionLevel: DefaultCompressionLevel,
+		writeBufferSize:  DefaultWriteBufferSize,
+		closeTimeout:     DefaultCloseTimeout,
+		metrics:          nopMetrics{},
+		logger:           nopLogger{},
+	}
+}
+
+// setMetrics configures the sink the connection reports into.
+func (c *BaseConnection) setMetrics(sink MetricsSink) {
+	c.metrics = metricsOrNop(sink)
+}
+
+// setLogger configures the logger of the connection.
+func (c *BaseConnection) setLogger(logger Logger) {
+	c.logger = loggerOrNop(logger)
+}
+
+// messageSizeLimiter is implemented by the connections that read the
+// messages, for the managers to configure their maximum size.
+type messageSizeLimiter interface {
+	setMaxMessageSize(maxSize int)
+}
+
+// setMaxMessageSize configures the maximum size of the messages received,
+// following the rules of the MaxMessageSize of the managers.
+func (c *BaseConnection) setMaxMessageSize(maxSize int) {
+	c.maxMessageSize = maxMessageSize(maxSize)
+}
+
+// generational is implemented by the connections that are pooled, so the
+// messages meant for a use of the connection are not written to the next one.
+type generational interface {
+	currentGeneration() uint64
+	writeMessageGeneration(generation uint64, timeout time.Duration, opcode MessageType, payload []byte) error
+}
+
+// currentGeneration returns the generation of the current use of the
+// connection.
+func (c *BaseConnection) currentGeneration() uint64 {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.generation
+}
+
+// deflateLimiter is implemented by the connections that decompress the
+// packets, for the managers to configure their limits.
+type deflateLimiter interface {
+	setDeflateLimits(maxSize int, maxRatio float64)
+}
+
+// setDeflateLimits configures the limits of the decompressed packets. The
+// maxSize follows the rules of the MaxDecompressedSize of the managers.
+func (c *BaseConnection) setDeflateLimits(maxSize int, maxRatio float64) {
+	c.maxDeflateSize = maxDecompressedSize(maxSize)
+	c.maxDeflateRatio = maxRatio
+}
+
+// maxDecompressedSize resolves the MaxDecompressedSize configured: zero means
+// the default and negative values mean no limit.
+func maxDecompressedSize(maxSize int) int {
+	if maxSize == 0 {
+		return DefaultMaxDecompressedSize
+	}
+	if maxSize < 0 {
+		return 0
+	}
+	return maxSize
+}
+
+// maxMessageSize resolves the MaxMessageSize configured: zero means the
+// default and negative values mean no limit.
+func maxMessageSize(maxSize int) int {
+	if maxSize == 0 {
+		return DefaultMaxMessageSize
+	}
+	if maxSize < 0 {
+		return 0
+	}
+	return maxSize
+}
+
+// compressionSetter is implemented by the connections that compress the
+// packets sent, for the managers to configure the compression.
+type compressionSetter interface {
+	setCompression(level int, threshold int)
+}
+
+// setCompression configures the level of the compressed packets, zero or an
+// invalid level meaning the DefaultCompressionLevel. Packets smaller than the
+// threshold are sent uncompressed.
+func (c *BaseConnection) setCompression(level int, threshold int) {
+	if level == 0 || level < flate.HuffmanOnly || level > flate.BestCompression {
+		level = DefaultCompressionLevel
+	}
+	c.compressionLevel = level
+	c.compressionThreshold = threshold
+}
+
+// closeTimeoutSetter is implemented by the connections that run the close
+// handshake, for the managers to configure its timeout.
+type closeTimeoutSetter interface {
+	setCloseTimeout(timeout time.Duration)
+}
+
+// setCloseTimeout configures the time waited for the close frame of the peer,
+// zero meaning the DefaultCloseTimeout.
+func (c *BaseConnection) setCloseTimeout(timeout time.Duration) {
+	if timeout <= 0 {
+		timeout = DefaultCloseTimeout
+	}
+	c.closeTimeout = timeout
+}
+
+// writeBufferSetter is implemented by the connections that write the frames
+// through a buffer, for the managers to configure its size.
+type writeBufferSetter interface {
+	setWriteBufferSize(size int)
+}
+
+// setWriteBufferSize configures the size of the write buffer, zero meaning the
+// DefaultWriteBufferSize.
+func (c *BaseConnection) setWriteBufferSize(size int) {
+	if size <= 0 {
+		size = DefaultWriteBufferSize
+	}
+	c.writeBufferSize = size
+}
+
+// writeBufferPool holds the buffers the frames are written through, shared by
+// all the connections as they are used only while writing.
+var writeBufferPool sync.Pool
+
+func getWriteBuffer(size int) *[]byte {
+	if buff, ok := writeBufferPool.Get().(*[]byte); ok && cap(*buff) >= size {
+		return buff
+	}
+	buff := make([]byte, 0, size)
+	return &buff
+}
+
+// flateBufferPool holds the buffers the packets are compressed into, before
+// being written.
+var flateBufferPool sync.Pool
+
+// maxPooledFlateBuffer is the capacity of the biggest buffer returned to the
+// flateBufferPool, so a big message does not pin its buffer.
+const maxPooledFlateBuffer = 64 * 1024
+
+func getFlateBuffer() *[]byte {
+	if buff, ok := flateBufferPool.Get().(*[]byte); ok {
+		return buff
+	}
+	buff := make([]byte, 0, 1024)
+	return &buff
+}
+
+func putFlateBuffer(buff *[]byte) {
+	if cap(*buff) <= maxPooledFlateBuffer {
+		flateBufferPool.Put(buff)
 	}
 }
 
 // Reset cleans up all the data and prepare the instance for being placed back
 // on the pool, for avoiding allocation.
 func (c *BaseConnection) Reset() {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	c.conn = nil
 	c.compressed = false
 	c.state = ConnectionStateClosed
@@ -134,9 +375,16 @@ func (c *BaseConnection) Reset() {
 
 // Init implements the websocket.Connection.Init
 func (c *BaseConnection) Init(ctx *ConnectionContext) {
+	c.writeMutex.Lock()
+	c.generation++
 	c.compressed = ctx.Compressed
 	c.conn = ctx.Conn
 	c.state = ConnectionStateOpen
+	c.closeSent = false
+	c.writeMutex.Unlock()
+	atomic.StoreInt32(&c.aborted, 0)
+	c.stats.reset(time.Now())
+	c.trace.reset(ctx.TraceContext)
 }
 
 // Conn implements the websocket.Connection.Conn
@@ -146,6 +394,8 @@ func (c *BaseConnection) Conn() net.Conn {
 
 // State implements the websocket.Connection.State
 func (c *BaseConnection) State() ConnectionState {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	return c.state
 }
 
@@ -159,50 +409,100 @@ func (c *BaseConnection) SetContext(value interface{}) {
 
 // Read implements the websocket.Connection.Read
 func (c *BaseConnection) Read(b []byte) (int, error) {
-	return c.conn.Read(b)
+	n, err := c.conn.Read(b)
+	c.frameRead += n
+	return n, err
 }
 
 // ReadPacket implements the websocket.Connection.ReadPacket
+//
+// A compressed frame is inflated only when it is a whole message. The
+// fragments of a compressed message can only be inflated together, so they
+// are returned as received (ReadMessage reassembles and inflates them).
 func (c *BaseConnection) ReadPacket() (fin bool, opcode byte, payload []byte, err error) {
-	fin, rsv1, rsv2, rsv3, opcode, _, maskingKey, payload, err := DecodePacketFromReader(c, c.readBuff, time.Now().Add(time.Second*10))
+	fin, rsv1, opcode, payload, err := c.readFrame()
 	if err != nil {
 		return false, 0, nil, err
 	}
+	if rsv1 && fin {
+		payload, err = c.inflate(payload)
+		if err != nil {
+			return false, 0, nil, err
+		}
+	}
+	return fin, opcode, payload, nil
+}
+
+// readFrame reads a frame and unmasks its payload. The rsv1 flags the first
+// frame of a compressed message (RFC 7692, section 6).
+func (c *BaseConnection) readFrame() (fin bool, rsv1 bool, opcode byte, payload []byte, err error) {
+	c.frameRead = 0
+	fin, rsv1, rsv2, rsv3, opcode, _, maskingKey, payload, err := DecodeFrameFromReader(c, c.readBuff, uint64(c.maxMessageSize))
+	if err == ErrMessageTooBig {
+		c.CloseWithReason(ConnectionCloseReasonMessageTooBig)
+		c.Terminate()
+		return false, false, 0, nil, err
+	}
+	if err != nil {
+		if isTimeout(err) && c.frameRead > 0 {
+			return false, false, 0, nil, c.failPartial()
+		}
+		return false, false, 0, nil, err
+	}
+	c.stats.frameIn(opcode, frameSize(uint64(len(payload)), maskingKey != nil))
 
-	if rsv1 || rsv2 || rsv3 {
+	// Control frames and continuations are never flagged as compressed
+	// (RFC 7692, sections 6 and 6.1).
+	if (rsv1 && (!c.compressed || opcode == OPCodeContinuationFrame || opcode >= OPCodeConnectionCloseFrame)) || rsv2 || rsv3 {
 		c.CloseWithReason(ConnectionCloseReasonProtocolError)
 		c.Terminate()
-		return false, 0, nil, ErrProtocolError
+		return false, false, 0, nil, ErrProtocolError
 	}
 
 	if !fin && (MessageType(opcode) == MessageTypePing || MessageType(opcode) == MessageTypePong) {
 		c.CloseWithReason(ConnectionCloseReasonProtocolError)
 		c.Terminate()
-		return false, 0, nil, ErrControlFragmented
+		return false, false, 0, nil, ErrControlFragmented
 	}
 
 	if maskingKey == nil {
 		err = c.CloseWithReason(ConnectionCloseReasonProtocolError)
 		if err != nil {
-			return false, 0, nil, err
+			return false, false, 0, nil, err
 		}
-		return false, 0, nil, ErrMissingMaskKey
+		return false, false, 0, nil, ErrMissingMaskKey
 	}
 
 	Unmask(payload, maskingKey) // Always masked
-	if c.compressed && (opcode != OPCodeConnectionCloseFrame) {
-		dpayload, err := Deflate(make([]byte, 0, len(payload)), payload)
-		if err != nil {
-			return false, 0, nil, err
-		}
-		return fin, opcode, dpayload, nil
+	return fin, rsv1, opcode, payload, nil
+}
+
+// failPartial fails the connection after a timeout in the middle of a
+// message: the bytes already read are lost, so the stream cannot be resumed.
+func (c *BaseConnection) failPartial() error {
+	c.CloseWithReason(ConnectionCloseReasonPolicyViolation)
+	c.Terminate()
+	return ErrPartialMessageTimeout
+}
+
+// inflate decompresses the payload of a compressed message within the limits
+// configured, closing the connection when they are exceeded.
+func (c *BaseConnection) inflate(payload []byte) ([]byte, error) {
+	dpayload, err := DeflateLimit(make([]byte, 0, len(payload)), payload, deflateLimit(len(payload), c.maxDeflateSize, c.maxDeflateRatio))
+	if err == ErrMessageTooBig {
+		c.CloseWithReason(ConnectionCloseReasonMessageTooBig)
+		c.Terminate()
 	}
-	return fin, opcode, payload, nil
+	if err != nil {
+		return nil, err
+	}
+	c.stats.compressedIn(len(payload), len(dpayload))
+	return dpayload, nil
 }
 
 // ReadPacketTimeout implements the websocket.Connection.ReadPacketTimeout
 func (c *BaseConnection) ReadPacketTimeout(timeout time.Duration) (bool, byte, []byte, error) {
-	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err == nil {
+	if err := c.conn.SetReadDeadline(deadline(timeout)); err != nil {
 		return false, 0, nil, err
 	}
 	return c.ReadPacket()
@@ -213,47 +513,119 @@ func (c *BaseConnection) Write(b []byte) (int, error) {
 	return c.conn.Write(b)
 }
 
-func (c *BaseConnection) preparePacket(opcode byte, payload []byte) ([]byte, error) {
-	return EncodePacket(true, c.compressed, false, false, opcode, uint64(len(payload)), nil, payload)
-}
-
 // WritePacket implements the websocket.Connection.WritePacket
+//
+// Writes are serialized, so it is safe to call it from different goroutines
+// (eg. broadcasting while the handler replies a message).
+//
+// Once the close frame is sent, no other frames are (RFC 6455, section 5.5.1)
+// and ErrConnectionClosing is returned.
 func (c *BaseConnection) WritePacket(opcode byte, data []byte) error {
+	return c.sendPacket(opcode, data, true)
+}
+
+// sendPacket writes the packet, compressed if asked to and the compression is
+// negotiated.
+func (c *BaseConnection) sendPacket(opcode byte, data []byte, compress bool) error {
+	return c.sendPacketTimeout(0, 0, opcode, data, compress)
+}
+
+// sendPacketTimeout is the sendPacket within the timeout, zero meaning no
+// deadline. The deadline is set while holding the writeMutex, and cleared
+// after, so it applies to this packet only. A non zero generation restricts
+// the packet to that use of the connection, ErrConnectionClosed being
+// returned when it was released since.
+//
+// A packet timing out may be written partially, so the connection is
+// aborted: its reader is woken up and terminates it. The writer does not
+// terminate it, as it may run concurrently with the reader.
+func (c *BaseConnection) sendPacketTimeout(generation uint64, timeout time.Duration, opcode byte, data []byte, compress bool) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if generation != 0 && generation != c.generation {
+		return ErrConnectionClosed
+	}
+	if c.conn == nil || c.state == ConnectionStateClosed {
+		return ErrConnectionClosed
+	}
+	if c.closeSent {
+		return ErrConnectionClosing
+	}
+	if timeout > 0 {
+		if err := c.conn.SetWriteDeadline(deadline(timeout)); err != nil {
+			return err
+		}
+		defer c.conn.SetWriteDeadline(time.Time{})
+	}
+	err := c.writePacket(opcode, data, compress)
+	if isTimeout(err) {
+		atomic.StoreInt32(&c.aborted, 1)
+		c.conn.SetReadDeadline(time.Now())
+	}
+	return err
+}
+
+// isAborted tells whether a write timed out, the stream being lost.
+func (c *BaseConnection) isAborted() bool {
+	return atomic.LoadInt32(&c.aborted) == 1
+}
+
+// writePacket writes the packet, the writeMutex must be held.
+func (c *BaseConnection) writePacket(opcode byte, data []byte, compress bool) error {
 	var err error
-	if c.compressed {
-		data, _, err = Flate(make([]byte, 0, 1024), data)
+	// Control frames are never compressed (RFC 7692, section 6.1), neither
+	// are the packets too small to be worth it, sent with the rsv1 clear.
+	compressed := compress && c.compressed && opcode < OPCodeConnectionCloseFrame && len(data) >= c.compressionThreshold
+	rawLen := len(data)
+	if compressed {
+		buff := getFlateBuffer()
+		defer putFlateBuffer(buff)
+		data, _, err = FlateLevel((*buff)[:0], data, c.compressionLevel)
 		if err != nil {
 			return err
 		}
+		// Keeps the buffer grown by the compression.
+		*buff = data
+	}
+	var header [maxFrameHeaderSize]byte
+	headerLen := putFrameHeader(header[:], true, compressed, opcode, uint64(len(data)))
+	packetLen := headerLen + len(data)
+	if packetLen <= c.writeBufferSize {
+		// Small frames are copied into a buffer, for a single write.
+		buff := getWriteBuffer(c.writeBufferSize)
+		packet := append(append((*buff)[:0], header[:headerLen]...), data...)
+		_, err = c.Write(packet)
+		writeBufferPool.Put(buff)
+	} else {
+		// Big frames are written straight from the payload, with a single
+		// writev when the connection supports it.
+		buffers := net.Buffers{header[:headerLen], data}
+		_, err = buffers.WriteTo(c.conn)
 	}
-	packet, err := c.preparePacket(opcode, data)
 	if err != nil {
 		return err
 	}
-	packetLen := len(packet)
-	for i := 0; i < packetLen; i += 997 {
-		if i+997 < packetLen {
-			_, err = c.Write(packet[i:i+997])
-		} else {
-			_, err = c.Write(packet[i:packetLen])
-		}
-		if err != nil {
-			return err
-		}
+	c.stats.frameOut(opcode, packetLen)
+	if compressed {
+		c.stats.compressedOut(len(data), rawLen)
 	}
 	return err
 }
 
 // WritePacketTimeout implements the websocket.Connection.WritePacketTimeout
 func (c *BaseConnection) WritePacketTimeout(timeout time.Duration, opcode byte, data []byte) error {
-	if err := c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
-		return err
-	}
-	return c.WritePacket(opcode, data)
+	return c.sendPacketTimeout(0, timeout, opcode, data, true)
+}
+
+// Stats implements the websocket.Connection.Stats
+func (c *BaseConnection) Stats() ConnectionStats {
+	return c.stats.snapshot()
 }
 
 // IsClosed implements the websocket.Connection.IsClosed
 func (c *BaseConnection) IsClosed() bool {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	return c.state == ConnectionStateClosed
 }
 
@@ -263,18 +635,123 @@ func (c *BaseConnection) Close() error {
 }
 
 // CloseWithReason implements the websocket.Connection.CloseWithReason
+//
+// It starts the close handshake (RFC 6455, section 7): the close frame is sent
+// only once and, from then on, the connection is read until the close frame of
+// the peer arrives, or the close timeout expires, to close the TCP connection.
+// Replying the close of the peer is the end of the handshake, so the TCP
+// connection can be closed right away.
 func (c *BaseConnection) CloseWithReason(reason ConnectionCloseReason) error {
-	c.state = ConnectionStateClosing
 	var payload [2]byte
 	binary.BigEndian.PutUint16(payload[:], uint16(reason))
-	return c.WritePacket(OPCodeConnectionCloseFrame, payload[:])
+	return c.sendClose(reason, payload[:])
+}
+
+// replyClose answers the close frame of the peer echoing its status code, or
+// with no payload when the peer sent none (RFC 6455, section 5.5.1). Nothing
+// is sent if the close frame was sent already.
+func (c *BaseConnection) replyClose(payload []byte) error {
+	if len(payload) < 2 {
+		return c.sendClose(ConnectionCloseReasonNormal, nil)
+	}
+	return c.sendClose(ConnectionCloseReason(binary.BigEndian.Uint16(payload)), payload[:2])
+}
+
+// sendClose sends the close frame with the payload, only once.
+func (c *BaseConnection) sendClose(reason ConnectionCloseReason, payload []byte) error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	if c.conn == nil || c.state == ConnectionStateClosed {
+		return ErrConnectionClosed
+	}
+	if c.closeSent {
+		return nil
+	}
+	c.state = ConnectionStateClosing
+	c.closeSent = true
+	c.closeDeadline = time.Now().Add(c.closeTimeout)
+	err := c.writePacket(OPCodeConnectionCloseFrame, payload, false)
+	if err == nil {
+		c.metrics.CloseSent(reason)
+	}
+	return err
+}
+
+// closeExpired checks if the peer did not answer the close frame sent within
+// the close timeout.
+func (c *BaseConnection) closeExpired(now time.Time) bool {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.closeSent && !now.Before(c.closeDeadline)
+}
+
+// isOpen checks if the connection is open, the close frame not being sent.
+func (c *BaseConnection) isOpen() bool {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.state == ConnectionStateOpen
+}
+
+// isClosing checks if the close frame was sent.
+func (c *BaseConnection) isClosing() bool {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
+	return c.closeSent
+}
+
+// awaitClose reads the connection until the close frame of the peer, which
+// answers the one sent, discarding any other frame. Then, or when the close
+// timeout expires, the TCP connection is closed.
+func (c *BaseConnection) awaitClose() error {
+	c.writeMutex.Lock()
+	closeDeadline := c.closeDeadline
+	c.writeMutex.Unlock()
+	if err := c.conn.SetReadDeadline(closeDeadline); err != nil {
+		c.Terminate()
+		return err
+	}
+	for {
+		_, opcode, payload, err := c.ReadPacket()
+		if err != nil {
+			c.Terminate()
+			if isTimeout(err) || err == ErrPartialMessageTimeout {
+				return ErrCloseTimeout
+			}
+			return err
+		}
+		if opcode == OPCodeConnectionCloseFrame {
+			reason := ConnectionCloseReasonNormal
+			if len(payload) >= 2 {
+				reason = ConnectionCloseReason(binary.BigEndian.Uint16(payload))
+			}
+			c.metrics.CloseReceived(reason)
+			return c.Terminate()
+		}
+	}
 }
 
 // Terminate implements the websocket.Connection.Terminate
 func (c *BaseConnection) Terminate() error {
+	c.writeMutex.Lock()
+	defer c.writeMutex.Unlock()
 	err := c.conn.Close()
 	if err == nil {
 		c.state = ConnectionStateClosed
 	}
 	return err
 }
+
+// deadline returns the deadline for the timeout. A zero timeout means no
+// deadline.
+func deadline(timeout time.Duration) time.Time {
+	if timeout == 0 {
+		return time.Time{}
+	}
+	return time.Now().Add(timeout)
+}
+
+// isTimeout checks if the error was caused by a deadline exceeded.
+func isTimeout(err error) bool {
+	netErr, ok := err.(net.Error)
+	return ok && netErr.Timeout()
+}
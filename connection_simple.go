@@ -6,7 +6,6 @@ import (
 	"unicode/utf8"
 	"encoding/binary"
 	"golang.org/x/text/encoding"
-	"log"
 )
 
 // SimpleConnection represents a connection with a client
@@ -24,21 +23,37 @@ func NewSimpleConn(conn net.Conn) *SimpleConnection {
 
 // ReadMessage implements the websocket.Connection.ReadMessage method
 func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
-	if c.state == ConnectionStateClosing {
-		return 0, nil, ErrConnectionClosing
-	}
-	if c.state == ConnectionStateClosing {
+	if c.IsClosed() {
 		return 0, nil, ErrConnectionClosed
 	}
+	if c.isClosing() {
+		// Waits for the peer to answer the close frame sent.
+		return 0, nil, c.awaitClose()
+	}
+	// Checked after the read deadline is set (see ReadMessageTimeout), so an
+	// abort either is seen here or interrupts the read.
+	if c.isAborted() {
+		return 0, nil, errConnectionAborted
+	}
 
 	var (
 		npayload []byte
 		nopcode  MessageType
+		// compressed is set by the rsv1 of the first frame, the message
+		// being inflated once reassembled.
+		compressed bool
+		text       utf8Validator
 	)
 	for {
-		fin, opc, payload, err := c.ReadPacket()
+		fin, rsv1, opc, payload, err := c.readFrame()
 
+		if err != nil && c.isAborted() {
+			return 0, nil, errConnectionAborted
+		}
 		if err != nil {
+			if isTimeout(err) && npayload != nil {
+				return 0, nil, c.failPartial()
+			}
 			return 0, nil, err
 		}
 
@@ -57,7 +72,7 @@ func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
 			}
 			switch opcode {
 			case MessageTypePing:
-				if c.state == ConnectionStateOpen {
+				if c.isOpen() {
 					// Respond the ping message with payload
 					err = c.WritePacketTimeout(time.Millisecond*10, OPCodePongFrame, payload)
 					if err != nil {
@@ -77,14 +92,16 @@ func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
 					c.Terminate()
 					return 0, nil, nil
 				}
+				closePayload := payload
 				closingReason := ConnectionCloseReasonNormal
 				if len(payload) >= 2 {
 					closingReason = ConnectionCloseReason(uint16(binary.BigEndian.Uint16(payload[:2])))
 					payload = payload[2:]
 				}
+				c.metrics.CloseReceived(closingReason)
 
 				switch closingReason {
-				case ConnectionCloseReasonNormal, ConnectionCloseReasonGoingDown, ConnectionCloseReasonProtocolError,  ConnectionCloseReasonDataTypeUnsupported, ConnectionCloseReasonInconsistentType, ConnectionCloseReasonPolicyViolation, ConnectionCloseReasonMessageTooBig, ConnectionCloseReasonCouldNotNegotiateExtensions, ConnectionCloseReasonUnexpected:
+				case ConnectionCloseReasonNormal, ConnectionCloseReasonGoingDown, ConnectionCloseReasonProtocolError,  ConnectionCloseReasonDataTypeUnsupported, ConnectionCloseReasonInconsistentType, ConnectionCloseReasonPolicyViolation, ConnectionCloseReasonMessageTooBig, ConnectionCloseReasonCouldNotNegotiateExtensions, ConnectionCloseReasonUnexpected, ConnectionCloseReasonTryAgainLater:
 				default:
 					if closingReason < 3000 || closingReason >= 5000 {
 						c.CloseWithReason(ConnectionCloseReasonProtocolError)
@@ -94,17 +111,23 @@ func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
 				}
 
 				if !utf8.Valid(payload) {
-					log.Println(string(payload))
+					c.logger.Debug("websocket: invalid close reason", "remote", c.conn.RemoteAddr(), "error", encoding.ErrInvalidUTF8)
 					c.CloseWithReason(ConnectionCloseReasonInconsistentType)
 					c.Terminate()
 					return 0, nil, encoding.ErrInvalidUTF8
 				}
-				c.state = ConnectionStateClosing
-				c.Close()
+				// The close is answered and, as it ends the handshake, the
+				// TCP connection is closed (RFC 6455, section 7.1.1).
+				c.replyClose(closePayload)
 				err = c.Terminate()
 				return 0, nil, err
 			}
 		case MessageTypeContinuation, MessageTypeBinary, MessageTypeText:
+			if c.maxMessageSize > 0 && len(npayload)+len(payload) > c.maxMessageSize {
+				c.CloseWithReason(ConnectionCloseReasonMessageTooBig)
+				c.Terminate()
+				return 0, nil, ErrMessageTooBig
+			}
 			if fin {
 				if opcode == MessageTypeContinuation {
 					if npayload == nil { // If receiving a end of continuation without expecting one
@@ -113,11 +136,22 @@ func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
 						return 0, nil, ErrProtocolError
 					}
 					npayload = append(npayload, payload...)
-					if nopcode == MessageTypeText && !utf8.Valid(npayload) {
+					valid := true
+					if compressed {
+						if npayload, err = c.inflate(npayload); err != nil {
+							return 0, nil, err
+						}
+						valid = nopcode != MessageTypeText || utf8.Valid(npayload)
+					} else if nopcode == MessageTypeText {
+						// The text was validated as it arrived.
+						valid = text.Write(payload) && text.Done()
+					}
+					if !valid {
 						c.CloseWithReason(ConnectionCloseReasonInconsistentType)
 						c.Terminate()
 						return 0, nil, encoding.ErrInvalidUTF8
 					}
+					c.stats.messageIn()
 					return nopcode, npayload, nil
 				}
 				if npayload != nil { // If receiving a non continuation frame expecting one
@@ -125,11 +159,17 @@ func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
 					c.Terminate()
 					return 0, nil, ErrProtocolError
 				}
+				if rsv1 {
+					if payload, err = c.inflate(payload); err != nil {
+						return 0, nil, err
+					}
+				}
 				if opcode == MessageTypeText && !utf8.Valid(payload) {
 					c.CloseWithReason(ConnectionCloseReasonInconsistentType)
 					c.Terminate()
 					return 0, nil, encoding.ErrInvalidUTF8
 				}
+				c.stats.messageIn()
 				return opcode, payload, nil
 			}
 			if npayload == nil {
@@ -140,6 +180,7 @@ func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
 				}
 				npayload = make([]byte, len(payload))
 				nopcode = opcode
+				compressed = rsv1
 				copy(npayload[:len(payload)], payload)
 			} else {
 				if opcode != MessageTypeContinuation { // If receiving a non continuation after sending a prior fragment
@@ -151,6 +192,12 @@ func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
 				npayload = append(npayload, make([]byte, len(payload))...)
 				copy(npayload[lp:], payload)
 			}
+			// Invalid text fails right away, not after the last fragment.
+			if nopcode == MessageTypeText && !compressed && !text.Write(payload) {
+				c.CloseWithReason(ConnectionCloseReasonInconsistentType)
+				c.Terminate()
+				return 0, nil, encoding.ErrInvalidUTF8
+			}
 		default:
 			// Unknown opcode
 			c.CloseWithReason(ConnectionCloseReasonProtocolError)
@@ -162,7 +209,7 @@ func (c *SimpleConnection) ReadMessage() (MessageType, []byte, error) {
 
 // ReadMessageTimeout implements the websocket.Connection.ReadMessageTimeout method
 func (c *SimpleConnection) ReadMessageTimeout(timeout time.Duration) (MessageType, []byte, error) {
-	if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+	if err := c.conn.SetReadDeadline(deadline(timeout)); err != nil {
 		return 0, nil, err
 	}
 	return c.ReadMessage()
@@ -170,13 +217,55 @@ func (c *SimpleConnection) ReadMessageTimeout(timeout time.Duration) (MessageTyp
 
 // WriteMessage implements the websocket.Connection.WriteMessage method
 func (c *SimpleConnection) WriteMessage(opcode MessageType, payload []byte) error {
-	return c.WritePacket(byte(opcode), payload)
+	return c.WriteMessageWithOptions(opcode, payload, WriteMessageOptions{
+		Compress: true,
+	})
+}
+
+// WriteMessageWithOptions implements the websocket.Connection.WriteMessageWithOptions method
+func (c *SimpleConnection) WriteMessageWithOptions(opcode MessageType, payload []byte, options WriteMessageOptions) error {
+	return c.writeMessage(0, 0, opcode, payload, options.Compress)
 }
 
 // WriteMessageTimeout implements the websocket.Connection.WriteMessageTimeout method
 func (c *SimpleConnection) WriteMessageTimeout(timeout time.Duration, opcode MessageType, payload []byte) error {
-	if err := c.conn.SetWriteDeadline(time.Now().Add(timeout)); err != nil {
-		return err
+	return c.writeMessage(0, timeout, opcode, payload, true)
+}
+
+// writeMessageGeneration is the WriteMessageTimeout restricted to the given
+// use of the connection.
+func (c *SimpleConnection) writeMessageGeneration(generation uint64, timeout time.Duration, opcode MessageType, payload []byte) error {
+	return c.writeMessage(generation, timeout, opcode, payload, true)
+}
+
+// writeMessage writes the message within the timeout, zero meaning no
+// deadline, to the given generation of the connection, zero meaning any.
+func (c *SimpleConnection) writeMessage(generation uint64, timeout time.Duration, opcode MessageType, payload []byte, compress bool) error {
+	err := c.sendPacketTimeout(generation, timeout, byte(opcode), payload, compress)
+	if err == nil && (opcode == MessageTypeText || opcode == MessageTypeBinary) {
+		c.stats.messageOut()
+		c.metrics.MessageSent(opcode, len(payload))
+		c.trace.written(opcode, len(payload))
 	}
-	return c.WriteMessage(opcode, payload)
+	return err
+}
+
+// ReadValue implements the websocket.Connection.ReadValue method
+func (c *SimpleConnection) ReadValue(codec Codec, v interface{}) error {
+	return readValue(c, codec, v)
+}
+
+// WriteValue implements the websocket.Connection.WriteValue method
+func (c *SimpleConnection) WriteValue(codec Codec, v interface{}) error {
+	return writeValue(c, codec, v)
+}
+
+// ReadJSON implements the websocket.Connection.ReadJSON method
+func (c *SimpleConnection) ReadJSON(v interface{}) error {
+	return c.ReadValue(JSONCodec{}, v)
+}
+
+// WriteJSON implements the websocket.Connection.WriteJSON method
+func (c *SimpleConnection) WriteJSON(v interface{}) error {
+	return c.WriteValue(JSONCodec{}, v)
 }
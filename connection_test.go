@@ -0,0 +1,330 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+)
+
+// recordingConn records the writes, keeping the slices written.
+type recordingConn struct {
+	streamConn
+	writes [][]byte
+}
+
+func (c *recordingConn) Write(b []byte) (int, error) {
+	c.writes = append(c.writes, b)
+	return len(b), nil
+}
+
+func (c *recordingConn) written() []byte {
+	return bytes.Join(c.writes, nil)
+}
+
+var _ = Describe("Connection", func() {
+	Describe("WritePacket", func() {
+		var (
+			conn *recordingConn
+			c    *SimpleConnection
+		)
+
+		BeforeEach(func() {
+			conn = &recordingConn{}
+			c = NewSimpleConn(conn)
+			c.Init(&ConnectionContext{
+				Conn: conn,
+			})
+		})
+
+		It("should write small frames with a single write", func() {
+			payload := bytes.Repeat([]byte("a"), 200)
+			Expect(c.WritePacket(OPCodeTextFrame, payload)).To(Succeed())
+			Expect(conn.writes).To(HaveLen(1))
+			packet, err := EncodePacket(true, false, false, false, OPCodeTextFrame, uint64(len(payload)), nil, payload)
+			Expect(err).To(BeNil())
+			Expect(conn.written()).To(Equal(packet))
+		})
+
+		It("should write big frames straight from the payload", func() {
+			payload := bytes.Repeat([]byte("a"), 70000)
+			Expect(c.WritePacket(OPCodeBinaryFrame, payload)).To(Succeed())
+			Expect(conn.writes).To(HaveLen(2))
+			Expect(&conn.writes[1][0]).To(BeIdenticalTo(&payload[0]))
+			packet, err := EncodePacket(true, false, false, false, OPCodeBinaryFrame, uint64(len(payload)), nil, payload)
+			Expect(err).To(BeNil())
+			Expect(conn.written()).To(Equal(packet))
+		})
+
+		It("should write through a buffer of the configured size", func() {
+			c.setWriteBufferSize(64)
+			Expect(c.WritePacket(OPCodeTextFrame, bytes.Repeat([]byte("a"), 62))).To(Succeed())
+			Expect(conn.writes).To(HaveLen(1))
+			Expect(c.WritePacket(OPCodeTextFrame, bytes.Repeat([]byte("a"), 63))).To(Succeed())
+			Expect(conn.writes).To(HaveLen(3))
+		})
+
+		It("should send the packets under the compression threshold uncompressed", func() {
+			c.Init(&ConnectionContext{
+				Conn:       conn,
+				Compressed: true,
+			})
+			c.setCompression(flate.BestCompression, 64)
+			Expect(c.WritePacket(OPCodeTextFrame, []byte("Hello"))).To(Succeed())
+			_, rsv1, _, _, _, _, _, payload, err := DecodePacket(conn.written())
+			Expect(err).To(BeNil())
+			Expect(rsv1).To(BeFalse())
+			Expect(string(payload)).To(Equal("Hello"))
+
+			conn.writes = nil
+			message := bytes.Repeat([]byte("Hello"), 20)
+			Expect(c.WritePacket(OPCodeTextFrame, message)).To(Succeed())
+			_, rsv1, _, _, _, _, _, payload, err = DecodePacket(conn.written())
+			Expect(err).To(BeNil())
+			Expect(rsv1).To(BeTrue())
+			expected, _, err := FlateLevel(nil, message, flate.BestCompression)
+			Expect(err).To(BeNil())
+			Expect(payload).To(Equal(expected))
+		})
+
+		It("should use the default compression level for invalid levels", func() {
+			c.setCompression(flate.BestCompression+1, 0)
+			Expect(c.compressionLevel).To(Equal(DefaultCompressionLevel))
+			c.setCompression(0, 0)
+			Expect(c.compressionLevel).To(Equal(DefaultCompressionLevel))
+			c.setCompression(flate.HuffmanOnly, 0)
+			Expect(c.compressionLevel).To(Equal(flate.HuffmanOnly))
+		})
+
+		It("should compress the messages per write", func() {
+			c.Init(&ConnectionContext{
+				Conn:       conn,
+				Compressed: true,
+			})
+			message := bytes.Repeat([]byte("Hello"), 20)
+			Expect(c.WriteMessageWithOptions(MessageTypeBinary, message, WriteMessageOptions{})).To(Succeed())
+			_, rsv1, _, _, _, _, _, payload, err := DecodePacket(conn.written())
+			Expect(err).To(BeNil())
+			Expect(rsv1).To(BeFalse())
+			Expect(payload).To(Equal(message))
+
+			conn.writes = nil
+			Expect(c.WriteMessageWithOptions(MessageTypeBinary, message, WriteMessageOptions{Compress: true})).To(Succeed())
+			_, rsv1, _, _, _, _, _, payload, err = DecodePacket(conn.written())
+			Expect(err).To(BeNil())
+			Expect(rsv1).To(BeTrue())
+			payload, err = Deflate(nil, payload)
+			Expect(err).To(BeNil())
+			Expect(payload).To(Equal(message))
+			Expect(c.Stats().MessagesOut).To(Equal(uint64(2)))
+		})
+
+		It("should count the bytes of the frames written", func() {
+			Expect(c.WritePacket(OPCodeTextFrame, bytes.Repeat([]byte("a"), 200))).To(Succeed())
+			Expect(c.WritePacket(OPCodeBinaryFrame, bytes.Repeat([]byte("a"), 70000))).To(Succeed())
+			Expect(c.Stats().BytesOut).To(Equal(uint64(len(conn.written()))))
+		})
+	})
+})
+
+var _ = Describe("Connection", func() {
+	Describe("ReadMessage with compression", func() {
+		var (
+			server, client net.Conn
+			c              *SimpleConnection
+		)
+
+		BeforeEach(func() {
+			server, client = net.Pipe()
+			c = NewSimpleConn(server)
+			c.Init(&ConnectionContext{
+				Conn:       server,
+				Compressed: true,
+			})
+		})
+
+		AfterEach(func() {
+			client.Close()
+		})
+
+		It("should answer pings with a payload", func() {
+			writeFrames(client, maskedFrame(true, OPCodePingFrame, []byte("ping")))
+			done := make(chan error, 1)
+			go func() {
+				_, _, err := c.ReadMessage()
+				done <- err
+			}()
+			Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodePongFrame, "ping"}}))
+			Eventually(done).Should(Receive(BeNil()))
+		})
+
+		It("should read uncompressed messages", func() {
+			writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+			opcode, payload, err := c.ReadMessage()
+			Expect(err).To(BeNil())
+			Expect(opcode).To(Equal(MessageTypeText))
+			Expect(string(payload)).To(Equal("Hello"))
+		})
+
+		It("should inflate fragmented messages once reassembled", func() {
+			message := bytes.Repeat([]byte("Hello"), 100)
+			flated, _, err := Flate(nil, message)
+			Expect(err).To(BeNil())
+			writeFrames(client,
+				compressedFrame(false, OPCodeTextFrame, flated[:10]),
+				maskedFrame(true, OPCodePingFrame, []byte("ping")),
+				maskedFrame(true, OPCodeContinuationFrame, flated[10:]),
+			)
+			go io.Copy(ioutil.Discard, client)
+			opcode, payload, err := c.ReadMessage()
+			Expect(err).To(BeNil())
+			Expect(opcode).To(Equal(MessageTypeText))
+			Expect(payload).To(Equal(message))
+			Expect(c.Stats().RawBytesIn).To(Equal(uint64(len(message))))
+		})
+
+		It("should fail continuation frames flagged as compressed", func() {
+			flated, _, err := Flate(nil, []byte("Hello"))
+			Expect(err).To(BeNil())
+			writeFrames(client,
+				compressedFrame(false, OPCodeTextFrame, flated[:2]),
+				compressedFrame(true, OPCodeContinuationFrame, flated[2:]),
+			)
+			go io.Copy(ioutil.Discard, client)
+			_, _, err = c.ReadMessage()
+			Expect(err).To(Equal(ErrProtocolError))
+		})
+	})
+})
+
+// countingConn discards the writes, counting them.
+type countingConn struct {
+	streamConn
+	writes int
+}
+
+func (c *countingConn) Write(b []byte) (int, error) {
+	c.writes++
+	return len(b), nil
+}
+
+// writeChunked is how the frames were written before the write buffer: the
+// payload is copied after the header, then written 997 bytes at a time.
+func writeChunked(conn net.Conn, opcode byte, payload []byte) error {
+	packet, err := EncodePacket(true, false, false, false, opcode, uint64(len(payload)), nil, payload)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < len(packet); i += 997 {
+		end := i + 997
+		if end > len(packet) {
+			end = len(packet)
+		}
+		if _, err = conn.Write(packet[i:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var benchmarkWriteSizes = []int{128, 4 * 1024, 64 * 1024, 1024 * 1024}
+
+func BenchmarkWritePacket(b *testing.B) {
+	for _, size := range benchmarkWriteSizes {
+		payload := make([]byte, size)
+		b.Run(fmt.Sprintf("buffered/%d", size), func(b *testing.B) {
+			conn := &countingConn{}
+			c := NewSimpleConn(conn)
+			c.Init(&ConnectionContext{Conn: conn})
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := c.WritePacket(OPCodeBinaryFrame, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+		})
+		b.Run(fmt.Sprintf("compressed/%d", size), func(b *testing.B) {
+			conn := &countingConn{}
+			c := NewSimpleConn(conn)
+			c.Init(&ConnectionContext{Conn: conn, Compressed: true})
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := c.WritePacket(OPCodeBinaryFrame, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("chunked/%d", size), func(b *testing.B) {
+			conn := &countingConn{}
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := writeChunked(conn, OPCodeBinaryFrame, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+			b.ReportMetric(float64(conn.writes)/float64(b.N), "writes/op")
+		})
+	}
+}
+
+// BenchmarkWritePacketTCP writes to a loopback TCP connection, where the big
+// frames are written with writev.
+func BenchmarkWritePacketTCP(b *testing.B) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go io.Copy(ioutil.Discard, conn)
+		}
+	}()
+	for _, size := range benchmarkWriteSizes {
+		payload := make([]byte, size)
+		b.Run(fmt.Sprintf("buffered/%d", size), func(b *testing.B) {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			c := NewSimpleConn(conn)
+			c.Init(&ConnectionContext{Conn: conn})
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := c.WritePacket(OPCodeBinaryFrame, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("chunked/%d", size), func(b *testing.B) {
+			conn, err := net.Dial("tcp", listener.Addr().String())
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer conn.Close()
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := writeChunked(conn, OPCodeBinaryFrame, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
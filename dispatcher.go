@@ -0,0 +1,182 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+)
+
+var (
+	ErrDispatcherQueueFull = errors.New("Dispatcher queue full")
+	ErrDispatcherClosed    = errors.New("Dispatcher closed")
+)
+
+// QueueFullPolicy defines what the websocket.Dispatcher does with a message
+// when the queue of the connection is full.
+type QueueFullPolicy byte
+
+const (
+	// QueueFullBlock blocks the reading of the connection until its queue
+	// has room for the message.
+	QueueFullBlock QueueFullPolicy = iota
+	// QueueFullDrop discards the message, reporting ErrDispatcherQueueFull to
+	// the OnMessageError handler.
+	QueueFullDrop
+	// QueueFullClose closes the connection with the
+	// ConnectionCloseReasonTryAgainLater reason, reporting
+	// ErrDispatcherQueueFull to the OnMessageError handler.
+	QueueFullClose
+)
+
+// Dispatcher runs the message handlers on a bounded pool of workers, so the
+// amount of concurrent handler work is capped and a slow handler does not
+// block the reading of its connection (pings are still answered).
+//
+// Each connection has its own queue, taken by any free worker while it has
+// messages, hence the messages of a connection are always handled in order
+// and a slow handler holds only its own connection.
+type Dispatcher struct {
+	queueSize int
+	queueFull QueueFullPolicy
+	mutex     sync.Mutex
+	// cond signals the workers a queue is ready, or the dispatcher closed.
+	cond   *sync.Cond
+	ready  []*dispatchQueue
+	closed bool
+	wg     sync.WaitGroup
+}
+
+// dispatchQueue is the queue of the messages of a connection. It is in the
+// ready list, or taken by a worker, while it has messages.
+type dispatchQueue struct {
+	d     *Dispatcher
+	mutex sync.Mutex
+	// room signals the readers blocked by a full queue a message was taken.
+	room      *sync.Cond
+	jobs      []func()
+	scheduled bool
+}
+
+// NewDispatcher returns a new instance of the websocket.Dispatcher with the
+// given number of workers, each connection having a queue of queueSize
+// messages (at least one).
+func NewDispatcher(workers, queueSize int, queueFull QueueFullPolicy) *Dispatcher {
+	if workers <= 0 {
+		workers = 1
+	}
+	if queueSize <= 0 {
+		queueSize = 1
+	}
+	d := &Dispatcher{
+		queueSize: queueSize,
+		queueFull: queueFull,
+	}
+	d.cond = sync.NewCond(&d.mutex)
+	d.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go d.work()
+	}
+	return d
+}
+
+func (d *Dispatcher) work() {
+	defer d.wg.Done()
+	for {
+		d.mutex.Lock()
+		for len(d.ready) == 0 && !d.closed {
+			d.cond.Wait()
+		}
+		if len(d.ready) == 0 {
+			// Closed, with all messages handled.
+			d.mutex.Unlock()
+			return
+		}
+		q := d.ready[0]
+		d.ready[0] = nil
+		d.ready = d.ready[1:]
+		d.mutex.Unlock()
+		q.runNext()
+	}
+}
+
+// schedule appends the queue to the ready list.
+func (d *Dispatcher) schedule(q *dispatchQueue) {
+	d.mutex.Lock()
+	d.ready = append(d.ready, q)
+	d.mutex.Unlock()
+	d.cond.Signal()
+}
+
+func (d *Dispatcher) isClosed() bool {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	return d.closed
+}
+
+// queue returns a new queue, for a new connection.
+func (d *Dispatcher) queue() *dispatchQueue {
+	q := &dispatchQueue{
+		d: d,
+	}
+	q.room = sync.NewCond(&q.mutex)
+	return q
+}
+
+// runNext handles the next message of the queue, scheduling it again when
+// there are more, so the connections take turns on the workers.
+func (q *dispatchQueue) runNext() {
+	q.mutex.Lock()
+	job := q.jobs[0]
+	q.jobs[0] = nil
+	q.jobs = q.jobs[1:]
+	q.mutex.Unlock()
+	q.room.Broadcast()
+
+	job()
+
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	if len(q.jobs) == 0 {
+		q.scheduled = false
+		return
+	}
+	q.d.schedule(q)
+}
+
+// dispatch enqueues the job following the QueueFullPolicy. No lock of the
+// dispatcher is held while blocked by a full queue.
+func (d *Dispatcher) dispatch(q *dispatchQueue, job func()) error {
+	q.mutex.Lock()
+	defer q.mutex.Unlock()
+	for {
+		if d.isClosed() {
+			return ErrDispatcherClosed
+		}
+		if len(q.jobs) < d.queueSize {
+			break
+		}
+		if d.queueFull != QueueFullBlock {
+			return ErrDispatcherQueueFull
+		}
+		// The queue is full, hence scheduled: a worker makes room.
+		q.room.Wait()
+	}
+	q.jobs = append(q.jobs, job)
+	if !q.scheduled {
+		q.scheduled = true
+		d.schedule(q)
+	}
+	return nil
+}
+
+// Close waits the enqueued messages to be handled and stops the workers.
+func (d *Dispatcher) Close() {
+	d.mutex.Lock()
+	if d.closed {
+		d.mutex.Unlock()
+		return
+	}
+	d.closed = true
+	d.mutex.Unlock()
+	d.cond.Broadcast()
+	d.wg.Wait()
+}
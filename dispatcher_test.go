@@ -0,0 +1,196 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Dispatcher", func() {
+	It("should keep the messages of a connection in order", func() {
+		dispatcher := NewDispatcher(4, 16, QueueFullBlock)
+		defer dispatcher.Close()
+		manager := NewListeableManager()
+		manager.ReadTimeout = time.Second
+		manager.Dispatcher = dispatcher
+		var (
+			mutex    sync.Mutex
+			received []string
+		)
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			time.Sleep(time.Millisecond)
+			mutex.Lock()
+			received = append(received, string(payload))
+			mutex.Unlock()
+			return nil
+		}
+		manager.OnClose = func(conn Connection) error {
+			return nil
+		}
+
+		client, done := acceptPipe(manager)
+		expected := make([]string, 50)
+		frames := make([][]byte, 50)
+		for i := range frames {
+			expected[i] = fmt.Sprintf("message %d", i)
+			frames[i] = maskedFrame(true, OPCodeTextFrame, []byte(expected[i]))
+		}
+		writeFrames(client, frames...)
+		Eventually(func() []string {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return append([]string{}, received...)
+		}).Should(Equal(expected))
+		client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should cap the concurrent handlers to the number of workers", func() {
+		dispatcher := NewDispatcher(2, 16, QueueFullBlock)
+		defer dispatcher.Close()
+		manager := NewListeableManager()
+		manager.ReadTimeout = time.Second
+		manager.Dispatcher = dispatcher
+		var (
+			mutex            sync.Mutex
+			running, maximum int
+			handled          int
+		)
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			mutex.Lock()
+			running++
+			if running > maximum {
+				maximum = running
+			}
+			mutex.Unlock()
+			time.Sleep(time.Millisecond * 10)
+			mutex.Lock()
+			running--
+			handled++
+			mutex.Unlock()
+			return nil
+		}
+		manager.OnClose = func(conn Connection) error {
+			return nil
+		}
+
+		for i := 0; i < 6; i++ {
+			client, _ := acceptPipe(manager)
+			defer client.Close()
+			writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")), maskedFrame(true, OPCodeTextFrame, []byte("World")))
+		}
+		Eventually(func() int {
+			mutex.Lock()
+			defer mutex.Unlock()
+			return handled
+		}).Should(Equal(12))
+		Expect(maximum).To(Equal(2))
+	})
+
+	It("should not let a slow handler hold the other connections", func() {
+		dispatcher := NewDispatcher(2, 16, QueueFullBlock)
+		defer dispatcher.Close()
+		manager := NewListeableManager()
+		manager.ReadTimeout = time.Second
+		manager.Dispatcher = dispatcher
+		release := make(chan struct{})
+		handled := make(chan string, 10)
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			if string(payload) == "slow" {
+				<-release
+			}
+			handled <- string(payload)
+			return nil
+		}
+		manager.OnClose = func(conn Connection) error {
+			return nil
+		}
+
+		slow, _ := acceptPipe(manager)
+		defer slow.Close()
+		defer close(release)
+		writeFrames(slow, maskedFrame(true, OPCodeTextFrame, []byte("slow")))
+		// More connections than workers, so they cannot all have their own.
+		for i := 0; i < 3; i++ {
+			client, _ := acceptPipe(manager)
+			defer client.Close()
+			writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("fast")), maskedFrame(true, OPCodeTextFrame, []byte("fast")))
+		}
+		for i := 0; i < 6; i++ {
+			Eventually(handled).Should(Receive(Equal("fast")))
+		}
+	})
+
+	It("should drop messages when the queue is full", func() {
+		dispatcher := NewDispatcher(1, 1, QueueFullDrop)
+		defer dispatcher.Close()
+		manager := NewListeableManager()
+		manager.ReadTimeout = time.Second
+		manager.Dispatcher = dispatcher
+		started := make(chan struct{}, 3)
+		release := make(chan struct{})
+		handled := make(chan string, 3)
+		errs := make(chan error, 3)
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			started <- struct{}{}
+			<-release
+			handled <- string(payload)
+			return nil
+		}
+		manager.OnMessageError = func(conn Connection, err error) {
+			errs <- err
+		}
+		manager.OnClose = func(conn Connection) error {
+			return nil
+		}
+
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("1")))
+		Eventually(started).Should(Receive())
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("2")), maskedFrame(true, OPCodeTextFrame, []byte("3")))
+		Eventually(errs).Should(Receive(Equal(ErrDispatcherQueueFull)))
+		close(release)
+		Eventually(handled).Should(Receive(Equal("1")))
+		Eventually(handled).Should(Receive(Equal("2")))
+		Consistently(handled, time.Millisecond*50).ShouldNot(Receive())
+		client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should close only the connection of a panicking handler", func() {
+		dispatcher := NewDispatcher(1, 16, QueueFullBlock)
+		defer dispatcher.Close()
+		manager := NewListeableManager()
+		manager.ReadTimeout = time.Second
+		manager.Dispatcher = dispatcher
+		errs := make(chan error, 3)
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			if string(payload) == "boom" {
+				panic("boom")
+			}
+			return conn.WriteMessage(opcode, payload)
+		}
+		manager.OnMessageError = func(conn Connection, err error) {
+			errs <- err
+		}
+
+		client1, done1 := acceptPipe(manager)
+		writeFrames(client1, maskedFrame(true, OPCodeTextFrame, []byte("boom")))
+		frames := readFrames(client1, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonUnexpected))
+		Eventually(errs).Should(Receive(MatchError("boom")))
+		writeFrames(client1, maskedFrame(true, OPCodeConnectionCloseFrame, []byte(frames[0].payload)))
+		Eventually(done1).Should(Receive(BeNil()))
+
+		client2, done2 := acceptPipe(manager)
+		writeFrames(client2, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(readFrames(client2, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+		client2.Close()
+		Eventually(done2).Should(Receive(BeNil()))
+	})
+})
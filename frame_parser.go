@@ -0,0 +1,129 @@
+package websocket
+
+// FrameHeader is the header of a frame decoded by the websocket.FrameParser
+// or websocket.DecodeHeader.
+type FrameHeader struct {
+	Fin        bool
+	Rsv1       bool
+	Rsv2       bool
+	Rsv3       bool
+	OPCode     byte
+	Masked     bool
+	MaskingKey [4]byte
+	PayloadLen uint64
+}
+
+// FrameParser is a resumable, non-blocking, frame decoder. It accepts the data
+// in chunks of any size, as they arrive from the network, keeping the state of
+// the frame being decoded between calls. Hence, it can be used from event
+// loops, tests and proxies, where blocking on a reader is not an option.
+//
+// Unless KeepMasked is set, the payload is unmasked in place, so the chunks
+// given to Feed are modified.
+type FrameParser struct {
+	// OnHeader is called when the header of a frame is completely decoded.
+	OnHeader func(header *FrameHeader) error
+	// OnPayload is called for each segment of the payload available. The
+	// final flag is set when the segment is the last one of the frame. Frames
+	// with no payload trigger a single call with an empty segment.
+	//
+	// The segment references the chunk given to Feed, it must be copied if
+	// it is going to be used after the callback returns.
+	OnPayload func(header *FrameHeader, segment []byte, final bool) error
+	// KeepMasked makes the parser emit the payload segments as received.
+	KeepMasked bool
+
+	header     FrameHeader
+	headerBuff [14]byte
+	headerLen  int
+	inPayload  bool
+	remaining  uint64
+	offset     uint64
+}
+
+// Reset discards any partial frame, preparing the parser for a new stream.
+func (p *FrameParser) Reset() {
+	p.headerLen = 0
+	p.inPayload = false
+	p.remaining = 0
+	p.offset = 0
+}
+
+// headerSize returns the size of the header being decoded, or 0 when it is
+// not possible to know it yet.
+func (p *FrameParser) headerSize() int {
+	if p.headerLen < 2 {
+		return 0
+	}
+	return frameHeaderSize(p.headerBuff[positionMaskPayloadLen])
+}
+
+// Feed decodes the given chunk. Errors returned by the callbacks are returned
+// right away and the rest of the chunk is not processed. Headers violating the
+// protocol fail with websocket.ErrProtocolError, the stream being lost.
+func (p *FrameParser) Feed(data []byte) error {
+	for len(data) > 0 {
+		if !p.inPayload {
+			// Collects the header byte by byte until its size is known, then
+			// the rest of it at once.
+			if size := p.headerSize(); size == 0 {
+				p.headerBuff[p.headerLen] = data[0]
+				p.headerLen++
+				data = data[1:]
+			} else {
+				n := copy(p.headerBuff[p.headerLen:size], data)
+				p.headerLen += n
+				data = data[n:]
+			}
+			size := p.headerSize()
+			if size == 0 || p.headerLen < size {
+				continue
+			}
+			if _, err := DecodeHeader(p.headerBuff[:size], &p.header); err != nil {
+				return err
+			}
+			p.headerLen = 0
+			p.offset = 0
+			p.remaining = p.header.PayloadLen
+			if p.OnHeader != nil {
+				if err := p.OnHeader(&p.header); err != nil {
+					return err
+				}
+			}
+			if p.remaining == 0 {
+				if err := p.emit(data[:0], true); err != nil {
+					return err
+				}
+				continue
+			}
+			p.inPayload = true
+			continue
+		}
+
+		segment := data
+		if uint64(len(segment)) > p.remaining {
+			segment = segment[:p.remaining]
+		}
+		data = data[len(segment):]
+		p.remaining -= uint64(len(segment))
+		final := p.remaining == 0
+		if final {
+			p.inPayload = false
+		}
+		if err := p.emit(segment, final); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *FrameParser) emit(segment []byte, final bool) error {
+	if p.header.Masked && !p.KeepMasked {
+		UnmaskAt(segment, p.header.MaskingKey, p.offset)
+	}
+	p.offset += uint64(len(segment))
+	if p.OnPayload != nil {
+		return p.OnPayload(&p.header, segment, final)
+	}
+	return nil
+}
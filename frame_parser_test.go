@@ -0,0 +1,147 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+)
+
+type parsedFrame struct {
+	header   FrameHeader
+	payload  []byte
+	segments int
+}
+
+// collectFrames returns a parser that appends all the frames decoded to the
+// given list.
+func collectFrames(frames *[]parsedFrame) *FrameParser {
+	return &FrameParser{
+		OnHeader: func(header *FrameHeader) error {
+			*frames = append(*frames, parsedFrame{
+				header:  *header,
+				payload: []byte{},
+			})
+			return nil
+		},
+		OnPayload: func(header *FrameHeader, segment []byte, final bool) error {
+			frame := &(*frames)[len(*frames)-1]
+			frame.payload = append(frame.payload, segment...)
+			frame.segments++
+			return nil
+		},
+	}
+}
+
+func copyBytes(data []byte) []byte {
+	result := make([]byte, len(data))
+	copy(result, data)
+	return result
+}
+
+var _ = Describe("FrameParser", func() {
+	It("should parse a single-frame unmasked text message", func() {
+		var frames []parsedFrame
+		parser := collectFrames(&frames)
+		Expect(parser.Feed(copyBytes(singleFrameUnmaskedText))).To(Succeed())
+		Expect(frames).To(HaveLen(1))
+		Expect(frames[0].header.Fin).To(BeTrue())
+		Expect(frames[0].header.OPCode).To(Equal(OPCodeTextFrame))
+		Expect(frames[0].header.Masked).To(BeFalse())
+		Expect(frames[0].header.PayloadLen).To(Equal(uint64(5)))
+		Expect(frames[0].payload).To(Equal(singleFrameUnmaskedTextPayload))
+	})
+
+	It("should parse and unmask a single-frame masked text message fed byte by byte", func() {
+		var frames []parsedFrame
+		parser := collectFrames(&frames)
+		for _, b := range copyBytes(singleFrameMaskedText) {
+			Expect(parser.Feed([]byte{b})).To(Succeed())
+		}
+		Expect(frames).To(HaveLen(1))
+		Expect(frames[0].header.Masked).To(BeTrue())
+		Expect(frames[0].header.MaskingKey[:]).To(Equal(singleFrameMaskedTextMask))
+		Expect(frames[0].payload).To(Equal([]byte("Hello")))
+		Expect(frames[0].segments).To(Equal(5))
+	})
+
+	It("should keep the payload masked", func() {
+		var frames []parsedFrame
+		parser := collectFrames(&frames)
+		parser.KeepMasked = true
+		Expect(parser.Feed(copyBytes(singleFrameMaskedText))).To(Succeed())
+		Expect(frames[0].payload).To(Equal(singleFrameMaskedTextPayload))
+	})
+
+	It("should parse many frames in a single chunk", func() {
+		var frames []parsedFrame
+		parser := collectFrames(&frames)
+		stream := append(copyBytes(fragmentedUnmaskedText1), fragmentedUnmaskedText2...)
+		stream = append(stream, singleFrameUnmaskedZeroLengthText...)
+		Expect(parser.Feed(stream)).To(Succeed())
+		Expect(frames).To(HaveLen(3))
+		Expect(frames[0].header.Fin).To(BeFalse())
+		Expect(frames[0].payload).To(Equal(fragmentedUnmaskedText1Payload))
+		Expect(frames[1].header.Fin).To(BeTrue())
+		Expect(frames[1].header.OPCode).To(Equal(OPCodeContinuationFrame))
+		Expect(frames[1].payload).To(Equal(fragmentedUnmaskedText2Payload))
+		Expect(frames[2].payload).To(BeEmpty())
+		Expect(frames[2].segments).To(Equal(1))
+	})
+
+	It("should parse extended payload lengths split across chunks", func() {
+		var frames []parsedFrame
+		parser := collectFrames(&frames)
+		payload := make([]byte, 1024*65)
+		for i := range payload {
+			payload[i] = byte(i)
+		}
+		stream := append(copyBytes(singleFrameBinaryUnmasked64KBytesLongHeader), payload...)
+		stream = append(stream, singleFrameBinaryUnmasked256BytesLongHeader...)
+		stream = append(stream, payload[:256]...)
+		for len(stream) > 0 {
+			n := 1000
+			if n > len(stream) {
+				n = len(stream)
+			}
+			Expect(parser.Feed(stream[:n])).To(Succeed())
+			stream = stream[n:]
+		}
+		Expect(frames).To(HaveLen(2))
+		Expect(frames[0].header.PayloadLen).To(Equal(uint64(1024 * 65)))
+		Expect(frames[0].payload).To(Equal(payload))
+		Expect(frames[1].header.PayloadLen).To(Equal(uint64(256)))
+		Expect(frames[1].payload).To(Equal(payload[:256]))
+	})
+
+	It("should stop parsing when a callback fails", func() {
+		var frames []parsedFrame
+		parser := collectFrames(&frames)
+		errStop := errors.New("stop")
+		parser.OnHeader = func(header *FrameHeader) error {
+			frames = append(frames, parsedFrame{header: *header})
+			return errStop
+		}
+		stream := append(copyBytes(singleFrameUnmaskedText), singleFrameUnmaskedText...)
+		Expect(parser.Feed(stream)).To(Equal(errStop))
+		Expect(frames).To(HaveLen(1))
+	})
+
+	It("should fail on 64 bits payload lengths with the most significant bit set", func() {
+		var frames []parsedFrame
+		parser := collectFrames(&frames)
+		Expect(parser.Feed([]byte{0x82, 0x7f, 0x80, 0, 0, 0, 0, 0, 0, 1})).To(Equal(ErrProtocolError))
+		Expect(frames).To(BeEmpty())
+	})
+
+	It("should discard a partial frame on reset", func() {
+		var frames []parsedFrame
+		parser := collectFrames(&frames)
+		Expect(parser.Feed(copyBytes(singleFrameUnmaskedText[:3]))).To(Succeed())
+		parser.Reset()
+		frames = nil
+		Expect(parser.Feed(copyBytes(singleFrameUnmaskedText))).To(Succeed())
+		Expect(frames).To(HaveLen(1))
+		Expect(frames[0].payload).To(Equal(singleFrameUnmaskedTextPayload))
+	})
+})
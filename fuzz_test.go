@@ -0,0 +1,200 @@
+//go:build go1.18
+
+package websocket
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// The seed corpus of the fuzz targets is in testdata/fuzz. Run a target with:
+//
+//	go test -run '^$' -fuzz FuzzDecodePacket
+
+// FuzzDecodePacket checks DecodePacket never panics, agrees with
+// DecodeFrameFromReader, and that the decoded frames survive a round-trip
+// through EncodePacket.
+func FuzzDecodePacket(f *testing.F) {
+	f.Add(singleFrameUnmaskedText)
+	f.Add(singleFrameMaskedText)
+	f.Add(singleFrameMaskedFlatedText)
+	f.Add(append(singleFrameBinaryUnmasked256BytesLongHeader, make([]byte, 256)...))
+	f.Add(singleFrameBinaryUnmasked64KBytesLongHeader)
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacket(data)
+		if err != nil {
+			return
+		}
+		if uint64(len(payload)) != payloadLen {
+			t.Fatalf("payload of %d bytes, expected %d", len(payload), payloadLen)
+		}
+
+		rfin, rrsv1, rrsv2, rrsv3, ropcode, rpayloadLen, rmaskingKey, rpayload, err := DecodeFrameFromReader(bytes.NewReader(data), make([]byte, 1024), 0)
+		if err != nil {
+			t.Fatalf("DecodeFrameFromReader failed: %v", err)
+		}
+		if rfin != fin || rrsv1 != rsv1 || rrsv2 != rsv2 || rrsv3 != rsv3 || ropcode != opcode || rpayloadLen != payloadLen ||
+			!bytes.Equal(rmaskingKey, maskingKey) || !bytes.Equal(rpayload, payload) {
+			t.Fatalf("DecodeFrameFromReader disagrees with DecodePacket")
+		}
+
+		packet, err := EncodePacket(fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload)
+		if err != nil {
+			t.Fatalf("EncodePacket failed: %v", err)
+		}
+		efin, ersv1, ersv2, ersv3, eopcode, epayloadLen, emaskingKey, epayload, err := DecodePacket(packet)
+		if err != nil {
+			t.Fatalf("DecodePacket failed on the encoded packet: %v", err)
+		}
+		if efin != fin || ersv1 != rsv1 || ersv2 != rsv2 || ersv3 != rsv3 || eopcode != opcode || epayloadLen != payloadLen ||
+			!bytes.Equal(emaskingKey, maskingKey) || !bytes.Equal(epayload, payload) {
+			t.Fatalf("round-trip mismatch")
+		}
+	})
+}
+
+// FuzzDecodeFrameFromReader checks DecodeFrameFromReader never panics nor
+// reads beyond the frame, whatever the size of the buffer.
+func FuzzDecodeFrameFromReader(f *testing.F) {
+	f.Add(singleFrameMaskedText, uint16(8))
+	f.Add(append(singleFrameBinaryUnmasked256BytesLongHeader, make([]byte, 256)...), uint16(16))
+	f.Add(singleFrameBinaryUnmasked64KBytesLongHeader, uint16(1024))
+	f.Fuzz(func(t *testing.T, data []byte, buffLen uint16) {
+		reader := bytes.NewReader(data)
+		_, _, _, _, _, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, make([]byte, buffLen), 0)
+		if buffLen < minDecodeBufferSize && err != ErrBufferTooSmall {
+			t.Fatalf("buffer of %d bytes accepted", buffLen)
+		}
+		if err != nil {
+			return
+		}
+		if uint64(len(payload)) != payloadLen {
+			t.Fatalf("payload of %d bytes, expected %d", len(payload), payloadLen)
+		}
+		// The length is not always encoded in the fewest bytes.
+		size := 2 + len(payload)
+		switch data[positionMaskPayloadLen] & maskPayloadLen {
+		case payloadLen16bits:
+			size += 2
+		case payloadLen64bits:
+			size += 8
+		}
+		if maskingKey != nil {
+			size += 4
+		}
+		if consumed := len(data) - reader.Len(); consumed != size {
+			t.Fatalf("consumed %d bytes for a frame of %d", consumed, size)
+		}
+	})
+}
+
+// FuzzHeaderVisit checks headerVisit never panics, visits only the parameters
+// in the header and stops when asked.
+func FuzzHeaderVisit(f *testing.F) {
+	f.Add("permessage-deflate; client_max_window_bits")
+	f.Add("foo=bar;john=doe")
+	f.Add("foo=;john= \tdoe;")
+	f.Fuzz(func(t *testing.T, header string) {
+		visits := 0
+		headerVisit([]byte(header), func(name, value []byte) bool {
+			visits++
+			if bytes.IndexByte(name, ';') >= 0 || bytes.IndexByte(value, ';') >= 0 {
+				t.Fatalf("parameter %q=%q has a separator", name, value)
+			}
+			return true
+		})
+		if visits > len(header) {
+			t.Fatalf("%d visits for a header of %d bytes", visits, len(header))
+		}
+
+		visits = 0
+		headerVisit([]byte(header), func(name, value []byte) bool {
+			visits++
+			return false
+		})
+		if visits > 1 {
+			t.Fatalf("headerVisit did not stop, visited %d times", visits)
+		}
+	})
+}
+
+// FuzzDeflate checks Deflate never panics on arbitrary data, DeflateLimit
+// respects the limit, and Flate then Deflate is the identity.
+func FuzzDeflate(f *testing.F) {
+	f.Add([]byte("test"))
+	f.Add(singleFrameMaskedFlatedTextPayload)
+	f.Add([]byte{})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		Deflate(nil, data)
+		if deflated, err := DeflateLimit(nil, data, 1024); err == nil && len(deflated) > 1024 {
+			t.Fatalf("deflated %d bytes over the limit", len(deflated))
+		}
+
+		flated, _, err := Flate(nil, data)
+		if err != nil {
+			t.Fatalf("Flate failed: %v", err)
+		}
+		deflated, err := Deflate(nil, flated)
+		if err != nil {
+			t.Fatalf("Deflate failed: %v", err)
+		}
+		if !bytes.Equal(deflated, data) {
+			t.Fatalf("round-trip mismatch")
+		}
+	})
+}
+
+// streamConn is a net.Conn reading from a byte stream and discarding the
+// writes.
+type streamConn struct {
+	io.Reader
+}
+
+func (c *streamConn) Write(b []byte) (int, error)        { return ioutil.Discard.Write(b) }
+func (c *streamConn) Close() error                       { return nil }
+func (c *streamConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *streamConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *streamConn) SetDeadline(t time.Time) error      { return nil }
+func (c *streamConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *streamConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// fuzzFrame encodes a masked frame, like maskedFrame, but without asserting,
+// since the seeds are added outside of the specs.
+func fuzzFrame(fin bool, opcode byte, payload []byte) []byte {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	masked := append([]byte(nil), payload...)
+	Unmask(masked, mask)
+	packet, _ := EncodePacket(fin, false, false, false, opcode, uint64(len(masked)), mask, masked)
+	return packet
+}
+
+// FuzzReadMessage checks SimpleConnection.ReadMessage never panics on a byte
+// stream, and only returns valid text messages.
+func FuzzReadMessage(f *testing.F) {
+	f.Add(singleFrameMaskedText, false)
+	f.Add(append(fuzzFrame(false, OPCodeTextFrame, []byte("Hel")), fuzzFrame(true, OPCodeContinuationFrame, []byte("lo"))...), false)
+	f.Add(append(fuzzFrame(true, OPCodePingFrame, []byte("ping")), fuzzFrame(true, OPCodeConnectionCloseFrame, []byte{0x03, 0xe8})...), false)
+	f.Add(singleFrameMaskedFlatedText, true)
+	f.Fuzz(func(t *testing.T, data []byte, compressed bool) {
+		conn := NewSimpleConn(&streamConn{bytes.NewReader(data)})
+		conn.Init(&ConnectionContext{
+			Conn:       conn.Conn(),
+			Compressed: compressed,
+		})
+		// Each message takes 2 bytes at least, so the loop ends.
+		for i := 0; i <= len(data); i++ {
+			opcode, payload, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			if opcode == MessageTypeText && !utf8.Valid(payload) {
+				t.Fatalf("invalid UTF-8 text message %q", payload)
+			}
+		}
+	})
+}
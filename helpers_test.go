@@ -0,0 +1,113 @@
+package websocket
+
+import (
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"net"
+	"time"
+
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+// maskedFrame encodes a frame the way a client would send it.
+func maskedFrame(fin bool, opcode byte, payload []byte) []byte {
+	mask := []byte{0x37, 0xfa, 0x21, 0x3d}
+	masked := make([]byte, len(payload))
+	copy(masked, payload)
+	Unmask(masked, mask)
+	packet, err := EncodePacket(fin, false, false, false, opcode, uint64(len(masked)), mask, masked)
+	Expect(err).To(BeNil())
+	return packet
+}
+
+// compressedFrame encodes a frame of a compressed message the way a client
+// would send it, with the rsv1 set. The payload must be already flated.
+func compressedFrame(fin bool, opcode byte, payload []byte) []byte {
+	packet := maskedFrame(fin, opcode, payload)
+	packet[positionFinRsvsOpCode] |= maskRsv1
+	return packet
+}
+
+type testFrame struct {
+	opcode  byte
+	payload string
+}
+
+// readFrames reads count small frames sent by the server, which may arrive
+// together in a single read. Small server frames have a 2 bytes header.
+func readFrames(conn net.Conn, count int) []testFrame {
+	var (
+		frames []testFrame
+		data   []byte
+	)
+	buff := make([]byte, 1024)
+	Expect(conn.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+	for len(frames) < count {
+		n, err := conn.Read(buff)
+		Expect(err).To(BeNil())
+		data = append(data, buff[:n]...)
+		for len(data) > 0 {
+			_, _, _, _, opcode, _, _, payload, err := DecodePacket(data)
+			if err != nil {
+				break
+			}
+			frames = append(frames, testFrame{opcode, string(payload)})
+			data = data[2+len(payload):]
+		}
+	}
+	return frames
+}
+
+// acceptPipe makes the manager accept the server side of a net.Pipe, returning
+// the client side and a channel that receives the result of Accept.
+func acceptPipe(manager Manager) (net.Conn, chan error) {
+	server, client := net.Pipe()
+	done := make(chan error, 1)
+	go func() {
+		done <- manager.Accept(&ConnectionContext{
+			Conn: server,
+		})
+	}()
+	return client, done
+}
+
+// writeFrames writes the frames from another goroutine, since writing to a
+// net.Pipe blocks until the other side reads.
+func writeFrames(conn net.Conn, frames ...[]byte) {
+	go func() {
+		for _, frame := range frames {
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+}
+
+// upgradeThroughServer handshakes through a fasthttp server running the
+// handler, so the connection upgraded is hijacked. It returns the client side
+// of the connection.
+func upgradeThroughServer(handler fasthttp.RequestHandler) net.Conn {
+	listener := fasthttputil.NewInmemoryListener()
+	defer listener.Close()
+	go fasthttp.Serve(listener, handler)
+	client, err := listener.Dial()
+	Expect(err).To(BeNil())
+	req := fasthttp.AcquireRequest()
+	defer fasthttp.ReleaseRequest(req)
+	buildValidCtx().Request.CopyTo(req)
+	req.SetRequestURI("http://localhost/")
+	_, err = req.WriteTo(client)
+	Expect(err).To(BeNil())
+	// The response is read byte by byte, leaving the frames that follow it.
+	var res []byte
+	b := make([]byte, 1)
+	for !bytes.HasSuffix(res, []byte("\r\n\r\n")) {
+		_, err = client.Read(b)
+		Expect(err).To(BeNil())
+		res = append(res, b[0])
+	}
+	Expect(string(res)).To(HavePrefix("HTTP/1.1 101 "))
+	return client
+}
@@ -0,0 +1,103 @@
+// Package jsonrpc implements the JSON-RPC 2.0 protocol
+// (https://www.jsonrpc.org/specification) on top of websocket connections.
+//
+// Both endpoints of the connection can issue calls: the browser calls the
+// methods registered on the Server and the server can call methods exposed
+// by the browser through the Peer of the connection.
+package jsonrpc
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// Version is the version of the protocol implemented.
+const Version = "2.0"
+
+// Standard error codes defined by the specification.
+const (
+	CodeParseError     = -32700
+	CodeInvalidRequest = -32600
+	CodeMethodNotFound = -32601
+	CodeInvalidParams  = -32602
+	CodeInternalError  = -32603
+	// CodeServerBusy is sent, from the range reserved for implementation
+	// defined errors, when a peer is serving too many requests.
+	CodeServerBusy = -32000
+)
+
+var (
+	ErrPeerClosed      = errors.New("Peer closed")
+	ErrInvalidResponse = errors.New("Invalid response")
+)
+
+// Error is the error object of the protocol. Handlers can return an *Error
+// for controlling the code and data sent to the peer, any other error is sent
+// as an internal error.
+type Error struct {
+	Code    int         `json:"code"`
+	Message string      `json:"message"`
+	Data    interface{} `json:"data,omitempty"`
+}
+
+// NewError returns a new instance of the jsonrpc.Error
+func NewError(code int, message string, data interface{}) *Error {
+	return &Error{
+		Code:    code,
+		Message: message,
+		Data:    data,
+	}
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("jsonrpc: %s (%d)", e.Message, e.Code)
+}
+
+// Request represents a request or, when the ID is missing, a notification.
+type Request struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// IsNotification checks if the request expects no response.
+func (r *Request) IsNotification() bool {
+	return len(r.ID) == 0
+}
+
+// Response represents the response of a request.
+type Response struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *Error          `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var nullID = json.RawMessage("null")
+
+// message is used for telling requests and responses apart.
+type message struct {
+	JSONRPC string           `json:"jsonrpc"`
+	Method  *string          `json:"method"`
+	Params  json.RawMessage  `json:"params"`
+	Result  json.RawMessage  `json:"result"`
+	Error   *json.RawMessage `json:"error"`
+	ID      json.RawMessage  `json:"id"`
+}
+
+func (m *message) isResponse() bool {
+	return m.Method == nil && (m.Result != nil || m.Error != nil)
+}
+
+func errorResponse(id json.RawMessage, err *Error) *Response {
+	if len(id) == 0 {
+		id = nullID
+	}
+	return &Response{
+		JSONRPC: Version,
+		Error:   err,
+		ID:      id,
+	}
+}
@@ -0,0 +1,185 @@
+package jsonrpc
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/jamillosantos/websocket"
+)
+
+func TestJSONRPC(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "JSON-RPC Suite")
+}
+
+// fakeConn is a websocket.Connection that only records the messages written.
+type fakeConn struct {
+	websocket.Connection
+	written chan string
+}
+
+func (c *fakeConn) WriteMessage(opcode websocket.MessageType, payload []byte) error {
+	c.written <- string(payload)
+	return nil
+}
+
+var _ = Describe("Peer", func() {
+	var (
+		conn *fakeConn
+		peer *Peer
+	)
+
+	BeforeEach(func() {
+		conn = &fakeConn{
+			written: make(chan string, 10),
+		}
+		methods := NewMethods()
+		methods.Register("subtract", func(ctx context.Context, conn websocket.Connection, params json.RawMessage) (interface{}, error) {
+			var args []int
+			if err := json.Unmarshal(params, &args); err != nil || len(args) != 2 {
+				return nil, NewError(CodeInvalidParams, "Invalid params", nil)
+			}
+			return args[0] - args[1], nil
+		})
+		methods.Register("fail", func(ctx context.Context, conn websocket.Connection, params json.RawMessage) (interface{}, error) {
+			return nil, errors.New("failed")
+		})
+		methods.Register("notify", func(ctx context.Context, conn websocket.Connection, params json.RawMessage) (interface{}, error) {
+			return "ignored", nil
+		})
+		peer = NewPeer(conn, methods)
+	})
+
+	AfterEach(func() {
+		peer.Close()
+	})
+
+	It("should respond a request", func() {
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"subtract","params":[42,23],"id":1}`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","result":19,"id":1}`)))
+	})
+
+	It("should not respond notifications", func() {
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"notify","params":[1]}`))).To(Succeed())
+		Consistently(conn.written, time.Millisecond*50).ShouldNot(Receive())
+	})
+
+	It("should respond the standard errors", func() {
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"foobar","id":"1"}`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":"1"}`)))
+
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"foobar,"params":"bar","baz]`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","error":{"code":-32700,"message":"Parse error"},"id":null}`)))
+
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","method":1,"params":"bar"}`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`)))
+
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"subtract","params":{},"id":2}`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","error":{"code":-32602,"message":"Invalid params"},"id":2}`)))
+
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"fail","id":3}`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","error":{"code":-32603,"message":"failed"},"id":3}`)))
+
+		Expect(peer.HandleMessage([]byte(`[]`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null}`)))
+	})
+
+	It("should respond batches", func() {
+		Expect(peer.HandleMessage([]byte(`[
+			{"jsonrpc":"2.0","method":"subtract","params":[42,23],"id":"1"},
+			{"jsonrpc":"2.0","method":"notify","params":[7]},
+			{"foo":"boo"},
+			{"jsonrpc":"2.0","method":"foo.get","params":{"name":"myself"},"id":"5"}
+		]`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`[
+			{"jsonrpc":"2.0","error":{"code":-32600,"message":"Invalid Request"},"id":null},
+			{"jsonrpc":"2.0","result":19,"id":"1"},
+			{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":"5"}
+		]`)))
+
+		Expect(peer.HandleMessage([]byte(`[{"jsonrpc":"2.0","method":"notify","params":[1]}]`))).To(Succeed())
+		Consistently(conn.written, time.Millisecond*50).ShouldNot(Receive())
+	})
+
+	It("should answer the requests beyond the concurrency limit as busy", func() {
+		release := make(chan struct{})
+		methods := NewMethods()
+		methods.Register("wait", func(ctx context.Context, conn websocket.Connection, params json.RawMessage) (interface{}, error) {
+			<-release
+			return "done", nil
+		})
+		limited := NewPeerWithOptions(conn, methods, PeerOptions{
+			MaxConcurrentRequests: 1,
+		})
+		defer limited.Close()
+
+		Expect(limited.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"wait","id":1}`))).To(Succeed())
+		Expect(limited.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"wait","id":2}`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","error":{"code":-32000,"message":"Server busy"},"id":2}`)))
+		Expect(limited.HandleMessage([]byte(`[{"jsonrpc":"2.0","method":"wait","id":3},{"jsonrpc":"2.0","method":"wait"}]`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`[{"jsonrpc":"2.0","error":{"code":-32000,"message":"Server busy"},"id":3}]`)))
+
+		close(release)
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","result":"done","id":1}`)))
+		// The slot is released once the response is sent.
+		Eventually(func() int {
+			return len(limited.slots)
+		}).Should(BeZero())
+		Expect(limited.HandleMessage([]byte(`{"jsonrpc":"2.0","method":"wait","id":4}`))).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","result":"done","id":4}`)))
+	})
+
+	It("should call the other endpoint", func() {
+		result := make(chan error, 1)
+		var sum int
+		go func() {
+			result <- peer.Call(context.Background(), "sum", []int{1, 2}, &sum)
+		}()
+		var req string
+		Eventually(conn.written).Should(Receive(&req))
+		Expect(req).To(MatchJSON(`{"jsonrpc":"2.0","method":"sum","params":[1,2],"id":1}`))
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","result":3,"id":1}`))).To(Succeed())
+		Eventually(result).Should(Receive(BeNil()))
+		Expect(sum).To(Equal(3))
+	})
+
+	It("should return the error sent by the other endpoint", func() {
+		result := make(chan error, 1)
+		go func() {
+			result <- peer.Call(context.Background(), "sum", nil, nil)
+		}()
+		Eventually(conn.written).Should(Receive())
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","error":{"code":-32601,"message":"Method not found"},"id":1}`))).To(Succeed())
+		var err error
+		Eventually(result).Should(Receive(&err))
+		Expect(err).To(Equal(NewError(CodeMethodNotFound, "Method not found", nil)))
+	})
+
+	It("should abandon calls when the context is done", func() {
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+		defer cancel()
+		Expect(peer.Call(ctx, "sum", nil, nil)).To(Equal(context.DeadlineExceeded))
+		Expect(peer.HandleMessage([]byte(`{"jsonrpc":"2.0","result":3,"id":1}`))).To(Equal(ErrInvalidResponse))
+	})
+
+	It("should abandon calls when the peer is closed", func() {
+		result := make(chan error, 1)
+		go func() {
+			result <- peer.Call(context.Background(), "sum", nil, nil)
+		}()
+		Eventually(conn.written).Should(Receive())
+		peer.Close()
+		Eventually(result).Should(Receive(Equal(ErrPeerClosed)))
+	})
+
+	It("should send notifications", func() {
+		Expect(peer.Notify("update", map[string]int{"count": 1})).To(Succeed())
+		Eventually(conn.written).Should(Receive(MatchJSON(`{"jsonrpc":"2.0","method":"update","params":{"count":1}}`)))
+	})
+})
@@ -0,0 +1,374 @@
+package jsonrpc
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"sync/atomic"
+
+	"github.com/jamillosantos/websocket"
+)
+
+// HandlerFunc handles the calls of a method. The returned value is encoded as
+// the result of the call.
+//
+// The ctx is cancelled when the connection is closed.
+type HandlerFunc func(ctx context.Context, conn websocket.Connection, params json.RawMessage) (interface{}, error)
+
+// Methods is the registry of the methods a peer exposes. It is shared by all
+// the connections and must be filled before serving them.
+type Methods struct {
+	handlers map[string]HandlerFunc
+}
+
+// NewMethods returns a new instance of the jsonrpc.Methods
+func NewMethods() *Methods {
+	return &Methods{
+		handlers: make(map[string]HandlerFunc),
+	}
+}
+
+// Register adds the handler of the method.
+func (m *Methods) Register(method string, handler HandlerFunc) {
+	m.handlers[method] = handler
+}
+
+// DefaultMaxConcurrentRequests is the number of requests a peer serves at
+// once when the PeerOptions do not set it.
+const DefaultMaxConcurrentRequests = 64
+
+// errPeerBusy is returned by serving when there is no room for the request.
+var errPeerBusy = errors.New("Peer busy")
+
+// PeerOptions configures the jsonrpc.Peer.
+type PeerOptions struct {
+	// MaxConcurrentRequests limits the requests served at once, a batch
+	// counting as one. The requests received beyond it are answered with
+	// the CodeServerBusy error. Zero means DefaultMaxConcurrentRequests.
+	MaxConcurrentRequests int
+}
+
+// Peer is one endpoint of a JSON-RPC session over a websocket connection. It
+// serves the calls for the registered methods and issues calls to the other
+// endpoint, matching the responses by id.
+//
+// Incoming requests are handled in their own goroutines, so a handler can
+// call the other endpoint without blocking the reading of the connection. At
+// most PeerOptions.MaxConcurrentRequests are handled at once.
+type Peer struct {
+	conn    websocket.Connection
+	methods *Methods
+	ctx     context.Context
+	cancel  context.CancelFunc
+	lastID  uint64
+	mutex   sync.Mutex
+	pending map[string]chan *Response
+	closed  bool
+	// slots holds a token for each request being served.
+	slots chan struct{}
+	wg    sync.WaitGroup
+}
+
+// NewPeer returns a new instance of the jsonrpc.Peer for the connection. The
+// methods may be nil when the peer only issues calls.
+func NewPeer(conn websocket.Connection, methods *Methods) *Peer {
+	return NewPeerWithOptions(conn, methods, PeerOptions{})
+}
+
+// NewPeerWithOptions returns a new instance of the jsonrpc.Peer for the
+// connection, configured by the options.
+func NewPeerWithOptions(conn websocket.Connection, methods *Methods, options PeerOptions) *Peer {
+	maxConcurrent := options.MaxConcurrentRequests
+	if maxConcurrent <= 0 {
+		maxConcurrent = DefaultMaxConcurrentRequests
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Peer{
+		conn:    conn,
+		methods: methods,
+		ctx:     ctx,
+		cancel:  cancel,
+		pending: make(map[string]chan *Response),
+		slots:   make(chan struct{}, maxConcurrent),
+	}
+}
+
+// HandleMessage processes a message received from the connection. Responses
+// are matched to the pending calls, and requests are dispatched to the
+// methods registered.
+func (p *Peer) HandleMessage(payload []byte) error {
+	payload = bytes.TrimSpace(payload)
+	if !json.Valid(payload) {
+		return p.send(errorResponse(nil, NewError(CodeParseError, "Parse error", nil)))
+	}
+	if payload[0] == '[' {
+		var batch []json.RawMessage
+		if err := json.Unmarshal(payload, &batch); err != nil || len(batch) == 0 {
+			return p.send(errorResponse(nil, NewError(CodeInvalidRequest, "Invalid Request", nil)))
+		}
+		return p.handleBatch(batch)
+	}
+
+	var msg message
+	if err := json.Unmarshal(payload, &msg); err == nil && msg.isResponse() {
+		return p.resolve(payload)
+	}
+	req, errResp := parseRequest(payload)
+	if errResp != nil {
+		return p.send(errResp)
+	}
+	if err := p.serving(); err == errPeerBusy {
+		if req.IsNotification() {
+			return nil
+		}
+		return p.send(busyResponse(req))
+	} else if err != nil {
+		return err
+	}
+	go func() {
+		defer p.served()
+		if resp := p.call(req); resp != nil {
+			p.send(resp)
+		}
+	}()
+	return nil
+}
+
+func (p *Peer) handleBatch(batch []json.RawMessage) error {
+	requests := make([]*Request, 0, len(batch))
+	responses := make([]*Response, 0, len(batch))
+	for _, raw := range batch {
+		var msg message
+		if err := json.Unmarshal(raw, &msg); err == nil && msg.isResponse() {
+			if err = p.resolve(raw); err != nil {
+				return err
+			}
+			continue
+		}
+		req, errResp := parseRequest(raw)
+		if errResp != nil {
+			responses = append(responses, errResp)
+			continue
+		}
+		requests = append(requests, req)
+	}
+	if len(requests) == 0 {
+		if len(responses) == 0 {
+			return nil
+		}
+		return p.send(responses)
+	}
+	if err := p.serving(); err == errPeerBusy {
+		for _, req := range requests {
+			if !req.IsNotification() {
+				responses = append(responses, busyResponse(req))
+			}
+		}
+		if len(responses) == 0 {
+			return nil
+		}
+		return p.send(responses)
+	} else if err != nil {
+		return err
+	}
+	go func() {
+		defer p.served()
+		for _, req := range requests {
+			if resp := p.call(req); resp != nil {
+				responses = append(responses, resp)
+			}
+		}
+		if len(responses) > 0 {
+			p.send(responses)
+		}
+	}()
+	return nil
+}
+
+// serving registers a request being served. It fails with ErrPeerClosed if
+// the peer is closed, and errPeerBusy when there is no room for the request.
+func (p *Peer) serving() error {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	if p.closed {
+		return ErrPeerClosed
+	}
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		return errPeerBusy
+	}
+	p.wg.Add(1)
+	return nil
+}
+
+// served unregisters a request served.
+func (p *Peer) served() {
+	<-p.slots
+	p.wg.Done()
+}
+
+func busyResponse(req *Request) *Response {
+	return errorResponse(req.ID, NewError(CodeServerBusy, "Server busy", nil))
+}
+
+func parseRequest(raw json.RawMessage) (*Request, *Response) {
+	var req Request
+	if err := json.Unmarshal(raw, &req); err != nil {
+		return nil, errorResponse(nil, NewError(CodeInvalidRequest, "Invalid Request", nil))
+	}
+	if req.JSONRPC != Version || req.Method == "" {
+		return nil, errorResponse(req.ID, NewError(CodeInvalidRequest, "Invalid Request", nil))
+	}
+	return &req, nil
+}
+
+// call runs the handler of the request, returning its response. Notifications
+// have no response.
+func (p *Peer) call(req *Request) *Response {
+	var handler HandlerFunc
+	if p.methods != nil {
+		handler = p.methods.handlers[req.Method]
+	}
+	if handler == nil {
+		if req.IsNotification() {
+			return nil
+		}
+		return errorResponse(req.ID, NewError(CodeMethodNotFound, "Method not found", nil))
+	}
+
+	result, err := handler(p.ctx, p.conn, req.Params)
+	if req.IsNotification() {
+		return nil
+	}
+	if err != nil {
+		rpcErr, ok := err.(*Error)
+		if !ok {
+			rpcErr = NewError(CodeInternalError, err.Error(), nil)
+		}
+		return errorResponse(req.ID, rpcErr)
+	}
+	data, err := json.Marshal(result)
+	if err != nil {
+		return errorResponse(req.ID, NewError(CodeInternalError, err.Error(), nil))
+	}
+	return &Response{
+		JSONRPC: Version,
+		Result:  data,
+		ID:      req.ID,
+	}
+}
+
+// resolve delivers the response to the pending call.
+func (p *Peer) resolve(raw json.RawMessage) error {
+	var resp Response
+	if err := json.Unmarshal(raw, &resp); err != nil {
+		return err
+	}
+	p.mutex.Lock()
+	ch, ok := p.pending[string(resp.ID)]
+	delete(p.pending, string(resp.ID))
+	p.mutex.Unlock()
+	if !ok {
+		return ErrInvalidResponse
+	}
+	ch <- &resp
+	return nil
+}
+
+func (p *Peer) send(v interface{}) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	return p.conn.WriteMessage(websocket.MessageTypeText, data)
+}
+
+// Call calls the method on the other endpoint and waits for its response.
+// The result, when not nil, receives the decoded result of the call. Errors
+// sent by the other endpoint are returned as *Error.
+//
+// The call is abandoned when the ctx is done or the peer is closed.
+func (p *Peer) Call(ctx context.Context, method string, params interface{}, result interface{}) error {
+	id := strconv.FormatUint(atomic.AddUint64(&p.lastID, 1), 10)
+	req := &Request{
+		JSONRPC: Version,
+		Method:  method,
+		ID:      json.RawMessage(id),
+	}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = data
+	}
+
+	ch := make(chan *Response, 1)
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return ErrPeerClosed
+	}
+	p.pending[id] = ch
+	p.mutex.Unlock()
+	forget := func() {
+		p.mutex.Lock()
+		delete(p.pending, id)
+		p.mutex.Unlock()
+	}
+
+	if err := p.send(req); err != nil {
+		forget()
+		return err
+	}
+	select {
+	case resp := <-ch:
+		if resp.Error != nil {
+			return resp.Error
+		}
+		if result != nil && len(resp.Result) > 0 {
+			return json.Unmarshal(resp.Result, result)
+		}
+		return nil
+	case <-ctx.Done():
+		forget()
+		return ctx.Err()
+	case <-p.ctx.Done():
+		return ErrPeerClosed
+	}
+}
+
+// Notify sends a notification to the other endpoint. No response is expected.
+func (p *Peer) Notify(method string, params interface{}) error {
+	req := &Request{
+		JSONRPC: Version,
+		Method:  method,
+	}
+	if params != nil {
+		data, err := json.Marshal(params)
+		if err != nil {
+			return err
+		}
+		req.Params = data
+	}
+	return p.send(req)
+}
+
+// Close cancels the pending calls and the context of the running handlers,
+// waiting for them to finish. The connection is not closed.
+func (p *Peer) Close() {
+	p.mutex.Lock()
+	if p.closed {
+		p.mutex.Unlock()
+		return
+	}
+	p.closed = true
+	p.pending = make(map[string]chan *Response)
+	p.mutex.Unlock()
+	p.cancel()
+	p.wg.Wait()
+}
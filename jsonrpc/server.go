@@ -0,0 +1,69 @@
+package jsonrpc
+
+import (
+	"sync"
+
+	"github.com/jamillosantos/websocket"
+)
+
+// Server keeps a Peer for each connection of a manager, serving the methods
+// registered. Its handlers must be wired to the manager:
+//
+//	server := jsonrpc.NewServer()
+//	server.Register("sum", sum)
+//	manager.OnConnect = server.OnConnect
+//	manager.OnMessage = server.OnMessage
+//	manager.OnClose = server.OnClose
+//
+// Calls to the browser are issued through the Peer of the connection.
+type Server struct {
+	*Methods
+	// PeerOptions configures the peers of the connections.
+	PeerOptions PeerOptions
+	peers       sync.Map
+}
+
+// NewServer returns a new instance of the jsonrpc.Server
+func NewServer() *Server {
+	return &Server{
+		Methods: NewMethods(),
+	}
+}
+
+// Peer returns the peer of the connection, or nil if the connection is not
+// being served.
+func (s *Server) Peer(conn websocket.Connection) *Peer {
+	peer, ok := s.peers.Load(conn)
+	if !ok {
+		return nil
+	}
+	return peer.(*Peer)
+}
+
+// OnConnect implements the websocket.ConnectionHandler creating the peer of
+// the connection.
+func (s *Server) OnConnect(conn websocket.Connection) error {
+	s.peers.Store(conn, NewPeerWithOptions(conn, s.Methods, s.PeerOptions))
+	return nil
+}
+
+// OnMessage implements the websocket.MessageHandler forwarding the message to
+// the peer of the connection.
+func (s *Server) OnMessage(conn websocket.Connection, opcode websocket.MessageType, payload []byte) error {
+	peer := s.Peer(conn)
+	if peer == nil {
+		return ErrPeerClosed
+	}
+	return peer.HandleMessage(payload)
+}
+
+// OnClose implements the websocket.ConnectionHandler closing the peer of the
+// connection. It waits for the running handlers, since the connection may be
+// reused by the manager after it returns.
+func (s *Server) OnClose(conn websocket.Connection) error {
+	if peer, ok := s.peers.Load(conn); ok {
+		s.peers.Delete(conn)
+		peer.(*Peer).Close()
+	}
+	return nil
+}
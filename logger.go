@@ -0,0 +1,38 @@
+package websocket
+
+// Logger receives the events logged by the Upgrader, the managers and the
+// connections. The keyvals are alternating keys and values, the keys are
+// strings:
+//
+//	logger.Debug("websocket: handshake rejected", "remote", ip, "reason", failure)
+//
+// The payloads of the messages are never logged. Implementations must be safe
+// for concurrent use.
+type Logger interface {
+	Debug(msg string, keyvals ...interface{})
+	Info(msg string, keyvals ...interface{})
+	Warn(msg string, keyvals ...interface{})
+	Error(msg string, keyvals ...interface{})
+}
+
+// nopLogger is used when no Logger is configured.
+type nopLogger struct{}
+
+func (nopLogger) Debug(msg string, keyvals ...interface{}) {}
+func (nopLogger) Info(msg string, keyvals ...interface{})  {}
+func (nopLogger) Warn(msg string, keyvals ...interface{})  {}
+func (nopLogger) Error(msg string, keyvals ...interface{}) {}
+
+// loggerOrNop returns the logger, or a no-op one when it is nil.
+func loggerOrNop(logger Logger) Logger {
+	if logger == nil {
+		return nopLogger{}
+	}
+	return logger
+}
+
+// loggerSetter is implemented by the connections that log, for the managers
+// to configure their logger.
+type loggerSetter interface {
+	setLogger(logger Logger)
+}
@@ -0,0 +1,53 @@
+//go:build go1.21
+
+package websocket
+
+import (
+	"context"
+	"log/slog"
+)
+
+// SlogLogger is the websocket.Logger that writes to a slog.Logger.
+type SlogLogger struct {
+	logger *slog.Logger
+}
+
+// NewSlogLogger returns a new instance of the websocket.SlogLogger. A nil
+// logger uses the slog.Default.
+func NewSlogLogger(logger *slog.Logger) *SlogLogger {
+	if logger == nil {
+		logger = slog.Default()
+	}
+	return &SlogLogger{
+		logger: logger,
+	}
+}
+
+// Debug implements the websocket.Logger.Debug method
+func (l *SlogLogger) Debug(msg string, keyvals ...interface{}) {
+	l.log(slog.LevelDebug, msg, keyvals)
+}
+
+// Info implements the websocket.Logger.Info method
+func (l *SlogLogger) Info(msg string, keyvals ...interface{}) {
+	l.log(slog.LevelInfo, msg, keyvals)
+}
+
+// Warn implements the websocket.Logger.Warn method
+func (l *SlogLogger) Warn(msg string, keyvals ...interface{}) {
+	l.log(slog.LevelWarn, msg, keyvals)
+}
+
+// Error implements the websocket.Logger.Error method
+func (l *SlogLogger) Error(msg string, keyvals ...interface{}) {
+	l.log(slog.LevelError, msg, keyvals)
+}
+
+func (l *SlogLogger) log(level slog.Level, msg string, keyvals []interface{}) {
+	ctx := context.Background()
+	// Avoids building the attributes of the disabled levels.
+	if !l.logger.Enabled(ctx, level) {
+		return
+	}
+	l.logger.Log(ctx, level, msg, keyvals...)
+}
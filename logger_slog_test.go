@@ -0,0 +1,24 @@
+//go:build go1.21
+
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"log/slog"
+)
+
+var _ = Describe("SlogLogger", func() {
+	It("should write to a slog.Logger", func() {
+		var buff bytes.Buffer
+		logger := NewSlogLogger(slog.New(slog.NewTextHandler(&buff, &slog.HandlerOptions{
+			Level: slog.LevelInfo,
+		})))
+		logger.Debug("hidden", "key", 1)
+		logger.Warn("websocket: test", "key", 2)
+		Expect(buff.String()).NotTo(ContainSubstring("hidden"))
+		Expect(buff.String()).To(ContainSubstring("level=WARN msg=\"websocket: test\" key=2"))
+	})
+})
@@ -0,0 +1,74 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+)
+
+// recordingLogger is a Logger that keeps the entries logged.
+type recordingLogger struct {
+	mutex   sync.Mutex
+	entries []string
+}
+
+func (l *recordingLogger) log(level, msg string, keyvals []interface{}) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.entries = append(l.entries, strings.TrimSuffix(fmt.Sprintln(append([]interface{}{level, msg}, keyvals...)...), "\n"))
+}
+
+func (l *recordingLogger) Debug(msg string, keyvals ...interface{}) { l.log("DEBUG", msg, keyvals) }
+func (l *recordingLogger) Info(msg string, keyvals ...interface{})  { l.log("INFO", msg, keyvals) }
+func (l *recordingLogger) Warn(msg string, keyvals ...interface{})  { l.log("WARN", msg, keyvals) }
+func (l *recordingLogger) Error(msg string, keyvals ...interface{}) { l.log("ERROR", msg, keyvals) }
+
+func (l *recordingLogger) Entries() []string {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	return append([]string(nil), l.entries...)
+}
+
+var _ = Describe("Logger", func() {
+	It("should log the handshakes rejected by the upgrader", func() {
+		logger := &recordingLogger{}
+		upgrader := &Upgrader{
+			Logger: logger,
+		}
+		ctx := buildValidCtx()
+		ctx.Request.Header.SetMethod("POST")
+		Expect(upgrader.Upgrade(ctx)).NotTo(Succeed())
+		Expect(logger.Entries()).To(HaveLen(1))
+		Expect(logger.Entries()[0]).To(HavePrefix("DEBUG websocket: handshake rejected"))
+		Expect(logger.Entries()[0]).To(ContainSubstring("method"))
+	})
+
+	It("should not log the close payload", func() {
+		logger := &recordingLogger{}
+		server, client := net.Pipe()
+		defer client.Close()
+		conn := NewSimpleConn(server)
+		conn.Init(&ConnectionContext{
+			Conn: server,
+		})
+		conn.setLogger(logger)
+
+		payload := make([]byte, 2, 4)
+		binary.BigEndian.PutUint16(payload, uint16(ConnectionCloseReasonNormal))
+		payload = append(payload, 0xff, 0xfe)
+		writeFrames(client, maskedFrame(true, OPCodeConnectionCloseFrame, payload))
+		go io.Copy(ioutil.Discard, client)
+		_, _, err := conn.ReadMessage()
+		Expect(err).NotTo(BeNil())
+		Expect(logger.Entries()).To(HaveLen(1))
+		Expect(logger.Entries()[0]).To(HavePrefix("DEBUG websocket: invalid close reason"))
+		Expect(logger.Entries()[0]).NotTo(ContainSubstring("\xff\xfe"))
+	})
+})
@@ -1,7 +1,17 @@
 package websocket
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"net"
+	"sync"
+	"time"
+)
+
+var (
+	ErrFirstMessageTimeout = errors.New("First message timeout")
+	ErrIdleTimeout         = errors.New("Idle timeout")
 )
 
 // ConnectionHandler represents the handler that the Upgrader will trigger after
@@ -20,6 +30,23 @@ type MessageHandler func(conn Connection, opcode MessageType, payload []byte) er
 type ConnectionContext struct {
 	Conn       net.Conn
 	Compressed bool
+	// TraceContext is the span context of the handshake, the parent of the
+	// span of the connection.
+	TraceContext context.Context
+
+	release     func()
+	releaseOnce sync.Once
+}
+
+// Release informs that the connection is no longer managed, freeing its slot
+// on the admission limits of the Upgrader. Managers must call it when they are
+// done with the connection. Calling it more than once is safe.
+func (ctx *ConnectionContext) Release() {
+	ctx.releaseOnce.Do(func() {
+		if ctx.release != nil {
+			ctx.release()
+		}
+	})
 }
 
 // Manager handles all the tasks .
@@ -27,3 +54,78 @@ type Manager interface {
 	// Accept handles the incoming connection.
 	Accept(conn *ConnectionContext) error
 }
+
+// Middleware wraps a MessageHandler, adding behaviour around it (eg. logging,
+// authorization, metrics). It may also decide not to call the next handler.
+type Middleware func(next MessageHandler) MessageHandler
+
+// ConnectionMiddleware wraps a ConnectionHandler, adding behaviour around it.
+type ConnectionMiddleware func(next ConnectionHandler) ConnectionHandler
+
+// chainMessageHandler wraps the handler with the middlewares. The first
+// middleware is the outermost one. A nil handler is replaced by a no-op.
+func chainMessageHandler(handler MessageHandler, middlewares []Middleware) MessageHandler {
+	if handler == nil {
+		handler = func(conn Connection, opcode MessageType, payload []byte) error {
+			return nil
+		}
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// chainConnectionHandler wraps the handler with the middlewares. The first
+// middleware is the outermost one. A nil handler is replaced by a no-op, so
+// the middlewares run even if no handler was set.
+func chainConnectionHandler(handler ConnectionHandler, middlewares []ConnectionMiddleware) ConnectionHandler {
+	if handler == nil {
+		if len(middlewares) == 0 {
+			return nil
+		}
+		handler = func(conn Connection) error {
+			return nil
+		}
+	}
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		handler = middlewares[i](handler)
+	}
+	return handler
+}
+
+// evictionDeadline returns when a connection accepted at acceptedAt, which
+// received its last frame at lastFrameAt (zero if none), must be evicted and
+// the error reported. A zero time means it is never evicted.
+func evictionDeadline(firstMessageTimeout, idleTimeout time.Duration, acceptedAt, lastFrameAt time.Time) (time.Time, error) {
+	var (
+		deadline time.Time
+		reason   error
+	)
+	if lastFrameAt.IsZero() && firstMessageTimeout > 0 {
+		deadline, reason = acceptedAt.Add(firstMessageTimeout), ErrFirstMessageTimeout
+	}
+	if idleTimeout > 0 {
+		last := lastFrameAt
+		if last.IsZero() {
+			last = acceptedAt
+		}
+		if d := last.Add(idleTimeout); deadline.IsZero() || d.Before(deadline) {
+			deadline, reason = d, ErrIdleTimeout
+		}
+	}
+	return deadline, reason
+}
+
+// recoveredError converts the value recovered from a panicking handler into
+// an error.
+func recoveredError(r interface{}) error {
+	switch x := r.(type) {
+	case error:
+		return x
+	case string:
+		return errors.New(x)
+	default:
+		return fmt.Errorf("%v", x)
+	}
+}
@@ -0,0 +1,791 @@
+//go:build linux
+
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+	"unicode/utf8"
+
+	"golang.org/x/text/encoding"
+)
+
+var (
+	ErrEventLoopRead   = errors.New("Reading is handled by the event loop")
+	ErrUnsupportedConn = errors.New("Connection does not expose a file descriptor")
+	ErrManagerClosed   = errors.New("Manager closed")
+
+	// errConnectionReleased interrupts the parser when the connection is
+	// terminated while its data is still being decoded.
+	errConnectionReleased = errors.New("Connection released")
+)
+
+const (
+	epollDefaultWorkers    = 64
+	epollDefaultQueueSize  = 1024
+	epollReadBufferSize    = 32 * 1024
+	epollWaitTimeout       = 100 // milliseconds
+	epollEventsBufferSize  = 128
+	epollMaxControlPayload = 125
+	epollEvictionInterval  = time.Second
+)
+
+// EpollManager is a websocket.Manager that does not hold a goroutine per
+// connection. The hijacked connections are registered on an epoll instance
+// and only read when data is available. The frames are decoded incrementally,
+// so an idle connection holds no read buffer, and complete messages are
+// dispatched to a bounded pool of workers.
+//
+// Messages of the same connection are always handled in order, one at a time.
+//
+// IMPORTANT: The fasthttp.Server MUST be configured with KeepHijackedConns
+// enabled. Otherwise, fasthttp closes the connection as soon as Accept
+// returns.
+//
+// The handlers MUST NOT read from the connection, the reading methods of
+// the connections managed by the EpollManager return
+// websocket.ErrEventLoopRead.
+type EpollManager struct {
+	OnConnect      ConnectionHandler
+	OnMessage      MessageHandler
+	OnMessageError ConnectionErrorHandler
+	OnClose        ConnectionHandler
+	// RateLimit, when set, limits the messages received by each connection.
+	// The RateLimitDelay action stops polling the connection for the time
+	// required, without holding a worker.
+	RateLimit *RateLimit
+	// GlobalRateLimiter, when set, limits the messages received by all the
+	// connections together.
+	GlobalRateLimiter *RateLimiter
+	// FirstMessageTimeout, when set, evicts the connections that do not send
+	// a frame within it after being accepted.
+	FirstMessageTimeout time.Duration
+	// IdleTimeout, when set, evicts the connections that do not send a frame
+	// (pings included) within it.
+	//
+	// The connections are checked every second, so the timeouts are not
+	// precise.
+	IdleTimeout time.Duration
+	// MaxMessageSize is the maximum size of a message received, its
+	// fragments together. Over it, the connection is closed with the
+	// ConnectionCloseReasonMessageTooBig reason, before the message is
+	// buffered. Zero means DefaultMaxMessageSize and negative values mean no
+	// limit.
+	MaxMessageSize int
+	// MaxDecompressedSize is the maximum size of a compressed message once
+	// decompressed. Over it, the connection is closed with the
+	// ConnectionCloseReasonMessageTooBig reason. Zero means
+	// DefaultMaxDecompressedSize and negative values mean no limit.
+	MaxDecompressedSize int
+	// MaxCompressionRatio, when set, also limits the decompressed size of a
+	// message to the given ratio of its compressed size.
+	MaxCompressionRatio float64
+	// CompressionLevel is the level of the compressed messages sent, from
+	// flate.HuffmanOnly to flate.BestCompression. Zero, or an invalid level,
+	// means DefaultCompressionLevel.
+	CompressionLevel int
+	// CompressionThreshold is the size of the smallest message compressed.
+	// Smaller messages are sent uncompressed, as compressing them costs more
+	// than it saves. Zero compresses all the messages.
+	CompressionThreshold int
+	// WriteBufferSize is the size of the buffer the frames are written
+	// through. Smaller frames are copied into it, for a single write, while
+	// the bigger ones are written straight from the payload. Zero means
+	// DefaultWriteBufferSize.
+	WriteBufferSize int
+	// CloseTimeout is the time waited for the peer to answer a close frame
+	// before closing the TCP connection. Zero means DefaultCloseTimeout.
+	//
+	// As the IdleTimeout, it is checked every second.
+	CloseTimeout time.Duration
+	// Metrics, when set, receives the metrics of the manager and its
+	// connections.
+	Metrics MetricsSink
+	// Logger, when set, receives the connections evicted and the errors the
+	// manager recovers from.
+	Logger Logger
+	// Tracer, when set, receives the lifecycle of the connections and their
+	// messages.
+	Tracer Tracer
+
+	epfd  int
+	mutex sync.RWMutex
+	// conns are the connections registered by their id, which the epoll
+	// events carry instead of the fd: once a connection is closed, its fd
+	// can be reused by another one while its events are still handled.
+	conns  map[uint32]*epollConnection
+	lastID uint32
+	tasks  chan *epollConnection
+	closed chan struct{}
+	wg     sync.WaitGroup
+	stats  managerStats
+}
+
+// NewEpollManager returns a new instance of the websocket.EpollManager with
+// the given number of workers. The queueSize is the number of connections
+// with data available that can wait for a worker, when the queue is full the
+// event loop stops polling until a worker is available.
+//
+// Zero values use the defaults: 64 workers and a queue of 1024 connections.
+func NewEpollManager(workers, queueSize int) (*EpollManager, error) {
+	if workers <= 0 {
+		workers = epollDefaultWorkers
+	}
+	if queueSize <= 0 {
+		queueSize = epollDefaultQueueSize
+	}
+	epfd, err := syscall.EpollCreate1(syscall.EPOLL_CLOEXEC)
+	if err != nil {
+		return nil, err
+	}
+	m := &EpollManager{
+		epfd:   epfd,
+		conns:  make(map[uint32]*epollConnection),
+		tasks:  make(chan *epollConnection, queueSize),
+		closed: make(chan struct{}),
+	}
+	m.wg.Add(workers)
+	for i := 0; i < workers; i++ {
+		go m.work()
+	}
+	m.wg.Add(1)
+	go m.loop()
+	return m, nil
+}
+
+// Accept implements the websocket.Manager.Accept method
+//
+// Differently from the other managers, it returns right after registering
+// the connection.
+func (m *EpollManager) Accept(ctx *ConnectionContext) error {
+	select {
+	case <-m.closed:
+		ctx.Conn.Close()
+		ctx.Release()
+		return ErrManagerClosed
+	default:
+	}
+
+	buffered := drainBuffered(ctx.Conn)
+	fd, err := connFd(ctx.Conn)
+	if err != nil {
+		ctx.Conn.Close()
+		ctx.Release()
+		return err
+	}
+
+	c := &epollConnection{
+		manager:    m,
+		fd:         fd,
+		ctx:        ctx,
+		acceptedAt: time.Now(),
+	}
+	c.Init(ctx)
+	c.setCompression(m.CompressionLevel, m.CompressionThreshold)
+	c.setWriteBufferSize(m.WriteBufferSize)
+	c.setCloseTimeout(m.CloseTimeout)
+	c.setMetrics(m.Metrics)
+	c.setLogger(m.Logger)
+	c.traceOpen(m.Tracer)
+	if m.RateLimit != nil {
+		c.limiter = NewRateLimiter(*m.RateLimit)
+	}
+	c.parser.OnHeader = c.onHeader
+	c.parser.OnPayload = c.onPayload
+
+	if m.OnConnect != nil {
+		if err = m.OnConnect(c); err != nil {
+			ctx.Conn.Close()
+			c.traceClose(c.Stats())
+			ctx.Release()
+			return err
+		}
+	}
+
+	m.stats.connected()
+	c.metrics.ConnectionOpened()
+
+	// Data that arrived along with the handshake, before the hijack.
+	if len(buffered) > 0 {
+		if err = c.parser.Feed(buffered); err != nil {
+			if err != errConnectionReleased {
+				m.reportError(c, err)
+			}
+			return c.Terminate()
+		}
+		if c.isReleased() {
+			return nil
+		}
+	}
+
+	m.mutex.Lock()
+	for {
+		m.lastID++
+		if _, ok := m.conns[m.lastID]; !ok {
+			break
+		}
+	}
+	c.id = m.lastID
+	m.conns[c.id] = c
+	m.mutex.Unlock()
+	err = syscall.EpollCtl(m.epfd, syscall.EPOLL_CTL_ADD, fd, &syscall.EpollEvent{
+		Events: epollEvents,
+		Fd:     int32(c.id),
+	})
+	if err != nil {
+		c.Terminate()
+		return err
+	}
+	return nil
+}
+
+// Stats returns the counters of the manager. The counters of the open
+// connections are read while they are updated, so they are approximate.
+func (m *EpollManager) Stats() ManagerStats {
+	m.mutex.RLock()
+	open := make([]Connection, 0, len(m.conns))
+	for _, c := range m.conns {
+		open = append(open, c)
+	}
+	m.mutex.RUnlock()
+	return m.stats.snapshot(open)
+}
+
+// Close closes all connections, with the ConnectionCloseReasonGoingDown
+// reason, and stops the event loop and the workers.
+func (m *EpollManager) Close() error {
+	select {
+	case <-m.closed:
+		return nil
+	default:
+	}
+	close(m.closed)
+
+	m.mutex.RLock()
+	conns := make([]*epollConnection, 0, len(m.conns))
+	for _, c := range m.conns {
+		conns = append(conns, c)
+	}
+	m.mutex.RUnlock()
+	for _, c := range conns {
+		c.CloseWithReason(ConnectionCloseReasonGoingDown)
+		c.Terminate()
+	}
+	m.wg.Wait()
+	return syscall.Close(m.epfd)
+}
+
+const epollEvents = syscall.EPOLLIN | syscall.EPOLLRDHUP | syscall.EPOLLONESHOT
+
+func (m *EpollManager) loop() {
+	defer m.wg.Done()
+	defer close(m.tasks)
+	events := make([]syscall.EpollEvent, epollEventsBufferSize)
+	lastEviction := time.Now()
+	for {
+		select {
+		case <-m.closed:
+			return
+		default:
+		}
+		n, err := syscall.EpollWait(m.epfd, events, epollWaitTimeout)
+		if err != nil {
+			if err == syscall.EINTR {
+				continue
+			}
+			return
+		}
+		for i := 0; i < n; i++ {
+			m.mutex.RLock()
+			c, ok := m.conns[uint32(events[i].Fd)]
+			m.mutex.RUnlock()
+			if !ok {
+				continue
+			}
+			select {
+			case m.tasks <- c:
+			case <-m.closed:
+				return
+			}
+		}
+		if time.Since(lastEviction) >= epollEvictionInterval {
+			lastEviction = time.Now()
+			m.evict(lastEviction)
+		}
+	}
+}
+
+// evict closes the connections that reached the FirstMessageTimeout or the
+// IdleTimeout, and the ones whose peer did not answer the close frame within
+// the CloseTimeout. The connections are closed in another goroutine, so a slow
+// peer does not hold the event loop.
+func (m *EpollManager) evict(now time.Time) {
+	type eviction struct {
+		c      *epollConnection
+		reason error
+	}
+	var evictions []eviction
+	m.mutex.RLock()
+	for _, c := range m.conns {
+		if c.closeExpired(now) {
+			evictions = append(evictions, eviction{c, ErrCloseTimeout})
+			continue
+		}
+		deadline, reason := evictionDeadline(m.FirstMessageTimeout, m.IdleTimeout, c.acceptedAt, c.lastFrame())
+		if !deadline.IsZero() && !now.Before(deadline) {
+			evictions = append(evictions, eviction{c, reason})
+		}
+	}
+	m.mutex.RUnlock()
+	if len(evictions) == 0 {
+		return
+	}
+	go func() {
+		for _, e := range evictions {
+			if e.reason == ErrCloseTimeout {
+				m.reportError(e.c, e.reason)
+				e.c.Terminate()
+				continue
+			}
+			e.c.logger.Debug("websocket: connection evicted", "remote", e.c.ctx.Conn.RemoteAddr(), "reason", e.reason)
+			m.reportError(e.c, e.reason)
+			e.c.fail(ConnectionCloseReasonPolicyViolation, e.reason)
+		}
+	}()
+}
+
+func (m *EpollManager) work() {
+	defer m.wg.Done()
+	buff := make([]byte, epollReadBufferSize)
+	for c := range m.tasks {
+		m.handle(c, buff)
+	}
+}
+
+// handle reads the data available once and arms the connection again. Since
+// the connection is registered as level-triggered, it will be dispatched again
+// if there is still data to be read.
+func (m *EpollManager) handle(c *epollConnection, buff []byte) {
+	// The lock is held through the read, so the connection cannot be
+	// released meanwhile: once closed, its fd could be reused by another
+	// connection. The fd is non-blocking, so the read does not hold it long.
+	c.mutex.Lock()
+	if c.released {
+		c.mutex.Unlock()
+		return
+	}
+	n, err := syscall.Read(c.fd, buff)
+	c.mutex.Unlock()
+	if err == syscall.EAGAIN || err == syscall.EINTR {
+		m.rearm(c)
+		return
+	}
+	if err != nil || n == 0 {
+		// The peer is gone.
+		c.Terminate()
+		return
+	}
+	if err = c.parser.Feed(buff[:n]); err != nil {
+		if err != errConnectionReleased {
+			m.reportError(c, err)
+		}
+		c.Terminate()
+		return
+	}
+	if c.delay > 0 {
+		delay := c.delay
+		c.delay = 0
+		time.AfterFunc(delay, func() {
+			m.rearm(c)
+		})
+		return
+	}
+	m.rearm(c)
+}
+
+func (m *EpollManager) rearm(c *epollConnection) {
+	// The lock is held through the rearming, so the fd cannot be closed, and
+	// reused by another connection, meanwhile.
+	c.mutex.Lock()
+	if c.released {
+		c.mutex.Unlock()
+		return
+	}
+	err := syscall.EpollCtl(m.epfd, syscall.EPOLL_CTL_MOD, c.fd, &syscall.EpollEvent{
+		Events: epollEvents,
+		Fd:     int32(c.id),
+	})
+	c.mutex.Unlock()
+	if err != nil {
+		c.logger.Error("websocket: rearming the connection failed", "fd", c.fd, "error", err)
+		m.reportError(c, err)
+		c.Terminate()
+	}
+}
+
+func (m *EpollManager) reportError(c *epollConnection, err error) {
+	if m.OnMessageError != nil {
+		m.OnMessageError(c, err)
+	}
+}
+
+// release unregisters the connection and closes it. It is called only once
+// per connection.
+func (m *EpollManager) release(c *epollConnection) error {
+	m.mutex.Lock()
+	if m.conns[c.id] == c {
+		delete(m.conns, c.id)
+		syscall.EpollCtl(m.epfd, syscall.EPOLL_CTL_DEL, c.fd, nil)
+	}
+	m.mutex.Unlock()
+	err := c.BaseConnection.Terminate()
+	if m.OnClose != nil {
+		if err2 := m.OnClose(c); err2 != nil && err == nil {
+			err = err2
+		}
+	}
+	stats := c.Stats()
+	m.stats.disconnected(stats)
+	c.metrics.ConnectionClosed(stats)
+	c.traceClose(stats)
+	c.ctx.Release()
+	return err
+}
+
+// epollConnection is the websocket.Connection managed by the EpollManager.
+type epollConnection struct {
+	SimpleConnection
+	manager  *EpollManager
+	ctx      *ConnectionContext
+	fd       int
+	id       uint32 // registration on the event loop, see EpollManager.conns
+	parser   FrameParser
+	mutex    sync.Mutex
+	released bool
+
+	message           []byte
+	messageOpcode     MessageType
+	messageCompressed bool
+	messageText       utf8Validator
+	inMessage         bool
+	control           []byte
+
+	limiter *RateLimiter
+	// delay is the time to wait before polling the connection again.
+	delay time.Duration
+
+	acceptedAt time.Time
+	// lastFrameAt is the UnixNano of the last frame received, accessed
+	// atomically.
+	lastFrameAt int64
+}
+
+// connFd returns the file descriptor of the connection.
+func connFd(conn net.Conn) (int, error) {
+	// fasthttp wraps the hijacked connection.
+	if u, ok := conn.(interface{ UnsafeConn() net.Conn }); ok {
+		conn = u.UnsafeConn()
+	}
+	sc, ok := conn.(syscall.Conn)
+	if !ok {
+		return -1, ErrUnsupportedConn
+	}
+	raw, err := sc.SyscallConn()
+	if err != nil {
+		return -1, err
+	}
+	fd := -1
+	err = raw.Control(func(f uintptr) {
+		fd = int(f)
+	})
+	if err != nil {
+		return -1, err
+	}
+	return fd, nil
+}
+
+// drainBuffered returns the data the hijacked connection has already buffered
+// when reading the handshake. The read deadline is set in the past, so only
+// the buffer is consumed and the socket is left untouched.
+func drainBuffered(conn net.Conn) []byte {
+	if _, ok := conn.(interface{ UnsafeConn() net.Conn }); !ok {
+		return nil
+	}
+	if err := conn.SetReadDeadline(time.Now().Add(-time.Second)); err != nil {
+		return nil
+	}
+	defer conn.SetReadDeadline(time.Time{})
+	var (
+		buffered []byte
+		buff     [1024]byte
+	)
+	for {
+		n, err := conn.Read(buff[:])
+		buffered = append(buffered, buff[:n]...)
+		if err != nil || n == 0 {
+			return buffered
+		}
+	}
+}
+
+func (c *epollConnection) isReleased() bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.released
+}
+
+// Read implements the websocket.Connection.Read. Reading is not allowed.
+func (c *epollConnection) Read(b []byte) (int, error) {
+	return 0, ErrEventLoopRead
+}
+
+// ReadPacket implements the websocket.Connection.ReadPacket. Reading is not
+// allowed.
+func (c *epollConnection) ReadPacket() (bool, byte, []byte, error) {
+	return false, 0, nil, ErrEventLoopRead
+}
+
+// ReadPacketTimeout implements the websocket.Connection.ReadPacketTimeout.
+// Reading is not allowed.
+func (c *epollConnection) ReadPacketTimeout(timeout time.Duration) (bool, byte, []byte, error) {
+	return false, 0, nil, ErrEventLoopRead
+}
+
+// ReadMessage implements the websocket.Connection.ReadMessage. Reading is not
+// allowed.
+func (c *epollConnection) ReadMessage() (MessageType, []byte, error) {
+	return 0, nil, ErrEventLoopRead
+}
+
+// ReadMessageTimeout implements the websocket.Connection.ReadMessageTimeout.
+// Reading is not allowed.
+func (c *epollConnection) ReadMessageTimeout(timeout time.Duration) (MessageType, []byte, error) {
+	return 0, nil, ErrEventLoopRead
+}
+
+// ReadValue implements the websocket.Connection.ReadValue. Reading is not
+// allowed.
+func (c *epollConnection) ReadValue(codec Codec, v interface{}) error {
+	return ErrEventLoopRead
+}
+
+// ReadJSON implements the websocket.Connection.ReadJSON. Reading is not
+// allowed.
+func (c *epollConnection) ReadJSON(v interface{}) error {
+	return ErrEventLoopRead
+}
+
+// Terminate implements the websocket.Connection.Terminate, unregistering the
+// connection from the event loop.
+func (c *epollConnection) Terminate() error {
+	c.mutex.Lock()
+	if c.released {
+		c.mutex.Unlock()
+		return nil
+	}
+	c.released = true
+	c.mutex.Unlock()
+	return c.manager.release(c)
+}
+
+// lastFrame returns when the last frame was received, zero if none.
+func (c *epollConnection) lastFrame() time.Time {
+	if at := atomic.LoadInt64(&c.lastFrameAt); at != 0 {
+		return time.Unix(0, at)
+	}
+	return time.Time{}
+}
+
+// fail closes the connection with the given reason, returning the err for
+// interrupting the parser.
+func (c *epollConnection) fail(reason ConnectionCloseReason, err error) error {
+	c.CloseWithReason(reason)
+	c.Terminate()
+	return err
+}
+
+func (c *epollConnection) onHeader(h *FrameHeader) error {
+	if c.isReleased() {
+		return errConnectionReleased
+	}
+	if !h.Masked {
+		return c.fail(ConnectionCloseReasonProtocolError, ErrMissingMaskKey)
+	}
+	if h.Rsv2 || h.Rsv3 {
+		return c.fail(ConnectionCloseReasonProtocolError, ErrProtocolError)
+	}
+	opcode := MessageType(h.OPCode)
+	switch opcode {
+	case MessageTypePing, MessageTypePong, MessageTypeConnectionClose:
+		if !h.Fin {
+			return c.fail(ConnectionCloseReasonProtocolError, ErrControlFragmented)
+		}
+		if h.Rsv1 || h.PayloadLen > epollMaxControlPayload {
+			return c.fail(ConnectionCloseReasonProtocolError, ErrProtocolError)
+		}
+	case MessageTypeContinuation:
+		if !c.inMessage || h.Rsv1 {
+			return c.fail(ConnectionCloseReasonProtocolError, ErrProtocolError)
+		}
+	case MessageTypeText, MessageTypeBinary:
+		if c.inMessage || (h.Rsv1 && !c.compressed) {
+			return c.fail(ConnectionCloseReasonProtocolError, ErrProtocolError)
+		}
+		c.inMessage = true
+		c.messageOpcode = opcode
+		c.messageCompressed = h.Rsv1
+		c.messageText.Reset()
+	default:
+		return c.fail(ConnectionCloseReasonProtocolError, ErrProtocolError)
+	}
+	if opcode < MessageTypeConnectionClose {
+		// The size is checked before the payload arrives, so the message
+		// buffered cannot grow without limit.
+		limit := maxMessageSize(c.manager.MaxMessageSize)
+		if limit > 0 && uint64(len(c.message))+h.PayloadLen > uint64(limit) {
+			return c.fail(ConnectionCloseReasonMessageTooBig, ErrMessageTooBig)
+		}
+	}
+	return nil
+}
+
+func (c *epollConnection) onPayload(h *FrameHeader, segment []byte, final bool) error {
+	if final {
+		atomic.StoreInt64(&c.lastFrameAt, time.Now().UnixNano())
+		c.stats.frameIn(h.OPCode, frameSize(h.PayloadLen, h.Masked))
+	}
+	opcode := MessageType(h.OPCode)
+	if opcode >= MessageTypeConnectionClose {
+		c.control = append(c.control, segment...)
+		if !final {
+			return nil
+		}
+		err := c.handleControl(opcode, c.control)
+		c.control = c.control[:0]
+		return err
+	}
+
+	if c.isClosing() {
+		// The messages received after the close frame sent are discarded.
+		return nil
+	}
+	// Invalid text fails right away, not after the last fragment.
+	if c.messageOpcode == MessageTypeText && !c.messageCompressed && !c.messageText.Write(segment) {
+		return c.fail(ConnectionCloseReasonInconsistentType, encoding.ErrInvalidUTF8)
+	}
+	c.message = append(c.message, segment...)
+	if !final || !h.Fin {
+		return nil
+	}
+	return c.handleMessage()
+}
+
+func (c *epollConnection) handleControl(opcode MessageType, payload []byte) error {
+	switch opcode {
+	case MessageTypePing:
+		if c.isOpen() {
+			return c.WritePacket(OPCodePongFrame, payload)
+		}
+	case MessageTypeConnectionClose:
+		if len(payload) == 1 {
+			return c.fail(ConnectionCloseReasonProtocolError, ErrProtocolError)
+		}
+		if len(payload) >= 2 {
+			reason := ConnectionCloseReason(binary.BigEndian.Uint16(payload))
+			c.metrics.CloseReceived(reason)
+			switch reason {
+			case ConnectionCloseReasonNormal, ConnectionCloseReasonGoingDown, ConnectionCloseReasonProtocolError, ConnectionCloseReasonDataTypeUnsupported, ConnectionCloseReasonInconsistentType, ConnectionCloseReasonPolicyViolation, ConnectionCloseReasonMessageTooBig, ConnectionCloseReasonCouldNotNegotiateExtensions, ConnectionCloseReasonUnexpected, ConnectionCloseReasonTryAgainLater:
+			default:
+				if reason < 3000 || reason >= 5000 {
+					return c.fail(ConnectionCloseReasonProtocolError, ErrWrongClosingCode)
+				}
+			}
+			if !utf8.Valid(payload[2:]) {
+				return c.fail(ConnectionCloseReasonInconsistentType, encoding.ErrInvalidUTF8)
+			}
+		} else {
+			c.metrics.CloseReceived(ConnectionCloseReasonNormal)
+		}
+		// Answered only if the close frame was not sent, ending the
+		// handshake.
+		c.replyClose(payload)
+		c.Terminate()
+		return errConnectionReleased
+	}
+	return nil
+}
+
+func (c *epollConnection) handleMessage() error {
+	opcode, payload, compressed := c.messageOpcode, c.message, c.messageCompressed
+	// The buffer is released, so idle connections do not hold memory.
+	c.message = nil
+	c.inMessage = false
+
+	if compressed {
+		var err error
+		compressedLen := len(payload)
+		limit := deflateLimit(compressedLen, maxDecompressedSize(c.manager.MaxDecompressedSize), c.manager.MaxCompressionRatio)
+		payload, err = DeflateLimit(make([]byte, 0, len(payload)), payload, limit)
+		if err == ErrMessageTooBig {
+			return c.fail(ConnectionCloseReasonMessageTooBig, err)
+		}
+		if err != nil {
+			return c.fail(ConnectionCloseReasonProtocolError, err)
+		}
+		c.stats.compressedIn(compressedLen, len(payload))
+	}
+	if opcode == MessageTypeText {
+		// The uncompressed text was validated as it arrived.
+		valid := c.messageText.Done()
+		if compressed {
+			valid = utf8.Valid(payload)
+		}
+		if !valid {
+			return c.fail(ConnectionCloseReasonInconsistentType, encoding.ErrInvalidUTF8)
+		}
+	}
+	c.stats.messageIn()
+	delay, ok := rateLimit(c, len(payload), c.manager.OnMessageError, c.limiter, c.manager.GlobalRateLimiter)
+	if !ok {
+		if c.isReleased() {
+			return errConnectionReleased
+		}
+		return nil
+	}
+	if delay > c.delay {
+		c.delay = delay
+	}
+	if c.manager.OnMessage != nil {
+		c.metrics.MessageReceived(opcode, len(payload))
+		done := c.traceMessage(opcode, len(payload))
+		start := time.Now()
+		err := c.onMessage(opcode, payload)
+		c.metrics.HandlerDone(time.Since(start), err)
+		done(err)
+		if err != nil {
+			c.manager.reportError(c, err)
+		}
+		if c.isReleased() {
+			return errConnectionReleased
+		}
+	}
+	return nil
+}
+
+// onMessage runs the OnMessage handler. A panicking handler fails only its
+// connection, with the ConnectionCloseReasonUnexpected reason, instead of the
+// worker and hence the whole process.
+func (c *epollConnection) onMessage(opcode MessageType, payload []byte) (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			c.logger.Error("websocket: handler panicked", "remote", c.ctx.Conn.RemoteAddr(), "panic", r)
+			err = c.fail(ConnectionCloseReasonUnexpected, recoveredError(r))
+		}
+	}()
+	return c.manager.OnMessage(c, opcode, payload)
+}
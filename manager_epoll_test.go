@@ -0,0 +1,246 @@
+//go:build linux
+
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/binary"
+	"net"
+	"time"
+)
+
+var _ = Describe("EpollManager", func() {
+	var (
+		manager  *EpollManager
+		listener net.Listener
+		client   net.Conn
+		closed   chan struct{}
+	)
+
+	BeforeEach(func() {
+		var err error
+		manager, err = NewEpollManager(4, 16)
+		Expect(err).To(BeNil())
+		closed = make(chan struct{})
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			if string(payload) == "read" {
+				_, _, err := conn.ReadMessage()
+				return conn.WriteMessage(MessageTypeText, []byte(err.Error()))
+			}
+			return conn.WriteMessage(opcode, payload)
+		}
+		manager.OnClose = func(conn Connection) error {
+			close(closed)
+			return nil
+		}
+	})
+
+	JustBeforeEach(func() {
+		var err error
+		listener, err = net.Listen("tcp", "127.0.0.1:0")
+		Expect(err).To(BeNil())
+		client, err = net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		server, err := listener.Accept()
+		Expect(err).To(BeNil())
+		Expect(manager.Accept(&ConnectionContext{
+			Conn: server,
+		})).To(Succeed())
+	})
+
+	AfterEach(func() {
+		client.Close()
+		listener.Close()
+		Expect(manager.Close()).To(Succeed())
+	})
+
+	It("should echo a message", func() {
+		_, err := client.Write(maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(err).To(BeNil())
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+	})
+
+	It("should resume decoding a fragmented message written byte by byte", func() {
+		stream := append(maskedFrame(false, OPCodeTextFrame, []byte("Hel")), maskedFrame(true, OPCodePingFrame, []byte("ping"))...)
+		stream = append(stream, maskedFrame(true, OPCodeContinuationFrame, []byte("lo"))...)
+		for _, b := range stream {
+			_, err := client.Write([]byte{b})
+			Expect(err).To(BeNil())
+			time.Sleep(time.Millisecond)
+		}
+		Expect(readFrames(client, 2)).To(Equal([]testFrame{
+			{OPCodePongFrame, "ping"},
+			{OPCodeTextFrame, "Hello"},
+		}))
+	})
+
+	It("should close the connection when receiving unmasked frames", func() {
+		packet, err := EncodePacket(true, false, false, false, OPCodeTextFrame, 5, nil, []byte("Hello"))
+		Expect(err).To(BeNil())
+		_, err = client.Write(packet)
+		Expect(err).To(BeNil())
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonProtocolError))
+		Eventually(closed).Should(BeClosed())
+	})
+
+	It("should fail invalid text before the last fragment", func() {
+		_, err := client.Write(maskedFrame(false, OPCodeTextFrame, []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xf4")))
+		Expect(err).To(BeNil())
+		_, err = client.Write(maskedFrame(false, OPCodeContinuationFrame, []byte("\x90\x80\x80")))
+		Expect(err).To(BeNil())
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonInconsistentType))
+		Eventually(closed).Should(BeClosed())
+	})
+
+	It("should wait for the peer to answer the close frame", func() {
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			if string(payload) == "close" {
+				return conn.Close()
+			}
+			return conn.WriteMessage(opcode, payload)
+		}
+		_, err := client.Write(maskedFrame(true, OPCodeTextFrame, []byte("close")))
+		Expect(err).To(BeNil())
+		Expect(readFrames(client, 1)[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+
+		_, err = client.Write(maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(err).To(BeNil())
+		Consistently(closed, "100ms").ShouldNot(BeClosed())
+		_, err = client.Write(maskedFrame(true, OPCodeConnectionCloseFrame, []byte{0x03, 0xe8}))
+		Expect(err).To(BeNil())
+		Eventually(closed).Should(BeClosed())
+	})
+
+	It("should answer the close frame of the peer echoing its code", func() {
+		_, err := client.Write(maskedFrame(true, OPCodeConnectionCloseFrame, []byte{0x03, 0xe9, 'b', 'y', 'e'}))
+		Expect(err).To(BeNil())
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeConnectionCloseFrame, "\x03\xe9"}}))
+		Eventually(closed).Should(BeClosed())
+	})
+
+	It("should answer an empty close frame with no payload", func() {
+		_, err := client.Write(maskedFrame(true, OPCodeConnectionCloseFrame, nil))
+		Expect(err).To(BeNil())
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeConnectionCloseFrame, ""}}))
+		Eventually(closed).Should(BeClosed())
+	})
+
+	Context("with a CloseTimeout", func() {
+		BeforeEach(func() {
+			manager.CloseTimeout = time.Millisecond * 100
+		})
+
+		It("should close the TCP connection when the peer does not answer the close frame", func() {
+			manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+				return conn.Close()
+			}
+			_, err := client.Write(maskedFrame(true, OPCodeTextFrame, []byte("close")))
+			Expect(err).To(BeNil())
+			Expect(readFrames(client, 1)[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+			Eventually(closed, "3s").Should(BeClosed())
+		})
+	})
+
+	Context("with a MaxMessageSize", func() {
+		BeforeEach(func() {
+			manager.MaxMessageSize = 8
+		})
+
+		It("should close the connection when a message is too big", func() {
+			_, err := client.Write(maskedFrame(false, OPCodeTextFrame, []byte("Hello")))
+			Expect(err).To(BeNil())
+			_, err = client.Write(maskedFrame(true, OPCodeContinuationFrame, []byte(" world")))
+			Expect(err).To(BeNil())
+			frames := readFrames(client, 1)
+			Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+			Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonMessageTooBig))
+			Eventually(closed).Should(BeClosed())
+		})
+
+		It("should accept messages up to it", func() {
+			_, err := client.Write(maskedFrame(false, OPCodeTextFrame, []byte("Hello")))
+			Expect(err).To(BeNil())
+			_, err = client.Write(maskedFrame(true, OPCodeContinuationFrame, []byte("!!!")))
+			Expect(err).To(BeNil())
+			Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello!!!"}}))
+		})
+	})
+
+	It("should close only the connection of a panicking handler", func() {
+		errs := make(chan error, 1)
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			if string(payload) == "boom" {
+				panic("boom")
+			}
+			return conn.WriteMessage(opcode, payload)
+		}
+		manager.OnMessageError = func(conn Connection, err error) {
+			errs <- err
+		}
+		_, err := client.Write(maskedFrame(true, OPCodeTextFrame, []byte("boom")))
+		Expect(err).To(BeNil())
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonUnexpected))
+		Eventually(closed).Should(BeClosed())
+		Expect(errs).To(Receive(MatchError("boom")))
+
+		manager.OnClose = nil
+		other, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer other.Close()
+		server, err := listener.Accept()
+		Expect(err).To(BeNil())
+		Expect(manager.Accept(&ConnectionContext{
+			Conn: server,
+		})).To(Succeed())
+		_, err = other.Write(maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(err).To(BeNil())
+		Expect(readFrames(other, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+	})
+
+	It("should call OnClose when the peer goes away", func() {
+		client.Close()
+		Eventually(closed).Should(BeClosed())
+	})
+
+	It("should register the connection reusing the fd of a released one anew", func() {
+		manager.mutex.RLock()
+		var released *epollConnection
+		for _, c := range manager.conns {
+			released = c
+		}
+		manager.mutex.RUnlock()
+		client.Close()
+		Eventually(closed).Should(BeClosed())
+
+		manager.OnClose = nil
+		other, err := net.Dial("tcp", listener.Addr().String())
+		Expect(err).To(BeNil())
+		defer other.Close()
+		server, err := listener.Accept()
+		Expect(err).To(BeNil())
+		Expect(manager.Accept(&ConnectionContext{
+			Conn: server,
+		})).To(Succeed())
+		manager.mutex.RLock()
+		Expect(manager.conns).To(HaveLen(1))
+		Expect(manager.conns).NotTo(HaveKey(released.id))
+		manager.mutex.RUnlock()
+		_, err = other.Write(maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(err).To(BeNil())
+		Expect(readFrames(other, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+	})
+
+	It("should not allow reading from the handlers", func() {
+		_, err := client.Write(maskedFrame(true, OPCodeTextFrame, []byte("read")))
+		Expect(err).To(BeNil())
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, ErrEventLoopRead.Error()}}))
+	})
+})
@@ -6,15 +6,86 @@ import (
 	"time"
 )
 
+// DefaultBroadcastTimeout is the default deadline of the writes of a
+// broadcast to each connection.
+const DefaultBroadcastTimeout = 5 * time.Second
+
 // ListenableManager is a websocket.Manager that implements a set of handlers
 // that will be called when any events occurs
 type ListenableManager struct {
-	ReadTimeout    time.Duration
+	// ReadTimeout is the deadline of each read. Timeouts are reported to the
+	// OnMessageError handler. Between messages the reading continues, but a
+	// timeout in the middle of a message fails the connection with
+	// ErrPartialMessageTimeout. Zero means no deadline.
+	ReadTimeout time.Duration
+	// FirstMessageTimeout, when set, evicts the connections that do not send
+	// a frame within it after being accepted.
+	FirstMessageTimeout time.Duration
+	// IdleTimeout, when set, evicts the connections that do not send a frame
+	// (pings included) within it.
+	IdleTimeout time.Duration
+	// Dispatcher, when set, runs the OnMessage handler on its pool of
+	// workers instead of the reading goroutine of the connection.
+	Dispatcher *Dispatcher
+	// RateLimit, when set, limits the messages received by each connection.
+	RateLimit *RateLimit
+	// GlobalRateLimiter, when set, limits the messages received by all the
+	// connections together.
+	GlobalRateLimiter *RateLimiter
+	// BroadcastTimeout is the deadline of each write of Broadcast and
+	// BroadcastTo, so a connection that does not read cannot hold the
+	// delivery to the others. Zero means DefaultBroadcastTimeout.
+	BroadcastTimeout time.Duration
+	// MaxMessageSize is the maximum size of a message received, its
+	// fragments together. Over it, the connection is closed with the
+	// ConnectionCloseReasonMessageTooBig reason. Zero means
+	// DefaultMaxMessageSize and negative values mean no limit.
+	MaxMessageSize int
+	// MaxDecompressedSize is the maximum size of a compressed packet once
+	// decompressed. Over it, the connection is closed with the
+	// ConnectionCloseReasonMessageTooBig reason. Zero means
+	// DefaultMaxDecompressedSize and negative values mean no limit.
+	MaxDecompressedSize int
+	// MaxCompressionRatio, when set, also limits the decompressed size of a
+	// packet to the given ratio of its compressed size.
+	MaxCompressionRatio float64
+	// CompressionLevel is the level of the compressed messages sent, from
+	// flate.HuffmanOnly to flate.BestCompression. Zero, or an invalid level,
+	// means DefaultCompressionLevel.
+	CompressionLevel int
+	// CompressionThreshold is the size of the smallest message compressed.
+	// Smaller messages are sent uncompressed, as compressing them costs more
+	// than it saves. Zero compresses all the messages.
+	CompressionThreshold int
+	// WriteBufferSize is the size of the buffer the frames are written
+	// through. Smaller frames are copied into it, for a single write, while
+	// the bigger ones are written straight from the payload. Zero means
+	// DefaultWriteBufferSize.
+	WriteBufferSize int
+	// CloseTimeout is the time waited for the peer to answer a close frame
+	// before closing the TCP connection. Zero means DefaultCloseTimeout.
+	CloseTimeout time.Duration
+	// Metrics, when set, receives the metrics of the manager and its
+	// connections.
+	Metrics MetricsSink
+	// Logger, when set, receives the connections evicted and the errors the
+	// manager recovers from.
+	Logger Logger
+	// Tracer, when set, receives the lifecycle of the connections and their
+	// messages.
+	Tracer Tracer
+
 	conns          sync.Pool
 	OnConnect      ConnectionHandler
 	OnMessage      MessageHandler
 	OnMessageError ConnectionErrorHandler
 	OnClose        ConnectionHandler
+	middlewares    []Middleware
+	onConnectMws   []ConnectionMiddleware
+	onCloseMws     []ConnectionMiddleware
+	rooms          *rooms
+	backplane      Backplane
+	stats          managerStats
 }
 
 // NewListeableManager returns a new instance of the websocket.ListenableManager
@@ -25,19 +96,67 @@ func NewListeableManager() *ListenableManager {
 				return NewSimpleConn(nil)
 			},
 		},
+		rooms: newRooms(),
 	}
 }
 
 // Accept implements the websocket.Manager.Accept method
 func (cm *ListenableManager) Accept(ctx *ConnectionContext) (err error) {
+	defer ctx.Release()
 	c := cm.conns.Get().(Connection)
 	defer func() {
 		c.Reset()
 		cm.conns.Put(c)
 	}()
+	onConnect := chainConnectionHandler(cm.OnConnect, cm.onConnectMws)
+	metrics := metricsOrNop(cm.Metrics)
+	logger := loggerOrNop(cm.Logger)
+	tracer := tracerOrNop(cm.Tracer)
+	onMessage := tracedMessageHandler(timedMessageHandler(chainMessageHandler(cm.OnMessage, cm.middlewares), metrics), tracer)
+	onClose := chainConnectionHandler(cm.OnClose, cm.onCloseMws)
+
 	c.Init(ctx)
-	if cm.OnConnect != nil {
-		err = cm.OnConnect(c)
+	if ml, ok := c.(messageSizeLimiter); ok {
+		ml.setMaxMessageSize(cm.MaxMessageSize)
+	}
+	if dl, ok := c.(deflateLimiter); ok {
+		dl.setDeflateLimits(cm.MaxDecompressedSize, cm.MaxCompressionRatio)
+	}
+	if cs, ok := c.(compressionSetter); ok {
+		cs.setCompression(cm.CompressionLevel, cm.CompressionThreshold)
+	}
+	if wb, ok := c.(writeBufferSetter); ok {
+		wb.setWriteBufferSize(cm.WriteBufferSize)
+	}
+	if ct, ok := c.(closeTimeoutSetter); ok {
+		ct.setCloseTimeout(cm.CloseTimeout)
+	}
+	if mr, ok := c.(metricsReporter); ok {
+		mr.setMetrics(metrics)
+	}
+	if ls, ok := c.(loggerSetter); ok {
+		ls.setLogger(logger)
+	}
+	tc, traced := c.(tracedConnection)
+	if traced {
+		tc.traceOpen(tracer)
+	}
+	cm.rooms.add(c)
+	// Deferred after the release, so it is unregistered before returning to
+	// the pool.
+	defer cm.rooms.remove(c)
+	cm.stats.connected()
+	metrics.ConnectionOpened()
+	defer func() {
+		stats := c.Stats()
+		cm.stats.disconnected(stats)
+		metrics.ConnectionClosed(stats)
+		if traced {
+			tc.traceClose(stats)
+		}
+	}()
+	if onConnect != nil {
+		err = onConnect(c)
 		if err != nil {
 			err2 := c.Conn().Close()
 			if err2 != nil {
@@ -49,34 +168,250 @@ func (cm *ListenableManager) Accept(ctx *ConnectionContext) (err error) {
 	defer func() {
 		if r := recover(); r != nil {
 			err2 := c.CloseWithReason(ConnectionCloseReasonUnexpected)
-			switch x := r.(type) {
-			case string:
-				if err2 != nil {
-					err = errors.Wrap(err2, x)
-				} else {
-					err = errors.New(x)
-				}
-			case error:
-				if err2 != nil {
-					err = errors.Wrap(err2, x.Error())
-				} else {
-					err = x
-				}
-			default:
-				err = errors.New("unknown error")
+			err = recoveredError(r)
+			if err2 != nil {
+				err = errors.Wrap(err2, err.Error())
 			}
+			logger.Error("websocket: handler panicked", "remote", c.Conn().RemoteAddr(), "panic", r)
 		}
 	}()
+	var (
+		queue   *dispatchQueue
+		pending sync.WaitGroup
+		limiter *RateLimiter
+	)
+	if cm.RateLimit != nil {
+		limiter = NewRateLimiter(*cm.RateLimit)
+	}
+	if cm.Dispatcher != nil {
+		queue = cm.Dispatcher.queue()
+		// The connection cannot be released while its messages are queued.
+		defer pending.Wait()
+	}
+	var (
+		acceptedAt  = time.Now()
+		lastFrameAt time.Time
+	)
 	for !c.IsClosed() {
-		opcode, payload, err := c.ReadMessageTimeout(cm.ReadTimeout)
+		evictAt, evictErr := evictionDeadline(cm.FirstMessageTimeout, cm.IdleTimeout, acceptedAt, lastFrameAt)
+		timeout := cm.ReadTimeout
+		if !evictAt.IsZero() {
+			if until := time.Until(evictAt); timeout == 0 || until < timeout {
+				timeout = until
+				// A zero timeout would mean no deadline.
+				if timeout <= 0 {
+					timeout = time.Nanosecond
+				}
+			}
+		}
+		opcode, payload, err := c.ReadMessageTimeout(timeout)
+		if err == nil {
+			lastFrameAt = time.Now()
+		}
 		if err == nil && payload != nil {
-			err = cm.OnMessage(c, opcode, payload)
+			delay, ok := rateLimit(c, len(payload), cm.OnMessageError, limiter, cm.GlobalRateLimiter)
+			if !ok {
+				continue
+			}
+			if delay > 0 {
+				time.Sleep(delay)
+			}
+			if queue != nil {
+				cm.dispatch(c, onMessage, logger, queue, &pending, opcode, payload)
+				continue
+			}
+			err = onMessage(c, opcode, payload)
 			if err != nil && cm.OnMessageError != nil {
 				cm.OnMessageError(c, err)
 			}
+		} else if err == errConnectionAborted {
+			// A write timed out, it was reported by the writer.
+			c.Terminate()
+			break
 		} else if err != nil {
+			timedOut := isTimeout(err) || err == ErrPartialMessageTimeout
+			if timedOut && !evictAt.IsZero() && !time.Now().Before(evictAt) {
+				// Half-open or trickle-feeding clients.
+				logger.Debug("websocket: connection evicted", "remote", c.Conn().RemoteAddr(), "reason", evictErr)
+				if cm.OnMessageError != nil {
+					cm.OnMessageError(c, evictErr)
+				}
+				c.CloseWithReason(ConnectionCloseReasonPolicyViolation)
+				c.Terminate()
+				break
+			}
+			if cm.OnMessageError != nil {
+				cm.OnMessageError(c, err)
+			}
+			if !isTimeout(err) {
+				// The stream cannot be recovered (eg. the peer is gone, or
+				// it timed out in the middle of a message).
+				c.Terminate()
+				break
+			}
+		}
+	}
+	pending.Wait()
+	if onClose == nil {
+		return nil
+	}
+	return onClose(c)
+}
+
+// dispatch enqueues the message on the Dispatcher, handling the queue full
+// policy.
+func (cm *ListenableManager) dispatch(c Connection, onMessage MessageHandler, logger Logger, queue *dispatchQueue, pending *sync.WaitGroup, opcode MessageType, payload []byte) {
+	// The payload buffer is reused by the next read.
+	p := make([]byte, len(payload))
+	copy(p, payload)
+	pending.Add(1)
+	err := cm.Dispatcher.dispatch(queue, func() {
+		defer pending.Done()
+		// A panicking handler fails only its connection, the worker goes on
+		// with the next messages.
+		defer func() {
+			if r := recover(); r != nil {
+				logger.Error("websocket: handler panicked", "remote", c.Conn().RemoteAddr(), "panic", r)
+				c.CloseWithReason(ConnectionCloseReasonUnexpected)
+				if cm.OnMessageError != nil {
+					cm.OnMessageError(c, recoveredError(r))
+				}
+			}
+		}()
+		if err := onMessage(c, opcode, p); err != nil && cm.OnMessageError != nil {
 			cm.OnMessageError(c, err)
 		}
+	})
+	if err == nil {
+		return
+	}
+	pending.Done()
+	if cm.OnMessageError != nil {
+		cm.OnMessageError(c, err)
+	}
+	if err == ErrDispatcherClosed || cm.Dispatcher.queueFull == QueueFullClose {
+		c.CloseWithReason(ConnectionCloseReasonTryAgainLater)
+		c.Terminate()
+	}
+}
+
+// Stats returns the counters of the manager. The counters of the open
+// connections are read while they are updated, so they are approximate.
+func (cm *ListenableManager) Stats() ManagerStats {
+	return cm.stats.snapshot(cm.rooms.members(""))
+}
+
+// Use appends middlewares to the OnMessage handler. They are composed in the
+// given order, the first one being the outermost.
+//
+// Middlewares should be added before the manager starts accepting
+// connections.
+func (cm *ListenableManager) Use(middlewares ...Middleware) {
+	cm.middlewares = append(cm.middlewares, middlewares...)
+}
+
+// UseOnConnect appends middlewares to the OnConnect handler. They are composed
+// in the given order, the first one being the outermost.
+func (cm *ListenableManager) UseOnConnect(middlewares ...ConnectionMiddleware) {
+	cm.onConnectMws = append(cm.onConnectMws, middlewares...)
+}
+
+// UseOnClose appends middlewares to the OnClose handler. They are composed in
+// the given order, the first one being the outermost.
+func (cm *ListenableManager) UseOnClose(middlewares ...ConnectionMiddleware) {
+	cm.onCloseMws = append(cm.onCloseMws, middlewares...)
+}
+
+// SetBackplane connects the manager to a cluster. Broadcasts performed in this
+// manager are published to the other nodes, and the broadcasts published by
+// them are delivered to the connections of this manager.
+//
+// It should be called before the manager starts accepting connections.
+func (cm *ListenableManager) SetBackplane(backplane Backplane) error {
+	err := backplane.Subscribe(func(msg *BackplaneMessage) {
+		cm.deliver(msg.Topic, msg.OPCode, msg.Payload)
+	})
+	if err != nil {
+		return err
+	}
+	cm.backplane = backplane
+	return nil
+}
+
+// Join adds the connection to the room.
+func (cm *ListenableManager) Join(conn Connection, room string) error {
+	if room == "" {
+		return ErrInvalidRoom
+	}
+	if !cm.rooms.join(conn, room) {
+		return ErrConnectionNotRegistered
+	}
+	return nil
+}
+
+// Leave removes the connection from the room.
+func (cm *ListenableManager) Leave(conn Connection, room string) {
+	cm.rooms.leave(conn, room)
+}
+
+// Broadcast sends the message to all connections of the manager and, when a
+// backplane is set, to the connections of all the other nodes.
+//
+// Errors writing to a connection are reported to the OnMessageError handler.
+// The connections that do not take the message within the BroadcastTimeout
+// are terminated.
+func (cm *ListenableManager) Broadcast(opcode MessageType, payload []byte) error {
+	return cm.publish("", opcode, payload)
+}
+
+// BroadcastTo sends the message to all connections that joined the room, in
+// this manager and, when a backplane is set, in all the other nodes.
+//
+// Errors writing to a connection are reported to the OnMessageError handler.
+// The connections that do not take the message within the BroadcastTimeout
+// are terminated.
+func (cm *ListenableManager) BroadcastTo(room string, opcode MessageType, payload []byte) error {
+	if room == "" {
+		return ErrInvalidRoom
+	}
+	return cm.publish(room, opcode, payload)
+}
+
+func (cm *ListenableManager) publish(room string, opcode MessageType, payload []byte) error {
+	cm.deliver(room, opcode, payload)
+	if cm.backplane == nil {
+		return nil
+	}
+	return cm.backplane.Publish(&BackplaneMessage{
+		Topic:   room,
+		OPCode:  opcode,
+		Payload: payload,
+	})
+}
+
+func (cm *ListenableManager) deliver(room string, opcode MessageType, payload []byte) {
+	timeout := cm.BroadcastTimeout
+	if timeout == 0 {
+		timeout = DefaultBroadcastTimeout
+	}
+	for _, r := range cm.rooms.recipients(room) {
+		var err error
+		// The connection may be released, and reused, since the snapshot.
+		if g, ok := r.conn.(generational); ok {
+			err = g.writeMessageGeneration(r.generation, timeout, opcode, payload)
+			if err == ErrConnectionClosed {
+				continue
+			}
+		} else {
+			err = r.conn.WriteMessageTimeout(timeout, opcode, payload)
+		}
+		if err == nil {
+			continue
+		}
+		// A connection timing out is aborted, then terminated by its
+		// reader.
+		if cm.OnMessageError != nil {
+			cm.OnMessageError(r.conn, err)
+		}
 	}
-	return cm.OnClose(c)
 }
@@ -0,0 +1,248 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/binary"
+	"io/ioutil"
+	"net"
+	"time"
+)
+
+var _ = Describe("ListenableManager", func() {
+	var (
+		manager *ListenableManager
+		errs    chan error
+	)
+
+	BeforeEach(func() {
+		errs = make(chan error, 10)
+		manager = NewListeableManager()
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			return conn.WriteMessage(opcode, payload)
+		}
+		manager.OnMessageError = func(conn Connection, err error) {
+			errs <- err
+		}
+	})
+
+	expectEvicted := func(frames []testFrame) {
+		Expect(frames[len(frames)-1].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[len(frames)-1].payload)))).To(Equal(ConnectionCloseReasonPolicyViolation))
+	}
+
+	It("should not time out reading without a ReadTimeout", func() {
+		client, done := acceptPipe(manager)
+		time.Sleep(time.Millisecond * 50)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+		Expect(errs).NotTo(Receive())
+		client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should carry on reading after timeouts between messages", func() {
+		manager.ReadTimeout = time.Millisecond * 100
+		client, done := acceptPipe(manager)
+		time.Sleep(time.Millisecond * 250)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+		Expect(errs).To(Receive(WithTransform(isTimeout, BeTrue())))
+		client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should fail the connection on timeouts in the middle of a frame", func() {
+		manager.ReadTimeout = time.Millisecond * 100
+		client, done := acceptPipe(manager)
+		frame := maskedFrame(true, OPCodeTextFrame, []byte("Hello"))
+		writeFrames(client, frame[:3])
+		time.Sleep(time.Millisecond * 250)
+		writeFrames(client, frame[3:])
+		expectEvicted(readFrames(client, 1))
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(errs).To(Receive(Equal(ErrPartialMessageTimeout)))
+	})
+
+	It("should fail the connection on timeouts between the fragments of a message", func() {
+		manager.ReadTimeout = time.Millisecond * 100
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(false, OPCodeTextFrame, []byte("Hel")))
+		time.Sleep(time.Millisecond * 250)
+		writeFrames(client, maskedFrame(true, OPCodeContinuationFrame, []byte("lo")))
+		expectEvicted(readFrames(client, 1))
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(errs).To(Receive(Equal(ErrPartialMessageTimeout)))
+	})
+
+	It("should evict connections that do not send the first message", func() {
+		manager.ReadTimeout = time.Second
+		manager.FirstMessageTimeout = time.Millisecond * 50
+		client, done := acceptPipe(manager)
+		// A partial frame, trickle-fed.
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello"))[:3])
+		expectEvicted(readFrames(client, 1))
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(errs).To(Receive(Equal(ErrFirstMessageTimeout)))
+	})
+
+	It("should evict idle connections", func() {
+		manager.ReadTimeout = time.Second
+		manager.FirstMessageTimeout = time.Second
+		manager.IdleTimeout = time.Millisecond * 100
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		frames := readFrames(client, 2)
+		Expect(frames[0]).To(Equal(testFrame{OPCodeTextFrame, "Hello"}))
+		expectEvicted(frames)
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(errs).To(Receive(Equal(ErrIdleTimeout)))
+	})
+
+	It("should wait for the peer to answer the close frame", func() {
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			if string(payload) == "close" {
+				return conn.Close()
+			}
+			return conn.WriteMessage(opcode, payload)
+		}
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("close")))
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonNormal))
+		Consistently(done, "100ms").ShouldNot(Receive())
+
+		// The messages sent before the close answer are discarded.
+		writeFrames(client,
+			maskedFrame(true, OPCodeTextFrame, []byte("Hello")),
+			maskedFrame(true, OPCodePingFrame, []byte("ping")),
+			maskedFrame(true, OPCodeConnectionCloseFrame, []byte{0x03, 0xe8}),
+		)
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(ioutil.ReadAll(client)).To(BeEmpty())
+		Expect(errs).NotTo(Receive())
+	})
+
+	It("should close the TCP connection when the peer does not answer the close frame", func() {
+		manager.CloseTimeout = time.Millisecond * 100
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			return conn.Close()
+		}
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("close")))
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(errs).To(Receive(Equal(ErrCloseTimeout)))
+	})
+
+	It("should reject writes while closing", func() {
+		writeErrs := make(chan error, 2)
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			writeErrs <- conn.Close()
+			writeErrs <- conn.WriteMessage(MessageTypeText, []byte("Hello"))
+			return nil
+		}
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("close")))
+		Expect(readFrames(client, 1)[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Eventually(writeErrs).Should(Receive(BeNil()))
+		Eventually(writeErrs).Should(Receive(Equal(ErrConnectionClosing)))
+		writeFrames(client, maskedFrame(true, OPCodeConnectionCloseFrame, nil))
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should fail invalid text before the last fragment", func() {
+		manager.ReadTimeout = time.Second
+		client, done := acceptPipe(manager)
+		writeFrames(client,
+			maskedFrame(false, OPCodeTextFrame, []byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5\xf4")),
+			maskedFrame(false, OPCodeContinuationFrame, []byte("\x90\x80\x80")),
+		)
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonInconsistentType))
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should close the connection when a message is over the MaxMessageSize", func() {
+		manager.MaxMessageSize = 8
+		client, done := acceptPipe(manager)
+		writeFrames(client,
+			maskedFrame(false, OPCodeTextFrame, []byte("Hello")),
+			maskedFrame(true, OPCodeContinuationFrame, []byte(" world")),
+		)
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonMessageTooBig))
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(errs).To(Receive(Equal(ErrMessageTooBig)))
+	})
+
+	It("should close the connection when a frame is over the MaxMessageSize", func() {
+		manager.MaxMessageSize = 8
+		client, done := acceptPipe(manager)
+		// Only the header is sent: the frame fails before its payload.
+		writeFrames(client, maskedFrame(true, OPCodeBinaryFrame, make([]byte, 1024))[:8])
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonMessageTooBig))
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(errs).To(Receive(Equal(ErrMessageTooBig)))
+	})
+
+	It("should send the messages under the CompressionThreshold uncompressed", func() {
+		manager.CompressionThreshold = 64
+		server, client := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- manager.Accept(&ConnectionContext{
+				Conn:       server,
+				Compressed: true,
+			})
+		}()
+		for _, message := range [][]byte{[]byte("Hello"), bytes.Repeat([]byte("Hello"), 20)} {
+			flated, _, err := Flate(nil, message)
+			Expect(err).To(BeNil())
+			writeFrames(client, compressedFrame(true, OPCodeTextFrame, flated))
+			buff := make([]byte, 1024)
+			Expect(client.SetReadDeadline(time.Now().Add(time.Second))).To(Succeed())
+			n, err := client.Read(buff)
+			Expect(err).To(BeNil())
+			_, rsv1, _, _, _, _, _, payload, err := DecodePacket(buff[:n])
+			Expect(err).To(BeNil())
+			Expect(rsv1).To(Equal(len(message) >= 64))
+			if rsv1 {
+				payload, err = Deflate(nil, payload)
+				Expect(err).To(BeNil())
+			}
+			Expect(payload).To(Equal(message))
+		}
+		client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should close the connection when a compressed message is too big", func() {
+		manager.ReadTimeout = time.Second
+		manager.MaxDecompressedSize = 1024
+		server, client := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- manager.Accept(&ConnectionContext{
+				Conn:       server,
+				Compressed: true,
+			})
+		}()
+		flated, _, err := Flate(nil, make([]byte, 1025))
+		Expect(err).To(BeNil())
+		writeFrames(client, compressedFrame(true, OPCodeBinaryFrame, flated))
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonMessageTooBig))
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(errs).To(Receive(Equal(ErrMessageTooBig)))
+	})
+})
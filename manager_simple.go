@@ -4,6 +4,9 @@ import "sync"
 
 // SimpleManager is a manager that will let the handler property manage all
 // reading and writing of the connection.
+//
+// The connections are pooled: once the handler returns, its connection is
+// reset and reused, so it must not be kept by the handler.
 type SimpleManager struct {
 	conns   sync.Pool
 	handler ConnectionHandler
@@ -14,7 +17,7 @@ func NewSimpleManager(handler ConnectionHandler) *SimpleManager {
 	return &SimpleManager{
 		conns: sync.Pool{
 			New: func() interface{} {
-				return NewConn(nil)
+				return NewSimpleConn(nil)
 			},
 		},
 		handler: handler,
@@ -23,7 +26,12 @@ func NewSimpleManager(handler ConnectionHandler) *SimpleManager {
 
 // Accept implements the websocket.Manager.Accept method
 func (cm *SimpleManager) Accept(ctx *ConnectionContext) error {
+	defer ctx.Release()
 	c := cm.conns.Get().(*SimpleConnection)
+	defer func() {
+		c.Reset()
+		cm.conns.Put(c)
+	}()
 	c.Init(ctx)
 	return cm.handler(c)
 }
@@ -0,0 +1,38 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("SimpleManager", func() {
+	It("should hand the connections to the handler", func() {
+		manager := NewSimpleManager(func(conn Connection) error {
+			opcode, payload, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+			return conn.WriteMessage(opcode, payload)
+		})
+		client, done := acceptPipe(manager)
+		defer client.Close()
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should reset the connections once the handler returns", func() {
+		handled := make(chan Connection, 1)
+		manager := NewSimpleManager(func(conn Connection) error {
+			handled <- conn
+			return nil
+		})
+		client, done := acceptPipe(manager)
+		defer client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+		var conn Connection
+		Expect(handled).To(Receive(&conn))
+		Expect(conn.Conn()).To(BeNil())
+		Expect(conn.IsClosed()).To(BeTrue())
+	})
+})
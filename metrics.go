@@ -0,0 +1,70 @@
+package websocket
+
+import (
+	"time"
+)
+
+// MetricsSink receives the metrics reported by the Upgrader, the managers and
+// the connections. Implementations must be safe for concurrent use.
+type MetricsSink interface {
+	// Handshake reports a handshake processed by the Upgrader. The failure
+	// is empty when the connection was upgraded.
+	Handshake(failure HandshakeFailure)
+	// ConnectionOpened reports a connection accepted by a manager.
+	ConnectionOpened()
+	// ConnectionClosed reports a connection released by a manager, with its
+	// final counters.
+	ConnectionClosed(stats ConnectionStats)
+	// MessageReceived reports a message, of size bytes, delivered by a
+	// manager to its OnMessage handler.
+	MessageReceived(opcode MessageType, size int)
+	// MessageSent reports a message, of size bytes, sent by a connection.
+	MessageSent(opcode MessageType, size int)
+	// HandlerDone reports the duration and the result of an OnMessage
+	// handler.
+	HandlerDone(duration time.Duration, err error)
+	// CloseReceived reports a close frame received with the reason.
+	CloseReceived(reason ConnectionCloseReason)
+	// CloseSent reports a close frame sent with the reason.
+	CloseSent(reason ConnectionCloseReason)
+}
+
+// nopMetrics is used when no MetricsSink is configured.
+type nopMetrics struct{}
+
+func (nopMetrics) Handshake(failure HandshakeFailure)            {}
+func (nopMetrics) ConnectionOpened()                             {}
+func (nopMetrics) ConnectionClosed(stats ConnectionStats)        {}
+func (nopMetrics) MessageReceived(opcode MessageType, size int)  {}
+func (nopMetrics) MessageSent(opcode MessageType, size int)      {}
+func (nopMetrics) HandlerDone(duration time.Duration, err error) {}
+func (nopMetrics) CloseReceived(reason ConnectionCloseReason)    {}
+func (nopMetrics) CloseSent(reason ConnectionCloseReason)        {}
+
+// metricsOrNop returns the sink, or a no-op one when it is nil.
+func metricsOrNop(sink MetricsSink) MetricsSink {
+	if sink == nil {
+		return nopMetrics{}
+	}
+	return sink
+}
+
+// metricsReporter is implemented by the connections that report metrics, for
+// the managers to configure their sink.
+type metricsReporter interface {
+	setMetrics(sink MetricsSink)
+}
+
+// timedMessageHandler wraps the handler reporting its duration to the sink.
+func timedMessageHandler(handler MessageHandler, sink MetricsSink) MessageHandler {
+	if _, ok := sink.(nopMetrics); ok {
+		return handler
+	}
+	return func(conn Connection, opcode MessageType, payload []byte) error {
+		sink.MessageReceived(opcode, len(payload))
+		start := time.Now()
+		err := handler(conn, opcode, payload)
+		sink.HandlerDone(time.Since(start), err)
+		return err
+	}
+}
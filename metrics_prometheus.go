@@ -0,0 +1,306 @@
+package websocket
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// DefaultMessageSizeBuckets are the buckets, in bytes, of the message size
+// histograms.
+var DefaultMessageSizeBuckets = []float64{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// DefaultHandlerDurationBuckets are the buckets, in seconds, of the handler
+// duration histogram.
+var DefaultHandlerDurationBuckets = []float64{0.0005, 0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+
+// PrometheusMetrics is a MetricsSink that keeps the metrics in memory and
+// renders them in the Prometheus text exposition format. It does not depend
+// on the Prometheus client library.
+//
+//	metrics := websocket.NewPrometheusMetrics("")
+//	upgrader.Metrics = metrics
+//	manager.Metrics = metrics
+//	http.Handle("/metrics", metrics)
+type PrometheusMetrics struct {
+	namespace string
+
+	mutex            sync.Mutex
+	handshakes       map[string]uint64
+	connectionsOpen  int64
+	connectionsTotal uint64
+	bytes            map[string]uint64
+	messages         map[string]uint64
+	messageSize      map[string]*histogram
+	handlerDuration  *histogram
+	handlerErrors    uint64
+	closeCodes       map[string]uint64
+	sizeBuckets      []float64
+}
+
+// NewPrometheusMetrics returns a new instance of the
+// websocket.PrometheusMetrics. The namespace prefixes the metric names,
+// default: "websocket".
+func NewPrometheusMetrics(namespace string) *PrometheusMetrics {
+	if namespace == "" {
+		namespace = "websocket"
+	}
+	return &PrometheusMetrics{
+		namespace:       namespace,
+		handshakes:      make(map[string]uint64),
+		bytes:           make(map[string]uint64),
+		messages:        make(map[string]uint64),
+		messageSize:     make(map[string]*histogram),
+		handlerDuration: newHistogram(DefaultHandlerDurationBuckets),
+		closeCodes:      make(map[string]uint64),
+		sizeBuckets:     DefaultMessageSizeBuckets,
+	}
+}
+
+// Handshake implements the websocket.MetricsSink.Handshake method
+func (p *PrometheusMetrics) Handshake(failure HandshakeFailure) {
+	result := string(failure)
+	if result == "" {
+		result = "upgraded"
+	}
+	p.mutex.Lock()
+	p.handshakes[result]++
+	p.mutex.Unlock()
+}
+
+// ConnectionOpened implements the websocket.MetricsSink.ConnectionOpened method
+func (p *PrometheusMetrics) ConnectionOpened() {
+	p.mutex.Lock()
+	p.connectionsOpen++
+	p.connectionsTotal++
+	p.mutex.Unlock()
+}
+
+// ConnectionClosed implements the websocket.MetricsSink.ConnectionClosed method
+func (p *PrometheusMetrics) ConnectionClosed(stats ConnectionStats) {
+	p.mutex.Lock()
+	p.connectionsOpen--
+	p.bytes["in"] += stats.BytesIn
+	p.bytes["out"] += stats.BytesOut
+	p.mutex.Unlock()
+}
+
+// MessageReceived implements the websocket.MetricsSink.MessageReceived method
+func (p *PrometheusMetrics) MessageReceived(opcode MessageType, size int) {
+	p.message("in", opcode, size)
+}
+
+// MessageSent implements the websocket.MetricsSink.MessageSent method
+func (p *PrometheusMetrics) MessageSent(opcode MessageType, size int) {
+	p.message("out", opcode, size)
+}
+
+func (p *PrometheusMetrics) message(direction string, opcode MessageType, size int) {
+	p.mutex.Lock()
+	defer p.mutex.Unlock()
+	p.messages[direction+"\x00"+messageTypeName(opcode)]++
+	h, ok := p.messageSize[direction]
+	if !ok {
+		h = newHistogram(p.sizeBuckets)
+		p.messageSize[direction] = h
+	}
+	h.observe(float64(size))
+}
+
+// HandlerDone implements the websocket.MetricsSink.HandlerDone method
+func (p *PrometheusMetrics) HandlerDone(duration time.Duration, err error) {
+	p.mutex.Lock()
+	p.handlerDuration.observe(duration.Seconds())
+	if err != nil {
+		p.handlerErrors++
+	}
+	p.mutex.Unlock()
+}
+
+// CloseReceived implements the websocket.MetricsSink.CloseReceived method
+func (p *PrometheusMetrics) CloseReceived(reason ConnectionCloseReason) {
+	p.closeCode("peer", reason)
+}
+
+// CloseSent implements the websocket.MetricsSink.CloseSent method
+func (p *PrometheusMetrics) CloseSent(reason ConnectionCloseReason) {
+	p.closeCode("local", reason)
+}
+
+func (p *PrometheusMetrics) closeCode(initiator string, reason ConnectionCloseReason) {
+	p.mutex.Lock()
+	p.closeCodes[initiator+"\x00"+strconv.Itoa(int(reason))]++
+	p.mutex.Unlock()
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format.
+func (p *PrometheusMetrics) WriteTo(w io.Writer) (int64, error) {
+	cw := &countingWriter{w: bufio.NewWriter(w)}
+	p.mutex.Lock()
+	p.write(cw)
+	p.mutex.Unlock()
+	if cw.err != nil {
+		return cw.n, cw.err
+	}
+	return cw.n, cw.w.(*bufio.Writer).Flush()
+}
+
+func (p *PrometheusMetrics) write(w *countingWriter) {
+	name := func(metric string) string {
+		return p.namespace + "_" + metric
+	}
+
+	header(w, name("handshakes_total"), "counter", "Handshakes processed by result.")
+	for _, result := range sortedKeys(p.handshakes) {
+		w.printf("%s{result=%q} %d\n", name("handshakes_total"), result, p.handshakes[result])
+	}
+
+	header(w, name("connections_open"), "gauge", "Connections being managed.")
+	w.printf("%s %d\n", name("connections_open"), p.connectionsOpen)
+
+	header(w, name("connections_total"), "counter", "Connections accepted.")
+	w.printf("%s %d\n", name("connections_total"), p.connectionsTotal)
+
+	header(w, name("bytes_total"), "counter", "Bytes on the wire of the closed connections by direction.")
+	for _, direction := range sortedKeys(p.bytes) {
+		w.printf("%s{direction=%q} %d\n", name("bytes_total"), direction, p.bytes[direction])
+	}
+
+	header(w, name("messages_total"), "counter", "Messages by direction and type.")
+	for _, key := range sortedKeys(p.messages) {
+		direction, messageType := splitKey(key)
+		w.printf("%s{direction=%q,type=%q} %d\n", name("messages_total"), direction, messageType, p.messages[key])
+	}
+
+	header(w, name("message_size_bytes"), "histogram", "Size of the messages by direction.")
+	directions := make([]string, 0, len(p.messageSize))
+	for direction := range p.messageSize {
+		directions = append(directions, direction)
+	}
+	sort.Strings(directions)
+	for _, direction := range directions {
+		p.messageSize[direction].write(w, name("message_size_bytes"), fmt.Sprintf("direction=%q,", direction))
+	}
+
+	header(w, name("handler_duration_seconds"), "histogram", "Duration of the message handlers.")
+	p.handlerDuration.write(w, name("handler_duration_seconds"), "")
+
+	header(w, name("handler_errors_total"), "counter", "Errors returned by the message handlers.")
+	w.printf("%s %d\n", name("handler_errors_total"), p.handlerErrors)
+
+	header(w, name("close_codes_total"), "counter", "Close frames by initiator and code.")
+	for _, key := range sortedKeys(p.closeCodes) {
+		initiator, code := splitKey(key)
+		w.printf("%s{initiator=%q,code=%q} %d\n", name("close_codes_total"), initiator, code, p.closeCodes[key])
+	}
+}
+
+// ServeHTTP implements the http.Handler rendering the metrics.
+func (p *PrometheusMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(w)
+}
+
+// FasthttpHandler is the fasthttp.RequestHandler rendering the metrics.
+func (p *PrometheusMetrics) FasthttpHandler(ctx *fasthttp.RequestCtx) {
+	ctx.SetContentType("text/plain; version=0.0.4; charset=utf-8")
+	p.WriteTo(ctx)
+}
+
+// histogram is guarded by the mutex of the PrometheusMetrics.
+type histogram struct {
+	buckets []float64
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets []float64) *histogram {
+	return &histogram{
+		buckets: buckets,
+		counts:  make([]uint64, len(buckets)),
+	}
+}
+
+func (h *histogram) observe(v float64) {
+	for i, bound := range h.buckets {
+		if v <= bound {
+			h.counts[i]++
+			break
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+// write renders the histogram, the labels must end with a comma.
+func (h *histogram) write(w *countingWriter, name string, labels string) {
+	var cumulative uint64
+	for i, bound := range h.buckets {
+		cumulative += h.counts[i]
+		w.printf("%s_bucket{%sle=%q} %d\n", name, labels, strconv.FormatFloat(bound, 'g', -1, 64), cumulative)
+	}
+	w.printf("%s_bucket{%sle=\"+Inf\"} %d\n", name, labels, h.count)
+	if labels != "" {
+		labels = "{" + labels[:len(labels)-1] + "}"
+	}
+	w.printf("%s_sum%s %s\n", name, labels, strconv.FormatFloat(h.sum, 'g', -1, 64))
+	w.printf("%s_count%s %d\n", name, labels, h.count)
+}
+
+func header(w *countingWriter, name, metricType, help string) {
+	w.printf("# HELP %s %s\n# TYPE %s %s\n", name, help, name, metricType)
+}
+
+func messageTypeName(opcode MessageType) string {
+	switch opcode {
+	case MessageTypeText:
+		return "text"
+	case MessageTypeBinary:
+		return "binary"
+	}
+	return strconv.Itoa(int(opcode))
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// splitKey splits the keys of two labels.
+func splitKey(key string) (string, string) {
+	for i := 0; i < len(key); i++ {
+		if key[i] == 0 {
+			return key[:i], key[i+1:]
+		}
+	}
+	return key, ""
+}
+
+// countingWriter keeps the first error, so the rendering does not need to
+// check every write.
+type countingWriter struct {
+	w   io.Writer
+	n   int64
+	err error
+}
+
+func (cw *countingWriter) printf(format string, args ...interface{}) {
+	if cw.err != nil {
+		return
+	}
+	n, err := fmt.Fprintf(cw.w, format, args...)
+	cw.n += int64(n)
+	cw.err = err
+}
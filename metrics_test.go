@@ -0,0 +1,127 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var _ = Describe("Metrics", func() {
+	render := func(metrics *PrometheusMetrics) string {
+		var buff bytes.Buffer
+		_, err := metrics.WriteTo(&buff)
+		Expect(err).To(BeNil())
+		return buff.String()
+	}
+
+	It("should render the histograms", func() {
+		metrics := NewPrometheusMetrics("test")
+		metrics.MessageReceived(MessageTypeText, 100)
+		metrics.MessageReceived(MessageTypeBinary, 2000)
+		metrics.HandlerDone(2*time.Millisecond, nil)
+		metrics.HandlerDone(time.Millisecond, errors.New("failed"))
+		output := render(metrics)
+		Expect(output).To(ContainSubstring("# TYPE test_message_size_bytes histogram\n"))
+		Expect(output).To(ContainSubstring("test_message_size_bytes_bucket{direction=\"in\",le=\"64\"} 0\n"))
+		Expect(output).To(ContainSubstring("test_message_size_bytes_bucket{direction=\"in\",le=\"256\"} 1\n"))
+		Expect(output).To(ContainSubstring("test_message_size_bytes_bucket{direction=\"in\",le=\"4096\"} 2\n"))
+		Expect(output).To(ContainSubstring("test_message_size_bytes_bucket{direction=\"in\",le=\"+Inf\"} 2\n"))
+		Expect(output).To(ContainSubstring("test_message_size_bytes_sum{direction=\"in\"} 2100\n"))
+		Expect(output).To(ContainSubstring("test_message_size_bytes_count{direction=\"in\"} 2\n"))
+		Expect(output).To(ContainSubstring("test_messages_total{direction=\"in\",type=\"binary\"} 1\n"))
+		Expect(output).To(ContainSubstring("test_messages_total{direction=\"in\",type=\"text\"} 1\n"))
+		Expect(output).To(ContainSubstring("test_handler_duration_seconds_bucket{le=\"0.001\"} 1\n"))
+		Expect(output).To(ContainSubstring("test_handler_duration_seconds_bucket{le=\"0.005\"} 2\n"))
+		Expect(output).To(ContainSubstring("test_handler_duration_seconds_count 2\n"))
+		Expect(output).To(ContainSubstring("test_handler_errors_total 1\n"))
+	})
+
+	It("should render deterministically", func() {
+		metrics := NewPrometheusMetrics("")
+		metrics.Handshake(HandshakeFailureVersion)
+		metrics.Handshake("")
+		metrics.Handshake(HandshakeFailureMethod)
+		metrics.CloseReceived(ConnectionCloseReasonGoingDown)
+		metrics.CloseSent(ConnectionCloseReasonNormal)
+		output := render(metrics)
+		Expect(output).To(Equal(render(metrics)))
+		Expect(output).To(ContainSubstring(
+			"websocket_handshakes_total{result=\"method\"} 1\n" +
+				"websocket_handshakes_total{result=\"upgraded\"} 1\n" +
+				"websocket_handshakes_total{result=\"version\"} 1\n"))
+		Expect(output).To(ContainSubstring(
+			"websocket_close_codes_total{initiator=\"local\",code=\"1000\"} 1\n" +
+				"websocket_close_codes_total{initiator=\"peer\",code=\"1001\"} 1\n"))
+	})
+
+	It("should report the handshakes of an upgrader", func() {
+		metrics := NewPrometheusMetrics("")
+		upgrader := &Upgrader{
+			Metrics: metrics,
+		}
+		Expect(upgrader.Upgrade(buildValidCtx())).To(Succeed())
+		ctx := buildValidCtx()
+		ctx.Request.Header.SetMethod("POST")
+		Expect(upgrader.Upgrade(ctx)).NotTo(Succeed())
+		output := render(metrics)
+		Expect(output).To(ContainSubstring("websocket_handshakes_total{result=\"method\"} 1\n"))
+		Expect(output).To(ContainSubstring("websocket_handshakes_total{result=\"upgraded\"} 1\n"))
+	})
+
+	It("should report the connections of a manager", func() {
+		metrics := NewPrometheusMetrics("")
+		manager := NewListeableManager()
+		manager.Metrics = metrics
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			return conn.WriteMessage(opcode, payload)
+		}
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+		Eventually(func() string {
+			return render(metrics)
+		}).Should(And(
+			ContainSubstring("websocket_connections_open 1\n"),
+			ContainSubstring("websocket_messages_total{direction=\"in\",type=\"text\"} 1\n"),
+			ContainSubstring("websocket_messages_total{direction=\"out\",type=\"text\"} 1\n"),
+			ContainSubstring("websocket_handler_duration_seconds_count 1\n"),
+		))
+
+		reason := make([]byte, 2)
+		binary.BigEndian.PutUint16(reason, uint16(ConnectionCloseReasonGoingDown))
+		writeFrames(client, maskedFrame(true, OPCodeConnectionCloseFrame, reason))
+		frames := readFrames(client, 1)
+		Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+		Eventually(done).Should(Receive())
+		client.Close()
+		output := render(metrics)
+		Expect(output).To(ContainSubstring("websocket_connections_open 0\n"))
+		Expect(output).To(ContainSubstring("websocket_connections_total 1\n"))
+		Expect(output).To(ContainSubstring("websocket_close_codes_total{initiator=\"peer\",code=\"1001\"} 1\n"))
+		Expect(output).To(ContainSubstring("websocket_close_codes_total{initiator=\"local\",code=\"1001\"} 1\n"))
+		Expect(output).To(ContainSubstring("websocket_bytes_total{direction=\"in\"} 19\n"))
+	})
+
+	It("should serve the metrics", func() {
+		metrics := NewPrometheusMetrics("")
+		metrics.ConnectionOpened()
+
+		recorder := httptest.NewRecorder()
+		metrics.ServeHTTP(recorder, httptest.NewRequest("GET", "/metrics", nil))
+		Expect(recorder.Header().Get("Content-Type")).To(HavePrefix("text/plain; version=0.0.4"))
+		Expect(recorder.Body.String()).To(ContainSubstring("websocket_connections_open 1\n"))
+
+		ctx := &fasthttp.RequestCtx{}
+		metrics.FasthttpHandler(ctx)
+		Expect(string(ctx.Response.Header.ContentType())).To(HavePrefix("text/plain; version=0.0.4"))
+		Expect(strings.Split(string(ctx.Response.Body()), "\n")).To(ContainElement("websocket_connections_open 1"))
+	})
+})
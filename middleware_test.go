@@ -0,0 +1,111 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+	"sync"
+	"time"
+)
+
+var _ = Describe("Middleware", func() {
+	var (
+		mutex sync.Mutex
+		calls []string
+	)
+
+	record := func(call string) {
+		mutex.Lock()
+		calls = append(calls, call)
+		mutex.Unlock()
+	}
+
+	recorded := func() []string {
+		mutex.Lock()
+		defer mutex.Unlock()
+		return append([]string{}, calls...)
+	}
+
+	tracing := func(name string) Middleware {
+		return func(next MessageHandler) MessageHandler {
+			return func(conn Connection, opcode MessageType, payload []byte) error {
+				record(name + " before")
+				err := next(conn, opcode, payload)
+				record(name + " after")
+				return err
+			}
+		}
+	}
+
+	tracingConnection := func(name string) ConnectionMiddleware {
+		return func(next ConnectionHandler) ConnectionHandler {
+			return func(conn Connection) error {
+				record(name)
+				return next(conn)
+			}
+		}
+	}
+
+	BeforeEach(func() {
+		calls = nil
+	})
+
+	It("should compose the middlewares in order", func() {
+		manager := NewListeableManager()
+		manager.ReadTimeout = time.Second
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			record("handler " + string(payload))
+			return nil
+		}
+		manager.Use(tracing("a"), tracing("b"))
+		manager.Use(tracing("c"))
+
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Eventually(recorded).Should(Equal([]string{
+			"a before", "b before", "c before", "handler Hello", "c after", "b after", "a after",
+		}))
+		client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should allow middlewares to stop the chain", func() {
+		errUnauthorized := errors.New("unauthorized")
+		manager := NewListeableManager()
+		manager.ReadTimeout = time.Second
+		errs := make(chan error, 1)
+		manager.OnMessageError = func(conn Connection, err error) {
+			errs <- err
+		}
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			record("handler")
+			return nil
+		}
+		manager.Use(func(next MessageHandler) MessageHandler {
+			return func(conn Connection, opcode MessageType, payload []byte) error {
+				return errUnauthorized
+			}
+		})
+
+		client, done := acceptPipe(manager)
+		writeFrames(client, maskedFrame(true, OPCodeTextFrame, []byte("Hello")))
+		Eventually(errs).Should(Receive(Equal(errUnauthorized)))
+		Expect(recorded()).To(BeEmpty())
+		client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+	})
+
+	It("should wrap the connect and close handlers even when they are not set", func() {
+		manager := NewListeableManager()
+		manager.ReadTimeout = time.Second
+		manager.UseOnConnect(tracingConnection("connect 1"), tracingConnection("connect 2"))
+		manager.UseOnClose(tracingConnection("close"))
+
+		client, done := acceptPipe(manager)
+		Eventually(recorded).Should(Equal([]string{"connect 1", "connect 2"}))
+		client.Close()
+		Eventually(done).Should(Receive(BeNil()))
+		Expect(recorded()).To(Equal([]string{"connect 1", "connect 2", "close"}))
+	})
+})
@@ -6,8 +6,8 @@ import (
 	"encoding/binary"
 	"errors"
 	"math"
-	"sync"
 	"io"
+	"sync"
 	"time"
 )
 
@@ -72,6 +72,11 @@ var (
 	ErrMissingMaskKey        = errors.New("Missing mask key")
 	ErrWrongMaskKey          = errors.New("Wrong mask key")
 	ErrWrongClosingCode      = errors.New("Wrong closing code")
+	ErrMessageTooBig         = errors.New("Message too big")
+	ErrCloseTimeout          = errors.New("Close handshake timeout")
+	ErrPartialMessageTimeout = errors.New("Timeout in the middle of a message")
+	ErrCompressionLevel      = errors.New("Invalid compression level")
+	ErrBufferTooSmall        = errors.New("Buffer too small")
 )
 
 // IsUnexpectedEndOfPacket checks if the given error is of type unexpected end of packet
@@ -88,9 +93,9 @@ func DecodePacket(buff []byte) (fin bool, rsv1 bool, rsv2 bool, rsv3 bool, opcod
 
 	// 1st byte
 	fin = ((buff[positionFinRsvsOpCode] & maskFin) == maskFin)
-	rsv1 = ((buff[positionFinRsvsOpCode] & maskRsv1) == maskFin)
-	rsv2 = ((buff[positionFinRsvsOpCode] & maskRsv2) == maskFin)
-	rsv3 = ((buff[positionFinRsvsOpCode] & maskRsv3) == maskFin)
+	rsv1 = ((buff[positionFinRsvsOpCode] & maskRsv1) == maskRsv1)
+	rsv2 = ((buff[positionFinRsvsOpCode] & maskRsv2) == maskRsv2)
+	rsv3 = ((buff[positionFinRsvsOpCode] & maskRsv3) == maskRsv3)
 	opcode = buff[positionFinRsvsOpCode] & maskOpCode
 
 	// 2nd byte
@@ -111,6 +116,10 @@ func DecodePacket(buff []byte) (fin bool, rsv1 bool, rsv2 bool, rsv3 bool, opcod
 			return false, false, false, false, 0, 0, nil, nil, ErrUnexpectedEndOfPacket
 		}
 		payloadLen = binary.BigEndian.Uint64(buff[positionMaskPayloadLenExtended:positionMaskPayloadLenExtended64bitsEnding])
+		if payloadLen > math.MaxInt64 {
+			// The most significant bit must be 0 (RFC 6455, section 5.2).
+			return false, false, false, false, 0, 0, nil, nil, ErrProtocolError
+		}
 	} else if (payloadLen + uint64(positionMaskPayloadLen)) > buffLen {
 		return false, false, false, false, 0, 0, nil, nil, ErrUnexpectedEndOfPacket
 	}
@@ -123,39 +132,77 @@ func DecodePacket(buff []byte) (fin bool, rsv1 bool, rsv2 bool, rsv3 bool, opcod
 		}
 		maskingKey = buff[(startAt - 4):startAt]
 	}
-	if buffLen < uint64(startAt)+payloadLen {
+	// Compared this way, since startAt+payloadLen may overflow.
+	if buffLen-uint64(startAt) < payloadLen {
 		return false, false, false, false, 0, 0, nil, nil, ErrUnexpectedEndOfPacket
 	}
 	payload = buff[startAt:(uint64(startAt) + payloadLen)]
 	return
 }
 
-func readBytes(reader io.Reader, buff []byte, deadline time.Time) (int, error) {
-	var n int
-	var i int
-	var err error
-	buffLen := len(buff)
-	for i = 0; i < buffLen; {
-		n, err = reader.Read(buff[i:buffLen])
-		if err == io.EOF {
-			time.Sleep(time.Millisecond)
-			if time.Now().After(deadline) {
-				return i, ErrTimeout
-			}
-		} else if err != nil {
-			return i, ErrUnexpectedEndOfPacket
-		}
-		i += n
+// readBytes fills the buff from the reader. Since it is always called in the
+// middle of a frame, running out of data is reported as
+// ErrUnexpectedEndOfPacket. Any other error, like timeouts, are returned as
+// they are.
+func readBytes(reader io.Reader, buff []byte) (int, error) {
+	n, err := io.ReadFull(reader, buff)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, ErrUnexpectedEndOfPacket
 	}
-	return i, nil
+	return n, err
 }
 
+// minDecodeBufferSize is the smallest buff DecodeFrameFromReader works with:
+// it must fit the 64 bits extended payload length.
+const minDecodeBufferSize = 8
+
+// DecodePacketFromReader reads and decodes a frame from the reader, failing
+// with ErrTimeout when the deadline is exceeded. The deadline is applied when
+// the reader supports it (eg. a net.Conn), and cleared once the frame is read.
+//
+// The payloads are limited to DefaultMaxMessageSize.
+//
+// Deprecated: Use DecodeFrameFromReader, setting the deadline on the reader.
 func DecodePacketFromReader(reader io.Reader, buff []byte, deadline time.Time) (fin bool, rsv1 bool, rsv2 bool, rsv3 bool, opcode byte, payloadLen uint64, maskingKey []byte, payload []byte, err error) {
-	var n int
+	if r, ok := reader.(interface{ SetReadDeadline(time.Time) error }); ok {
+		if err = r.SetReadDeadline(deadline); err != nil {
+			return false, false, false, false, 0, 0, nil, nil, err
+		}
+		defer r.SetReadDeadline(time.Time{})
+	}
+	fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err = DecodeFrameFromReader(reader, buff, DefaultMaxMessageSize)
+	if isTimeout(err) {
+		err = ErrTimeout
+	}
+	return
+}
+
+// DecodeFrameFromReader reads and decodes a frame from the reader.
+//
+// The reader is expected to block until data is available (eg. a net.Conn).
+// When the reader has no more data right at the beginning of the frame, the
+// io.EOF is returned, so a closed peer can be detected right away. If the
+// data ends in the middle of the frame, ErrUnexpectedEndOfPacket is returned.
+//
+// The buff must have at least 8 bytes, otherwise ErrBufferTooSmall is
+// returned. The maskingKey and, when it fits, the payload reference the buff,
+// so they are valid until the buff is reused.
+//
+// Payloads longer than maxPayloadLen fail with ErrMessageTooBig, before
+// being read. Zero means no limit.
+//
+// For non-blocking sources, check the websocket.FrameParser.
+func DecodeFrameFromReader(reader io.Reader, buff []byte, maxPayloadLen uint64) (fin bool, rsv1 bool, rsv2 bool, rsv3 bool, opcode byte, payloadLen uint64, maskingKey []byte, payload []byte, err error) {
+	if len(buff) < minDecodeBufferSize {
+		return false, false, false, false, 0, 0, nil, nil, ErrBufferTooSmall
+	}
 	buffLen := uint64(len(buff))
-	n, err = readBytes(reader, buff[:2], deadline)
-	if (err != nil && err != io.EOF) || (n < 2) {
-		return false, false, false, false, 0, 0, nil, nil, ErrUnexpectedEndOfPacket
+	_, err = io.ReadFull(reader, buff[:2])
+	if err == io.ErrUnexpectedEOF {
+		err = ErrUnexpectedEndOfPacket
+	}
+	if err != nil {
+		return false, false, false, false, 0, 0, nil, nil, err
 	}
 
 	// 1st byte
@@ -172,54 +219,108 @@ func DecodePacketFromReader(reader io.Reader, buff []byte, deadline time.Time) (
 
 	// Check if the payload length is extended
 	if payloadLen == payloadLen16bitsUint64 {
-		n, err = readBytes(reader, buff[:2], deadline)
-		if (n != 2) || (err != nil) {
-			err = ErrUnexpectedEndOfPacket
-			return
+		if _, err = readBytes(reader, buff[:2]); err != nil {
+			return false, false, false, false, 0, 0, nil, nil, err
 		}
 		payloadLen = uint64(binary.BigEndian.Uint16(buff[:2]))
 	} else if payloadLen == payloadLen64bitsUint64 {
-		n, err = readBytes(reader, buff[:8], deadline)
-		if (n != 8) || (err != nil) {
-			err = ErrUnexpectedEndOfPacket
-			return
+		if _, err = readBytes(reader, buff[:8]); err != nil {
+			return false, false, false, false, 0, 0, nil, nil, err
 		}
 		payloadLen = binary.BigEndian.Uint64(buff[:8])
+		if payloadLen > math.MaxInt64 {
+			// The most significant bit must be 0 (RFC 6455, section 5.2).
+			return false, false, false, false, 0, 0, nil, nil, ErrProtocolError
+		}
+	}
+
+	if maxPayloadLen > 0 && payloadLen > maxPayloadLen {
+		return false, false, false, false, 0, 0, nil, nil, ErrMessageTooBig
 	}
 
 	// Check the masking key
 	if masked {
-		n, err = readBytes(reader, buff[:4], deadline)
-		if err != nil {
+		// The key is kept at the end of the buff, out of the way of the
+		// payload, so it is not allocated.
+		maskingKey = buff[buffLen-4:]
+		if _, err = readBytes(reader, maskingKey); err != nil {
 			return false, false, false, false, 0, 0, nil, nil, err
 		}
-		maskingKey = make([]byte, 4)
-		copy(maskingKey, buff[:4])
+		buffLen -= 4
 	}
 	if buffLen < payloadLen {
-		payload = make([]byte, payloadLen)
-		n, err = readBytes(reader, payload, deadline)
+		payload, err = readLongPayload(reader, payloadLen)
 	} else {
-		readBytes(reader, buff[:payloadLen], deadline)
 		payload = buff[:payloadLen]
+		_, err = readBytes(reader, payload)
 	}
-	if err != nil && err != io.EOF {
+	if err != nil {
 		return false, false, false, false, 0, 0, nil, nil, err
 	}
-	err = nil
 	return
 }
 
+// payloadPreallocateSize is the most allocated for a payload before its data
+// arrives.
+const payloadPreallocateSize = 1024 * 1024
+
+// readLongPayload reads a payload that does not fit the buffer. The memory is
+// allocated as the data arrives, so a forged length cannot exhaust it.
+func readLongPayload(reader io.Reader, payloadLen uint64) ([]byte, error) {
+	var payload bytes.Buffer
+	if payloadLen < payloadPreallocateSize {
+		payload.Grow(int(payloadLen))
+	} else {
+		payload.Grow(payloadPreallocateSize)
+	}
+	n, err := io.CopyN(&payload, reader, int64(payloadLen))
+	if err == io.EOF || (err == nil && uint64(n) < payloadLen) {
+		return nil, ErrUnexpectedEndOfPacket
+	}
+	if err != nil {
+		return nil, err
+	}
+	return payload.Bytes(), nil
+}
+
 // Unmask unmasks a masked payload.
 //
 // There is no Mask method. Since the masking procedure is a bitwise not,
 // applying Unmask will toggle the un/masking.
 func Unmask(buff, mask []byte) {
-	l := uint64(len(buff))
-	masklen := uint64(len(mask))
-	// Unmask the payload
-	for i := uint64(0); i < l; i++ {
-		buff[i] = buff[i] ^ mask[i%masklen]
+	if len(mask) != 4 {
+		masklen := uint64(len(mask))
+		for i := uint64(0); i < uint64(len(buff)); i++ {
+			buff[i] ^= mask[i%masklen]
+		}
+		return
+	}
+	UnmaskAt(buff, [4]byte{mask[0], mask[1], mask[2], mask[3]}, 0)
+}
+
+// UnmaskAt unmasks a segment of a masked payload, starting at the given offset
+// of the payload. It is meant for payloads unmasked as they arrive, like the
+// segments of the websocket.FrameParser.
+//
+// The payload is unmasked 8 bytes at a time, with the key rotated to the
+// offset.
+func UnmaskAt(buff []byte, key [4]byte, offset uint64) {
+	if len(buff) < 8 {
+		for i := range buff {
+			buff[i] ^= key[(offset+uint64(i))&3]
+		}
+		return
+	}
+	rotated := [4]byte{key[offset&3], key[(offset+1)&3], key[(offset+2)&3], key[(offset+3)&3]}
+	key32 := uint64(binary.LittleEndian.Uint32(rotated[:]))
+	key64 := key32<<32 | key32
+	i := 0
+	for ; i+8 <= len(buff); i += 8 {
+		binary.LittleEndian.PutUint64(buff[i:], binary.LittleEndian.Uint64(buff[i:])^key64)
+	}
+	// 8 is a multiple of the key size, so the key is still aligned here.
+	for ; i < len(buff); i++ {
+		buff[i] ^= rotated[i&3]
 	}
 }
 
@@ -280,6 +381,129 @@ func EncodePacket(fin bool, rsv1 bool, rsv2 bool, rsv3 bool, opcode byte, payloa
 	return dst, nil
 }
 
+// maxFrameHeaderSize is the size of the longest header of the frames sent by
+// the server, which are never masked: 2 bytes plus the 64-bit length.
+const maxFrameHeaderSize = 10
+
+// putFrameHeader encodes the header of an unmasked frame into the dst, which
+// must fit maxFrameHeaderSize bytes, returning its size.
+func putFrameHeader(dst []byte, fin bool, rsv1 bool, opcode byte, payloadLen uint64) int {
+	dst[positionFinRsvsOpCode] = opcode & maskOpCode
+	if fin {
+		dst[positionFinRsvsOpCode] |= maskFin
+	}
+	if rsv1 {
+		dst[positionFinRsvsOpCode] |= maskRsv1
+	}
+	if payloadLen < uint64(payloadLen16bits) {
+		dst[positionMaskPayloadLen] = byte(payloadLen)
+		return int(positionMaskPayloadLenExtended)
+	}
+	if payloadLen <= math.MaxUint16 {
+		dst[positionMaskPayloadLen] = payloadLen16bits
+		binary.BigEndian.PutUint16(dst[positionMaskPayloadLenExtended:], uint16(payloadLen))
+		return int(positionMaskPayloadLenExtended16bitsEnding)
+	}
+	dst[positionMaskPayloadLen] = payloadLen64bits
+	binary.BigEndian.PutUint64(dst[positionMaskPayloadLenExtended:], payloadLen)
+	return int(positionMaskPayloadLenExtended64bitsEnding)
+}
+
+// frameHeaderSize returns the size of a header given its 2nd byte.
+func frameHeaderSize(b byte) int {
+	size := int(positionMaskPayloadLenExtended)
+	switch b & maskPayloadLen {
+	case payloadLen16bits:
+		size += 2
+	case payloadLen64bits:
+		size += 8
+	}
+	if (b & maskMask) == maskMask {
+		size += 4
+	}
+	return size
+}
+
+// decodeFrameHeader decodes a complete header, as sized by frameHeaderSize.
+func decodeFrameHeader(b []byte, h *FrameHeader) {
+	h.Fin = (b[positionFinRsvsOpCode] & maskFin) == maskFin
+	h.Rsv1 = (b[positionFinRsvsOpCode] & maskRsv1) == maskRsv1
+	h.Rsv2 = (b[positionFinRsvsOpCode] & maskRsv2) == maskRsv2
+	h.Rsv3 = (b[positionFinRsvsOpCode] & maskRsv3) == maskRsv3
+	h.OPCode = b[positionFinRsvsOpCode] & maskOpCode
+	h.Masked = (b[positionMaskPayloadLen] & maskMask) == maskMask
+
+	startAt := int(positionMaskPayloadLenExtended)
+	h.PayloadLen = uint64(b[positionMaskPayloadLen] & maskPayloadLen)
+	if h.PayloadLen == payloadLen16bitsUint64 {
+		h.PayloadLen = uint64(binary.BigEndian.Uint16(b[startAt:]))
+		startAt += 2
+	} else if h.PayloadLen == payloadLen64bitsUint64 {
+		h.PayloadLen = binary.BigEndian.Uint64(b[startAt:])
+		startAt += 8
+	}
+	if h.Masked {
+		copy(h.MaskingKey[:], b[startAt:startAt+4])
+	} else {
+		h.MaskingKey = [4]byte{}
+	}
+}
+
+// DecodeHeader decodes the header of the frame at the beginning of the buff,
+// returning its size. The payload follows the header, and does not need to be
+// in the buff.
+//
+// Unlike DecodePacket, nothing is allocated nor references the buff, so the
+// header can be reused between frames.
+func DecodeHeader(buff []byte, header *FrameHeader) (int, error) {
+	if len(buff) < int(positionMaskPayloadLenExtended) {
+		return 0, ErrUnexpectedEndOfPacket
+	}
+	size := frameHeaderSize(buff[positionMaskPayloadLen])
+	if len(buff) < size {
+		return 0, ErrUnexpectedEndOfPacket
+	}
+	decodeFrameHeader(buff[:size], header)
+	if header.PayloadLen > math.MaxInt64 {
+		// The most significant bit must be 0 (RFC 6455, section 5.2).
+		return 0, ErrProtocolError
+	}
+	return size, nil
+}
+
+// AppendFrame appends the frame to the dst, returning the extended slice. If a
+// maskingKey is given, the payload is masked as it is appended, leaving the
+// given one untouched.
+//
+// Nothing is allocated when the dst has room for the frame, so the same
+// buffer can be reused for many frames.
+func AppendFrame(dst []byte, fin bool, rsv1 bool, rsv2 bool, rsv3 bool, opcode byte, maskingKey []byte, payload []byte) ([]byte, error) {
+	if (maskingKey != nil) && (len(maskingKey) != 4) {
+		return dst, ErrWrongMaskKey
+	}
+
+	var header [maxFrameHeaderSize + 4]byte
+	n := putFrameHeader(header[:], fin, rsv1, opcode, uint64(len(payload)))
+	if rsv2 {
+		header[positionFinRsvsOpCode] |= maskRsv2
+	}
+	if rsv3 {
+		header[positionFinRsvsOpCode] |= maskRsv3
+	}
+	if maskingKey != nil {
+		header[positionMaskPayloadLen] |= maskMask
+		n += copy(header[n:], maskingKey)
+	}
+	dst = append(dst, header[:n]...)
+
+	startAt := len(dst)
+	dst = append(dst, payload...)
+	if maskingKey != nil {
+		UnmaskAt(dst[startAt:], [4]byte{maskingKey[0], maskingKey[1], maskingKey[2], maskingKey[3]}, 0)
+	}
+	return dst, nil
+}
+
 const deflateBufferDefaultSize = 1024
 
 var deflateBufferPool = sync.Pool{
@@ -288,43 +512,195 @@ var deflateBufferPool = sync.Pool{
 	},
 }
 
+// deflateTail is appended to the payload for inflating it: the tail removed
+// by the sender (RFC 7692, section 7.2.2) followed by an empty final block, so
+// the reader ends at io.EOF.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
 // Deflate deflates a flated package
 func Deflate(dst, src []byte) ([]byte, error) {
+	return DeflateLimit(dst, src, 0)
+}
+
+// DeflateLimit deflates a flated package, failing with ErrMessageTooBig as
+// soon as the deflated data exceeds the limit. The data is never inflated
+// beyond the limit, hence small packages cannot exhaust the memory. A limit
+// of zero, or less, means no limit.
+func DeflateLimit(dst, src []byte, limit int) ([]byte, error) {
 	buff := deflateBufferPool.Get().([]byte)
 	defer deflateBufferPool.Put(buff)
 
-	reader := flate.NewReader(bytes.NewReader(append(src, []byte{0x00, 0x00, 0xff, 0xff}...)))
-	n, err := reader.Read(buff)
-
-	for (err == nil) && (n > 0) {
+	inflater := getInflater(src)
+	defer putInflater(inflater)
+	deflated := 0
+	for {
+		n, err := inflater.reader.Read(buff)
+		deflated += n
+		if limit > 0 && deflated > limit {
+			return nil, ErrMessageTooBig
+		}
 		dst = append(dst, buff[:n]...)
-		if n < len(buff) {
-			break
+		if err == io.EOF {
+			return dst, nil
+		}
+		if err != nil {
+			return nil, err
 		}
-		n, err = reader.Read(buff)
 	}
-	if err == nil {
-		return dst, err
+}
+
+// deflateLimit returns the limit for deflating size bytes given the maximum
+// size and the maximum compression ratio, zero meaning no limit.
+func deflateLimit(size int, maxSize int, maxRatio float64) int {
+	limit := maxSize
+	if maxRatio > 0 {
+		byRatio := int(maxRatio * float64(size))
+		if byRatio < deflateBufferDefaultSize {
+			// Tiny payloads are always allowed to inflate a bit.
+			byRatio = deflateBufferDefaultSize
+		}
+		if limit <= 0 || byRatio < limit {
+			limit = byRatio
+		}
 	}
-	return nil, err
+	return limit
 }
 
-// Flate compress the given src into the dst buffer
+// DefaultCompressionLevel is the default level of the compressed messages.
+// The fastest level is used, since every message is compressed on its own
+// (no context takeover) and the slower levels barely compress them better.
+const DefaultCompressionLevel = flate.BestSpeed
+
+// Flate compress the given src into the dst buffer, at the
+// DefaultCompressionLevel.
 // It returns the amount of bytes written or an error.
 func Flate(dst, src []byte) ([]byte, int, error) {
-	b := bytes.NewBuffer(dst)
-	writer, err := flate.NewWriter(b, flate.BestCompression)
+	return FlateLevel(dst, src, DefaultCompressionLevel)
+}
+
+// FlateLevel compress the given src into the dst buffer, at the given level,
+// from flate.HuffmanOnly to flate.BestCompression. The compressors are pooled
+// per level, so they are not allocated for every call.
+// It returns the amount of bytes written or an error.
+func FlateLevel(dst, src []byte, level int) ([]byte, int, error) {
+	flater, err := getFlater(dst, level)
 	if err != nil {
 		return nil, 0, err
 	}
-	_, err = writer.Write(src)
-	if err != nil {
+	defer putFlater(flater, level)
+	if _, err = flater.writer.Write(src); err != nil {
 		return nil, 0, err
 	}
-	err = writer.Flush()
-	if err != nil {
+	if err = flater.writer.Flush(); err != nil {
 		return nil, 0, err
 	}
-	l := b.Len() - 4
-	return b.Bytes()[:l], l, nil
+	// The tail of the flushed block is removed (RFC 7692, section 7.2.1).
+	l := len(flater.dst.b) - 4
+	return flater.dst.b[:l], l, nil
+}
+
+// appendWriter appends the data written to a slice.
+type appendWriter struct {
+	b []byte
+}
+
+func (w *appendWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+// flater is a pooled compressor, writing to the dst.
+type flater struct {
+	writer *flate.Writer
+	dst    appendWriter
+}
+
+// flaterPools pools the compressors of each level, from flate.HuffmanOnly.
+var flaterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+func getFlater(dst []byte, level int) (*flater, error) {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return nil, ErrCompressionLevel
+	}
+	f, ok := flaterPools[level-flate.HuffmanOnly].Get().(*flater)
+	if !ok {
+		f = &flater{}
+		writer, err := flate.NewWriter(&f.dst, level)
+		if err != nil {
+			return nil, err
+		}
+		f.writer = writer
+	} else {
+		f.writer.Reset(&f.dst)
+	}
+	f.dst.b = dst
+	return f, nil
+}
+
+func putFlater(f *flater, level int) {
+	f.dst.b = nil
+	flaterPools[level-flate.HuffmanOnly].Put(f)
+}
+
+// inflateSource reads the src followed by the deflateTail. It is a
+// io.ByteReader, so the decompressor reads it without buffering.
+type inflateSource struct {
+	src  []byte
+	tail []byte
+}
+
+func (s *inflateSource) reset(src []byte) {
+	s.src = src
+	s.tail = deflateTail
+}
+
+func (s *inflateSource) Read(p []byte) (int, error) {
+	if len(s.src) == 0 && len(s.tail) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(p, s.src)
+	s.src = s.src[n:]
+	m := copy(p[n:], s.tail)
+	s.tail = s.tail[m:]
+	return n + m, nil
+}
+
+func (s *inflateSource) ReadByte() (byte, error) {
+	if len(s.src) > 0 {
+		b := s.src[0]
+		s.src = s.src[1:]
+		return b, nil
+	}
+	if len(s.tail) > 0 {
+		b := s.tail[0]
+		s.tail = s.tail[1:]
+		return b, nil
+	}
+	return 0, io.EOF
+}
+
+// inflater is a pooled decompressor, reading from the source.
+type inflater struct {
+	reader io.ReadCloser
+	source inflateSource
+}
+
+var inflaterPool sync.Pool
+
+func getInflater(src []byte) *inflater {
+	f, ok := inflaterPool.Get().(*inflater)
+	if !ok {
+		f = &inflater{}
+		f.source.reset(src)
+		f.reader = flate.NewReader(&f.source)
+		return f
+	}
+	f.source.reset(src)
+	f.reader.(flate.Resetter).Reset(&f.source, nil)
+	return f
+}
+
+func putInflater(f *inflater) {
+	f.source.src = nil
+	inflaterPool.Put(f)
 }
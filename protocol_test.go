@@ -4,16 +4,16 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
 	"log"
+	"net"
 	"testing"
-	"bytes"
+	"time"
 )
 
-func TestProtocol(t *testing.T) {
-	RegisterFailHandler(Fail)
-	RunSpecs(t, "Protocol Test Suite")
-}
-
 var (
 	singleFrameUnmaskedText        = []byte{0x81, 0x05, 0x48, 0x65, 0x6c, 0x6c, 0x6f}
 	singleFrameUnmaskedTextPayload = []byte{0x48, 0x65, 0x6c, 0x6c, 0x6f}
@@ -64,7 +64,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameUnmaskedText)
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
 			Expect(rsv1).To(BeFalse())
@@ -94,7 +94,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameUnmaskedZeroLengthText)
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
 			Expect(rsv1).To(BeFalse())
@@ -124,7 +124,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameMaskedText)
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
 			Expect(rsv1).To(BeFalse())
@@ -155,7 +155,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(fragmentedUnmaskedText1)
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeFalse())
 			Expect(rsv1).To(BeFalse())
@@ -186,7 +186,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(fragmentedUnmaskedText2)
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
 			Expect(rsv1).To(BeFalse())
@@ -217,7 +217,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameUnmaskedPingRequest)
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
 			Expect(rsv1).To(BeFalse())
@@ -248,7 +248,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameMaskedPongResponse)
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
 			Expect(rsv1).To(BeFalse())
@@ -278,7 +278,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(append(singleFrameBinaryUnmasked256BytesLongHeader, make([]byte, 256)...))
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
 			Expect(rsv1).To(BeFalse())
@@ -311,7 +311,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(append(singleFrameBinaryUnmasked64KBytesLongHeader, packetPayload...))
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
 			Expect(rsv1).To(BeFalse())
@@ -331,7 +331,7 @@ var _ = Describe("Protocol", func() {
 			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacket(singleFrameMaskedFlatedText)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
-			Expect(rsv1).To(BeFalse())
+			Expect(rsv1).To(BeTrue())
 			Expect(rsv2).To(BeFalse())
 			Expect(rsv3).To(BeFalse())
 			Expect(opcode).To(Equal(byte(OPCodeTextFrame)))
@@ -345,10 +345,10 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameMaskedFlatedText)
 			buff := make([]byte, 1024*8)
 
-			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodePacketFromReader(reader, buff)
+			fin, rsv1, rsv2, rsv3, opcode, payloadLen, maskingKey, payload, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).To(BeNil())
 			Expect(fin).To(BeTrue())
-			Expect(rsv1).To(BeFalse())
+			Expect(rsv1).To(BeTrue())
 			Expect(rsv2).To(BeFalse())
 			Expect(rsv3).To(BeFalse())
 			Expect(opcode).To(Equal(byte(OPCodeTextFrame)))
@@ -368,11 +368,19 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameUnmaskedText[:1])
 			buff := make([]byte, 1024*8)
 
-			_, _, _, _, _, _, _, _, err := DecodePacketFromReader(reader, buff)
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).NotTo(BeNil())
 			Expect(IsUnexpectedEndOfPacket(err)).To(BeTrue())
 		})
 
+		It("should report the end of the reader right away when no frame started", func() {
+			reader := bytes.NewReader([]byte{})
+			buff := make([]byte, 1024*8)
+
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, buff, 0)
+			Expect(err).To(Equal(io.EOF))
+		})
+
 		It("should fail parsing a broken single-frame unmasked text message with no 16-bits length", func() {
 			_, _, _, _, _, _, _, _, err := DecodePacket(singleFrameBinaryUnmasked256BytesLongHeader[:4])
 			Expect(err).NotTo(BeNil())
@@ -387,14 +395,14 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameBinaryUnmasked256BytesLongHeader[:4])
 			buff := make([]byte, 1024*8)
 
-			_, _, _, _, _, _, _, _, err := DecodePacketFromReader(reader, buff)
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).NotTo(BeNil())
 			Expect(IsUnexpectedEndOfPacket(err)).To(BeTrue())
 
 			reader = bytes.NewReader(singleFrameBinaryUnmasked256BytesLongHeader[:3])
 			buff = make([]byte, 1024*8)
 
-			_, _, _, _, _, _, _, _, err = DecodePacketFromReader(reader, buff)
+			_, _, _, _, _, _, _, _, err = DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).NotTo(BeNil())
 			Expect(IsUnexpectedEndOfPacket(err)).To(BeTrue())
 		})
@@ -409,11 +417,95 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameBinaryUnmasked64KBytesLongHeader[:9])
 			buff := make([]byte, 1024*8)
 
-			_, _, _, _, _, _, _, _, err := DecodePacketFromReader(reader, buff)
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, buff, 0)
+			Expect(err).NotTo(BeNil())
+			Expect(IsUnexpectedEndOfPacket(err)).To(BeTrue())
+		})
+
+		It("should fail parsing a 64-bits length overflowing the packet", func() {
+			packet := []byte{0x82, 0x7F, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xfa, 0x00}
+			_, _, _, _, _, _, _, _, err := DecodePacket(packet)
+			Expect(err).NotTo(BeNil())
+			Expect(IsUnexpectedEndOfPacket(err)).To(BeTrue())
+		})
+
+		It("should fail parsing a 64-bits length overflowing the packet with reader", func() {
+			reader := bytes.NewReader([]byte{0x82, 0x7F, 0x7f, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00})
+			buff := make([]byte, 1024*8)
+
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).NotTo(BeNil())
 			Expect(IsUnexpectedEndOfPacket(err)).To(BeTrue())
 		})
 
+		It("should fail parsing a 64-bits length with the most significant bit set", func() {
+			packet := []byte{0x82, 0x7F, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0x00}
+			_, _, _, _, _, _, _, _, err := DecodePacket(packet)
+			Expect(err).To(Equal(ErrProtocolError))
+
+			_, _, _, _, _, _, _, _, err = DecodeFrameFromReader(bytes.NewReader(packet), make([]byte, 1024*8), 0)
+			Expect(err).To(Equal(ErrProtocolError))
+		})
+
+		It("should not allocate the masking key with reader", func() {
+			reader := bytes.NewReader(singleFrameMaskedText)
+			buff := make([]byte, 1024)
+			Expect(testing.AllocsPerRun(100, func() {
+				reader.Reset(singleFrameMaskedText)
+				DecodeFrameFromReader(reader, buff, 0)
+			})).To(BeZero())
+		})
+
+		It("should keep the masking key apart from the payload with reader", func() {
+			_, _, _, _, _, _, maskingKey, payload, err := DecodeFrameFromReader(bytes.NewReader(singleFrameMaskedText), make([]byte, 9), 0)
+			Expect(err).To(BeNil())
+			Expect(maskingKey).To(Equal(singleFrameMaskedTextMask))
+			Expect(payload).To(Equal(singleFrameMaskedTextPayload))
+		})
+
+		It("should fail decoding with a buffer too small with reader", func() {
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(bytes.NewReader(singleFrameMaskedText), make([]byte, 7), 0)
+			Expect(err).To(Equal(ErrBufferTooSmall))
+		})
+
+		It("should fail payloads over the maximum before reading them with reader", func() {
+			reader := bytes.NewReader(singleFrameBinaryUnmasked64KBytesLongHeader)
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, make([]byte, 1024), 1024)
+			Expect(err).To(Equal(ErrMessageTooBig))
+			Expect(reader.Len()).To(BeZero())
+
+			_, _, _, _, _, _, _, payload, err := DecodeFrameFromReader(bytes.NewReader(singleFrameMaskedText), make([]byte, 1024), 5)
+			Expect(err).To(BeNil())
+			Expect(payload).To(Equal(singleFrameMaskedTextPayload))
+		})
+
+		It("should decode with a deadline", func() {
+			_, _, _, _, _, _, maskingKey, payload, err := DecodePacketFromReader(bytes.NewReader(singleFrameMaskedText), make([]byte, 1024), time.Now().Add(time.Second))
+			Expect(err).To(BeNil())
+			Expect(maskingKey).To(Equal(singleFrameMaskedTextMask))
+			Expect(payload).To(Equal(singleFrameMaskedTextPayload))
+		})
+
+		It("should fail with ErrTimeout once the deadline is exceeded", func() {
+			server, client := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			_, _, _, _, _, _, _, _, err := DecodePacketFromReader(server, make([]byte, 1024), time.Now().Add(time.Millisecond*10))
+			Expect(err).To(Equal(ErrTimeout))
+		})
+
+		It("should clear the deadline once the frame is read", func() {
+			server, client := net.Pipe()
+			defer client.Close()
+			defer server.Close()
+			_, _, _, _, _, _, _, _, err := DecodePacketFromReader(server, make([]byte, 1024), time.Now().Add(time.Millisecond*10))
+			Expect(err).To(Equal(ErrTimeout))
+			writeFrames(client, singleFrameMaskedText)
+			_, _, _, _, _, _, _, payload, err := DecodeFrameFromReader(server, make([]byte, 1024), 0)
+			Expect(err).To(BeNil())
+			Expect(payload).To(Equal(singleFrameMaskedTextPayload))
+		})
+
 		It("should fail parsing single-frame masked text message broken at the mask", func() {
 			_, _, _, _, _, _, _, _, err := DecodePacket(singleFrameMaskedFlatedText[:6])
 			Expect(err).NotTo(BeNil())
@@ -424,7 +516,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameMaskedFlatedText[:6])
 			buff := make([]byte, 1024*8)
 
-			_, _, _, _, _, _, _, _, err := DecodePacketFromReader(reader, buff)
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).NotTo(BeNil())
 			Expect(IsUnexpectedEndOfPacket(err)).To(BeTrue())
 		})
@@ -439,7 +531,7 @@ var _ = Describe("Protocol", func() {
 			reader := bytes.NewReader(singleFrameMaskedFlatedText[:11])
 			buff := make([]byte, 1024*8)
 
-			_, _, _, _, _, _, _, _, err := DecodePacketFromReader(reader, buff)
+			_, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, buff, 0)
 			Expect(err).NotTo(BeNil())
 			Expect(IsUnexpectedEndOfPacket(err)).To(BeTrue())
 		})
@@ -504,7 +596,7 @@ var _ = Describe("Protocol", func() {
 
 		It("should parse a single frame masked and flated", func() {
 			payload := []byte("test")
-			payloadFlatted, n, err := Flate(make([]byte, 0, 1024), payload)
+			payloadFlatted, n, err := FlateLevel(make([]byte, 0, 1024), payload, flate.BestCompression)
 			Expect(err).To(BeNil())
 			Expect(n).To(Equal(6))
 			Expect(payloadFlatted).To(HaveLen(6))
@@ -530,6 +622,144 @@ var _ = Describe("Protocol", func() {
 			Unmask(buff, singleFrameMaskedPongResponseMask)
 			Expect(string(buff)).To(Equal("Hello"))
 		})
+
+		It("should unmask payloads of any size from any offset", func() {
+			key := [4]byte{0x37, 0xfa, 0x21, 0x3d}
+			payload := bytes.Repeat([]byte("websocket"), 10)
+			for size := 0; size <= len(payload); size++ {
+				for offset := uint64(0); offset < 8; offset++ {
+					buff := append([]byte(nil), payload[:size]...)
+					UnmaskAt(buff, key, offset)
+					for i := range buff {
+						Expect(buff[i]).To(Equal(payload[i] ^ key[(offset+uint64(i))%4]))
+					}
+				}
+			}
+		})
+
+		It("should unmask a payload in segments", func() {
+			payload := bytes.Repeat([]byte("websocket"), 10)
+			buff := append([]byte(nil), payload...)
+			Unmask(buff, singleFrameMaskedTextMask)
+			UnmaskAt(buff[:3], [4]byte{0x37, 0xfa, 0x21, 0x3d}, 0)
+			UnmaskAt(buff[3:50], [4]byte{0x37, 0xfa, 0x21, 0x3d}, 3)
+			UnmaskAt(buff[50:], [4]byte{0x37, 0xfa, 0x21, 0x3d}, 50)
+			Expect(buff).To(Equal(payload))
+		})
+	})
+
+	Describe("DecodeHeader", func() {
+		It("should decode the header of a masked text frame", func() {
+			var header FrameHeader
+			n, err := DecodeHeader(singleFrameMaskedText, &header)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(6))
+			Expect(header).To(Equal(FrameHeader{
+				Fin:        true,
+				OPCode:     OPCodeTextFrame,
+				Masked:     true,
+				MaskingKey: [4]byte{0x37, 0xfa, 0x21, 0x3d},
+				PayloadLen: 5,
+			}))
+		})
+
+		It("should decode the header without the payload", func() {
+			var header FrameHeader
+			n, err := DecodeHeader(singleFrameBinaryUnmasked64KBytesLongHeader, &header)
+			Expect(err).To(BeNil())
+			Expect(n).To(Equal(10))
+			Expect(header.OPCode).To(Equal(OPCodeBinaryFrame))
+			Expect(header.PayloadLen).To(Equal(uint64(0x10400)))
+		})
+
+		It("should decode the rsv bits", func() {
+			var header FrameHeader
+			_, err := DecodeHeader(singleFrameMaskedFlatedText, &header)
+			Expect(err).To(BeNil())
+			Expect(header.Rsv1).To(BeTrue())
+			Expect(header.Rsv2).To(BeFalse())
+			Expect(header.Rsv3).To(BeFalse())
+		})
+
+		It("should fail decoding an incomplete header", func() {
+			var header FrameHeader
+			_, err := DecodeHeader(singleFrameMaskedText[:1], &header)
+			Expect(err).To(Equal(ErrUnexpectedEndOfPacket))
+			_, err = DecodeHeader(singleFrameMaskedText[:5], &header)
+			Expect(err).To(Equal(ErrUnexpectedEndOfPacket))
+			_, err = DecodeHeader(singleFrameBinaryUnmasked256BytesLongHeader[:3], &header)
+			Expect(err).To(Equal(ErrUnexpectedEndOfPacket))
+		})
+
+		It("should fail decoding a 64-bits length with the most significant bit set", func() {
+			var header FrameHeader
+			_, err := DecodeHeader([]byte{0x82, 0x7F, 0x80, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00, 0x00}, &header)
+			Expect(err).To(Equal(ErrProtocolError))
+		})
+
+		It("should not allocate", func() {
+			var header FrameHeader
+			Expect(testing.AllocsPerRun(100, func() {
+				DecodeHeader(singleFrameMaskedText, &header)
+			})).To(BeZero())
+		})
+	})
+
+	Describe("AppendFrame", func() {
+		It("should append an unmasked text frame", func() {
+			dst, err := AppendFrame(nil, true, false, false, false, OPCodeTextFrame, nil, []byte("Hello"))
+			Expect(err).To(BeNil())
+			Expect(dst).To(Equal(singleFrameUnmaskedText))
+		})
+
+		It("should append a masked text frame, masking the payload", func() {
+			payload := []byte("Hello")
+			dst, err := AppendFrame(nil, true, false, false, false, OPCodeTextFrame, singleFrameMaskedTextMask, payload)
+			Expect(err).To(BeNil())
+			Expect(dst).To(Equal(singleFrameMaskedText))
+			Expect(string(payload)).To(Equal("Hello"))
+		})
+
+		It("should append the rsv bits", func() {
+			payload := append([]byte(nil), singleFrameMaskedFlatedTextPayload...)
+			Unmask(payload, singleFrameMaskedFlatedTextMask)
+			dst, err := AppendFrame(nil, true, true, false, false, OPCodeTextFrame, singleFrameMaskedFlatedTextMask, payload)
+			Expect(err).To(BeNil())
+			Expect(dst).To(Equal(singleFrameMaskedFlatedText))
+			dst, err = AppendFrame(nil, false, false, true, true, OPCodeBinaryFrame, nil, nil)
+			Expect(err).To(BeNil())
+			Expect(dst).To(Equal([]byte{0x32, 0x00}))
+		})
+
+		It("should append frames with extended lengths", func() {
+			for _, size := range []int{125, 126, 65535, 65536} {
+				payload := make([]byte, size)
+				packet, err := EncodePacket(true, false, false, false, OPCodeBinaryFrame, uint64(size), nil, payload)
+				Expect(err).To(BeNil())
+				dst, err := AppendFrame(nil, true, false, false, false, OPCodeBinaryFrame, nil, payload)
+				Expect(err).To(BeNil())
+				Expect(dst).To(Equal(packet))
+			}
+		})
+
+		It("should append after the existing data", func() {
+			dst, err := AppendFrame([]byte("prefix"), true, false, false, false, OPCodeTextFrame, nil, []byte("Hello"))
+			Expect(err).To(BeNil())
+			Expect(dst).To(Equal(append([]byte("prefix"), singleFrameUnmaskedText...)))
+		})
+
+		It("should fail with a wrong mask key", func() {
+			_, err := AppendFrame(nil, true, false, false, false, OPCodeTextFrame, []byte{1, 2, 3}, []byte("Hello"))
+			Expect(err).To(Equal(ErrWrongMaskKey))
+		})
+
+		It("should not allocate when the dst has room", func() {
+			dst := make([]byte, 0, 1024)
+			payload := make([]byte, 512)
+			Expect(testing.AllocsPerRun(100, func() {
+				AppendFrame(dst[:0], true, false, false, false, OPCodeBinaryFrame, singleFrameMaskedTextMask, payload)
+			})).To(BeZero())
+		})
 	})
 
 	Describe("Deflate", func() {
@@ -541,6 +771,80 @@ var _ = Describe("Protocol", func() {
 			Expect(err).To(BeNil())
 			Expect(string(dst)).To(Equal("test"))
 		})
+
+		It("should deflate payloads bigger than the buffer", func() {
+			payload := bytes.Repeat([]byte("websocket "), 1000)
+			flated, _, err := Flate(nil, payload)
+			Expect(err).To(BeNil())
+			dst, err := Deflate(nil, flated)
+			Expect(err).To(BeNil())
+			Expect(dst).To(Equal(payload))
+		})
+
+		It("should stop deflating at the limit", func() {
+			flated, _, err := Flate(nil, make([]byte, 1024*1024))
+			Expect(err).To(BeNil())
+			_, err = DeflateLimit(nil, flated, 1024*1024-1)
+			Expect(err).To(Equal(ErrMessageTooBig))
+			dst, err := DeflateLimit(nil, flated, 1024*1024)
+			Expect(err).To(BeNil())
+			Expect(dst).To(HaveLen(1024 * 1024))
+		})
+
+		It("should flate at every level", func() {
+			payload := bytes.Repeat([]byte("websocket "), 1000)
+			for level := flate.HuffmanOnly; level <= flate.BestCompression; level++ {
+				flated, n, err := FlateLevel(nil, payload, level)
+				Expect(err).To(BeNil())
+				Expect(flated).To(HaveLen(n))
+				dst, err := Deflate(nil, flated)
+				Expect(err).To(BeNil())
+				Expect(dst).To(Equal(payload))
+			}
+		})
+
+		It("should flate at the DefaultCompressionLevel", func() {
+			payload := bytes.Repeat([]byte("websocket "), 1000)
+			flated, _, err := Flate(nil, payload)
+			Expect(err).To(BeNil())
+			expected, _, err := FlateLevel(nil, payload, DefaultCompressionLevel)
+			Expect(err).To(BeNil())
+			Expect(flated).To(Equal(expected))
+		})
+
+		It("should append the flated data to the dst", func() {
+			flated, _, err := Flate([]byte("prefix"), []byte("test"))
+			Expect(err).To(BeNil())
+			Expect(string(flated[:6])).To(Equal("prefix"))
+			dst, err := Deflate(nil, flated[6:])
+			Expect(err).To(BeNil())
+			Expect(string(dst)).To(Equal("test"))
+		})
+
+		It("should fail flating with an invalid level", func() {
+			_, _, err := FlateLevel(nil, []byte("test"), flate.BestCompression+1)
+			Expect(err).To(Equal(ErrCompressionLevel))
+			_, _, err = FlateLevel(nil, []byte("test"), flate.HuffmanOnly-1)
+			Expect(err).To(Equal(ErrCompressionLevel))
+		})
+
+		It("should reuse the decompressors after failing", func() {
+			_, err := Deflate(nil, []byte{0xff, 0xff, 0xff})
+			Expect(err).To(HaveOccurred())
+			flated, _, err := Flate(nil, []byte("test"))
+			Expect(err).To(BeNil())
+			dst, err := Deflate(nil, flated)
+			Expect(err).To(BeNil())
+			Expect(string(dst)).To(Equal("test"))
+		})
+
+		It("should limit the compression ratio", func() {
+			Expect(deflateLimit(10000, 0, 0)).To(Equal(0))
+			Expect(deflateLimit(10000, 50000, 0)).To(Equal(50000))
+			Expect(deflateLimit(10000, 50000, 2)).To(Equal(20000))
+			Expect(deflateLimit(10000, 0, 10)).To(Equal(100000))
+			Expect(deflateLimit(10, 0, 10)).To(Equal(deflateBufferDefaultSize))
+		})
 	})
 })
 
@@ -573,3 +877,140 @@ func BenchmarkDeflate(b *testing.B) {
 		log.Println(err)
 	}
 }
+
+// unmaskBytewise is how the payloads were unmasked before Unmask worked 8
+// bytes at a time.
+func unmaskBytewise(buff, mask []byte) {
+	l := uint64(len(buff))
+	masklen := uint64(len(mask))
+	for i := uint64(0); i < l; i++ {
+		buff[i] = buff[i] ^ mask[i%masklen]
+	}
+}
+
+var benchmarkPayloadSizes = []int{16, 128, 1024, 64 * 1024}
+
+func BenchmarkUnmaskPayload(b *testing.B) {
+	for _, size := range benchmarkPayloadSizes {
+		buff := make([]byte, size)
+		b.Run(fmt.Sprintf("word/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				Unmask(buff, singleFrameMaskedTextMask)
+			}
+		})
+		b.Run(fmt.Sprintf("bytewise/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			for i := 0; i < b.N; i++ {
+				unmaskBytewise(buff, singleFrameMaskedTextMask)
+			}
+		})
+	}
+}
+
+func BenchmarkAppendFrame(b *testing.B) {
+	for _, size := range benchmarkPayloadSizes {
+		payload := make([]byte, size)
+		b.Run(fmt.Sprintf("append/%d", size), func(b *testing.B) {
+			dst := make([]byte, 0, size+maxFrameHeaderSize+4)
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := AppendFrame(dst[:0], true, false, false, false, OPCodeBinaryFrame, singleFrameMaskedTextMask, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("encode/%d", size), func(b *testing.B) {
+			b.SetBytes(int64(size))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := EncodePacket(true, false, false, false, OPCodeBinaryFrame, uint64(size), singleFrameMaskedTextMask, payload); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDecodeHeader(b *testing.B) {
+	b.Run("header", func(b *testing.B) {
+		var header FrameHeader
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := DecodeHeader(singleFrameMaskedText, &header); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("reader", func(b *testing.B) {
+		reader := bytes.NewReader(singleFrameMaskedText)
+		buff := make([]byte, 1024)
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			reader.Reset(singleFrameMaskedText)
+			if _, _, _, _, _, _, _, _, err := DecodeFrameFromReader(reader, buff, 0); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// flateUnpooled is how the payloads were compressed before the compressors
+// were pooled.
+func flateUnpooled(dst, src []byte, level int) ([]byte, error) {
+	b := bytes.NewBuffer(dst)
+	writer, err := flate.NewWriter(b, level)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = writer.Write(src); err != nil {
+		return nil, err
+	}
+	if err = writer.Flush(); err != nil {
+		return nil, err
+	}
+	return b.Bytes()[:b.Len()-4], nil
+}
+
+func BenchmarkFlateLevel(b *testing.B) {
+	payload := bytes.Repeat([]byte(`{"jsonrpc":"2.0","method":"update","params":[42,"websocket"]}`), 16)
+	for _, level := range []int{flate.BestSpeed, flate.DefaultCompression, flate.BestCompression} {
+		b.Run(fmt.Sprintf("pooled/%d", level), func(b *testing.B) {
+			dst := make([]byte, 0, len(payload))
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, _, err := FlateLevel(dst[:0], payload, level); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+		b.Run(fmt.Sprintf("unpooled/%d", level), func(b *testing.B) {
+			dst := make([]byte, 0, len(payload))
+			b.SetBytes(int64(len(payload)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := flateUnpooled(dst[:0], payload, level); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDeflatePayload(b *testing.B) {
+	payload := bytes.Repeat([]byte(`{"jsonrpc":"2.0","method":"update","params":[42,"websocket"]}`), 16)
+	flated, _, err := Flate(nil, payload)
+	if err != nil {
+		b.Fatal(err)
+	}
+	dst := make([]byte, 0, len(payload))
+	b.SetBytes(int64(len(payload)))
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := Deflate(dst[:0], flated); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var (
+	ErrRateLimited = errors.New("Rate limit exceeded")
+)
+
+// RateLimitAction defines what the manager does with a message received when
+// a rate limit is exceeded.
+type RateLimitAction byte
+
+const (
+	// RateLimitDrop discards the message, reporting ErrRateLimited to the
+	// OnMessageError handler.
+	RateLimitDrop RateLimitAction = iota
+	// RateLimitDelay handles the message, but delays the reading of the
+	// connection until the limit allows it again.
+	RateLimitDelay
+	// RateLimitClose closes the connection with the
+	// ConnectionCloseReasonPolicyViolation reason, reporting ErrRateLimited
+	// to the OnMessageError handler.
+	RateLimitClose
+)
+
+// RateLimit configures token bucket limits for the messages received. A zero
+// rate disables its limit.
+type RateLimit struct {
+	// MessagesPerSecond is the rate of messages allowed.
+	MessagesPerSecond float64
+	// MessagesBurst is the number of messages allowed at once. Default: the
+	// MessagesPerSecond, at least 1.
+	MessagesBurst int
+	// BytesPerSecond is the rate of payload bytes allowed.
+	BytesPerSecond float64
+	// BytesBurst is the number of payload bytes allowed at once. Default: the
+	// BytesPerSecond. Messages bigger than it are never allowed, unless the
+	// Action is RateLimitDelay.
+	BytesBurst int
+	// Action is what is done when the limit is exceeded.
+	Action RateLimitAction
+}
+
+// RateLimiter applies a RateLimit. It is safe for concurrent use, so the same
+// limiter can be shared by all connections as a global limit.
+type RateLimiter struct {
+	action   RateLimitAction
+	messages tokenBucket
+	bytes    tokenBucket
+	mutex    sync.Mutex
+}
+
+// NewRateLimiter returns a new instance of the websocket.RateLimiter
+func NewRateLimiter(limit RateLimit) *RateLimiter {
+	return &RateLimiter{
+		action:   limit.Action,
+		messages: newTokenBucket(limit.MessagesPerSecond, limit.MessagesBurst),
+		bytes:    newTokenBucket(limit.BytesPerSecond, limit.BytesBurst),
+	}
+}
+
+// reserve takes the tokens of a message of the given size. It returns false,
+// taking nothing, when the message is not allowed. For the RateLimitDelay
+// action messages are always allowed, and the time to wait before reading
+// again is returned.
+func (l *RateLimiter) reserve(size int) (time.Duration, bool) {
+	now := time.Now()
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages.refill(now)
+	l.bytes.refill(now)
+	if l.action != RateLimitDelay && !(l.messages.has(1) && l.bytes.has(float64(size))) {
+		return 0, false
+	}
+	wait := l.messages.take(1)
+	if w := l.bytes.take(float64(size)); w > wait {
+		wait = w
+	}
+	return wait, true
+}
+
+// refund gives back the tokens reserved for a message of the given size that
+// was not read after all.
+func (l *RateLimiter) refund(size int) {
+	l.mutex.Lock()
+	defer l.mutex.Unlock()
+	l.messages.give(1)
+	l.bytes.give(float64(size))
+}
+
+// tokenBucket is not safe for concurrent use, the RateLimiter guards it.
+type tokenBucket struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(rate float64, burst int) tokenBucket {
+	b := float64(burst)
+	if b <= 0 {
+		b = rate
+		if b < 1 {
+			b = 1
+		}
+	}
+	return tokenBucket{
+		rate:   rate,
+		burst:  b,
+		tokens: b,
+	}
+}
+
+func (b *tokenBucket) refill(now time.Time) {
+	if b.rate <= 0 {
+		return
+	}
+	if !b.last.IsZero() {
+		b.tokens += now.Sub(b.last).Seconds() * b.rate
+		if b.tokens > b.burst {
+			b.tokens = b.burst
+		}
+	}
+	b.last = now
+}
+
+func (b *tokenBucket) has(n float64) bool {
+	return b.rate <= 0 || b.tokens >= n
+}
+
+// take removes the tokens, possibly going into debt, and returns how long it
+// takes for the bucket to be out of debt.
+func (b *tokenBucket) take(n float64) time.Duration {
+	if b.rate <= 0 {
+		return 0
+	}
+	b.tokens -= n
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// give adds the tokens back, up to the burst.
+func (b *tokenBucket) give(n float64) {
+	if b.rate <= 0 {
+		return
+	}
+	b.tokens += n
+	if b.tokens > b.burst {
+		b.tokens = b.burst
+	}
+}
+
+// rateLimit applies the limiters to a message received. It returns the time
+// the reading must be delayed and false if the message must be discarded, in
+// which case ErrRateLimited is reported and, for the RateLimitClose action,
+// the connection is closed.
+func rateLimit(c Connection, size int, onError ConnectionErrorHandler, limiters ...*RateLimiter) (time.Duration, bool) {
+	var delay time.Duration
+	for i, limiter := range limiters {
+		if limiter == nil {
+			continue
+		}
+		wait, ok := limiter.reserve(size)
+		if !ok {
+			// The message is discarded, so the limiters that allowed it
+			// are not charged.
+			for _, reserved := range limiters[:i] {
+				if reserved != nil {
+					reserved.refund(size)
+				}
+			}
+			if onError != nil {
+				onError(c, ErrRateLimited)
+			}
+			if limiter.action == RateLimitClose {
+				c.CloseWithReason(ConnectionCloseReasonPolicyViolation)
+				c.Terminate()
+			}
+			return 0, false
+		}
+		if wait > delay {
+			delay = wait
+		}
+	}
+	return delay, true
+}
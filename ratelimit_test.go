@@ -0,0 +1,167 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"encoding/binary"
+	"sync"
+	"time"
+)
+
+var _ = Describe("RateLimiter", func() {
+	It("should allow the burst of messages", func() {
+		limiter := NewRateLimiter(RateLimit{
+			MessagesPerSecond: 1,
+			MessagesBurst:     3,
+		})
+		for i := 0; i < 3; i++ {
+			_, ok := limiter.reserve(10)
+			Expect(ok).To(BeTrue())
+		}
+		_, ok := limiter.reserve(10)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should refill the tokens over time", func() {
+		limiter := NewRateLimiter(RateLimit{
+			MessagesPerSecond: 100,
+			MessagesBurst:     1,
+		})
+		_, ok := limiter.reserve(0)
+		Expect(ok).To(BeTrue())
+		_, ok = limiter.reserve(0)
+		Expect(ok).To(BeFalse())
+		time.Sleep(time.Millisecond * 20)
+		_, ok = limiter.reserve(0)
+		Expect(ok).To(BeTrue())
+	})
+
+	It("should limit the bytes", func() {
+		limiter := NewRateLimiter(RateLimit{
+			BytesPerSecond: 10,
+		})
+		_, ok := limiter.reserve(11)
+		Expect(ok).To(BeFalse())
+		_, ok = limiter.reserve(6)
+		Expect(ok).To(BeTrue())
+		_, ok = limiter.reserve(6)
+		Expect(ok).To(BeFalse())
+	})
+
+	It("should return the time to wait when delaying", func() {
+		limiter := NewRateLimiter(RateLimit{
+			BytesPerSecond: 1000,
+			Action:         RateLimitDelay,
+		})
+		wait, ok := limiter.reserve(1000)
+		Expect(ok).To(BeTrue())
+		Expect(wait).To(BeZero())
+		wait, ok = limiter.reserve(500)
+		Expect(ok).To(BeTrue())
+		Expect(wait).To(BeNumerically("~", time.Millisecond*500, time.Millisecond*50))
+	})
+
+	It("should not charge the limiters of the messages discarded", func() {
+		limiter := NewRateLimiter(RateLimit{
+			MessagesPerSecond: 0.001,
+			MessagesBurst:     2,
+		})
+		global := NewRateLimiter(RateLimit{
+			MessagesPerSecond: 0.001,
+			MessagesBurst:     1,
+		})
+		_, ok := rateLimit(nil, 10, nil, limiter, global)
+		Expect(ok).To(BeTrue())
+		_, ok = rateLimit(nil, 10, nil, limiter, global)
+		Expect(ok).To(BeFalse())
+		// The message discarded by the global limiter was refunded.
+		_, ok = limiter.reserve(10)
+		Expect(ok).To(BeTrue())
+	})
+
+	Describe("ListenableManager", func() {
+		var (
+			manager  *ListenableManager
+			mutex    sync.Mutex
+			received []string
+			errs     chan error
+		)
+
+		BeforeEach(func() {
+			received = nil
+			errs = make(chan error, 10)
+			manager = NewListeableManager()
+			manager.ReadTimeout = time.Second
+			manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+				mutex.Lock()
+				received = append(received, string(payload))
+				mutex.Unlock()
+				return nil
+			}
+			manager.OnMessageError = func(conn Connection, err error) {
+				errs <- err
+			}
+		})
+
+		It("should drop the messages over the limit", func() {
+			manager.RateLimit = &RateLimit{
+				MessagesPerSecond: 0.1,
+				MessagesBurst:     2,
+			}
+			client, done := acceptPipe(manager)
+			writeFrames(client,
+				maskedFrame(true, OPCodeTextFrame, []byte("1")),
+				maskedFrame(true, OPCodeTextFrame, []byte("2")),
+				maskedFrame(true, OPCodeTextFrame, []byte("3")),
+			)
+			Eventually(errs).Should(Receive(Equal(ErrRateLimited)))
+			client.Close()
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(received).To(Equal([]string{"1", "2"}))
+		})
+
+		It("should close the connection over the global limit", func() {
+			manager.GlobalRateLimiter = NewRateLimiter(RateLimit{
+				BytesPerSecond: 1,
+				BytesBurst:     5,
+				Action:         RateLimitClose,
+			})
+			client, done := acceptPipe(manager)
+			writeFrames(client,
+				maskedFrame(true, OPCodeTextFrame, []byte("Hello")),
+				maskedFrame(true, OPCodeTextFrame, []byte("World")),
+			)
+			frames := readFrames(client, 1)
+			Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+			Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonPolicyViolation))
+			Eventually(done).Should(Receive(BeNil()))
+			Expect(received).To(Equal([]string{"Hello"}))
+			Expect(errs).To(Receive(Equal(ErrRateLimited)))
+		})
+
+		It("should delay the reading of the connection", func() {
+			manager.RateLimit = &RateLimit{
+				MessagesPerSecond: 20,
+				MessagesBurst:     1,
+				Action:            RateLimitDelay,
+			}
+			client, done := acceptPipe(manager)
+			start := time.Now()
+			writeFrames(client,
+				maskedFrame(true, OPCodeTextFrame, []byte("1")),
+				maskedFrame(true, OPCodeTextFrame, []byte("2")),
+				maskedFrame(true, OPCodeTextFrame, []byte("3")),
+			)
+			Eventually(func() int {
+				mutex.Lock()
+				defer mutex.Unlock()
+				return len(received)
+			}).Should(Equal(3))
+			Expect(time.Since(start)).To(BeNumerically(">=", time.Millisecond*90))
+			Expect(errs).NotTo(Receive())
+			client.Close()
+			Eventually(done).Should(Receive(BeNil()))
+		})
+	})
+})
@@ -0,0 +1,140 @@
+package websocket
+
+import "sync"
+
+// rooms keeps track of the connections alive on a manager and the rooms they
+// have joined, so messages can be broadcasted to them.
+type rooms struct {
+	mutex sync.RWMutex
+	conns map[Connection]*member
+	rooms map[string]map[Connection]struct{}
+}
+
+// member is a connection registered, with the rooms it has joined.
+type member struct {
+	// generation is the use of the connection registered, as pooled
+	// connections are reused once released.
+	generation uint64
+	joined     map[string]struct{}
+}
+
+// recipient is a connection a broadcast is delivered to.
+type recipient struct {
+	conn       Connection
+	generation uint64
+}
+
+func newRooms() *rooms {
+	return &rooms{
+		conns: make(map[Connection]*member),
+		rooms: make(map[string]map[Connection]struct{}),
+	}
+}
+
+// add registers the connection, making it reachable by broadcasts.
+func (r *rooms) add(conn Connection) {
+	m := &member{
+		joined: make(map[string]struct{}),
+	}
+	if g, ok := conn.(generational); ok {
+		m.generation = g.currentGeneration()
+	}
+	r.mutex.Lock()
+	r.conns[conn] = m
+	r.mutex.Unlock()
+}
+
+// remove unregisters the connection and removes it from all rooms it has
+// joined.
+func (r *rooms) remove(conn Connection) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	if m, ok := r.conns[conn]; ok {
+		for room := range m.joined {
+			r.leaveLocked(conn, room)
+		}
+	}
+	delete(r.conns, conn)
+}
+
+// join adds the connection to the room. It returns false when the connection
+// is not registered.
+func (r *rooms) join(conn Connection, room string) bool {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	m, ok := r.conns[conn]
+	if !ok {
+		return false
+	}
+	m.joined[room] = struct{}{}
+	members, ok := r.rooms[room]
+	if !ok {
+		members = make(map[Connection]struct{})
+		r.rooms[room] = members
+	}
+	members[conn] = struct{}{}
+	return true
+}
+
+// leave removes the connection from the room.
+func (r *rooms) leave(conn Connection, room string) {
+	r.mutex.Lock()
+	r.leaveLocked(conn, room)
+	r.mutex.Unlock()
+}
+
+func (r *rooms) leaveLocked(conn Connection, room string) {
+	if m, ok := r.conns[conn]; ok {
+		delete(m.joined, room)
+	}
+	members, ok := r.rooms[room]
+	if !ok {
+		return
+	}
+	delete(members, conn)
+	if len(members) == 0 {
+		delete(r.rooms, room)
+	}
+}
+
+// members returns a snapshot of the connections of the given room. An empty
+// room name stands for all registered connections.
+func (r *rooms) members(room string) []Connection {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var result []Connection
+	if room == "" {
+		result = make([]Connection, 0, len(r.conns))
+		for conn := range r.conns {
+			result = append(result, conn)
+		}
+		return result
+	}
+	members := r.rooms[room]
+	result = make([]Connection, 0, len(members))
+	for conn := range members {
+		result = append(result, conn)
+	}
+	return result
+}
+
+// recipients returns a snapshot of the connections of the given room, as the
+// members, along with the generation registered of each.
+func (r *rooms) recipients(room string) []recipient {
+	r.mutex.RLock()
+	defer r.mutex.RUnlock()
+	var result []recipient
+	if room == "" {
+		result = make([]recipient, 0, len(r.conns))
+		for conn, m := range r.conns {
+			result = append(result, recipient{conn, m.generation})
+		}
+		return result
+	}
+	members := r.rooms[room]
+	result = make([]recipient, 0, len(members))
+	for conn := range members {
+		result = append(result, recipient{conn, r.conns[conn].generation})
+	}
+	return result
+}
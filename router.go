@@ -0,0 +1,178 @@
+package websocket
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strings"
+)
+
+var (
+	ErrUnknownMessageType = errors.New("Unknown message type")
+	ErrMissingMessageType = errors.New("Missing message type")
+)
+
+var (
+	connectionType = reflect.TypeOf((*Connection)(nil)).Elem()
+	errorType      = reflect.TypeOf((*error)(nil)).Elem()
+)
+
+// Router is a MessageHandler that decodes an envelope of the incoming message
+// and dispatches it to the handler registered for its type.
+//
+// By default, the envelope is a JSON object with the type at the "type" field
+// and the whole message is decoded into the request of the handler:
+//
+//	router := websocket.NewRouter()
+//	router.Handle("chat.send", func(conn websocket.Connection, req *ChatSend) error {
+//		...
+//	})
+//	manager.OnMessage = router.OnMessage
+//
+// Errors returned by the handlers and the hooks are returned by OnMessage,
+// hence they are reported to the OnMessageError of the manager.
+type Router struct {
+	// TypeField is the path of the field holding the message type. Nested
+	// fields are separated by dots (eg. "meta.type"). Default: "type".
+	TypeField string
+	// DataField is the path of the field decoded into the request of the
+	// handler. When empty, the whole message is decoded.
+	DataField string
+	// Envelope extracts the type and the data to be decoded from the payload.
+	// The default implementation decodes JSON using TypeField and DataField.
+	Envelope func(payload []byte) (msgType string, data []byte, err error)
+	// Unmarshal decodes the data into the request of the handler. Default:
+	// json.Unmarshal.
+	Unmarshal func(data []byte, v interface{}) error
+	// OnUnknownType is called when there is no handler registered for the
+	// type. The default implementation returns ErrUnknownMessageType.
+	OnUnknownType func(conn Connection, msgType string, payload []byte) error
+	// OnDecodeError is called when the envelope or the request cannot be
+	// decoded. The default implementation returns the err.
+	OnDecodeError func(conn Connection, payload []byte, err error) error
+
+	routes map[string]route
+}
+
+type route struct {
+	handler     reflect.Value
+	requestType reflect.Type
+}
+
+// NewRouter returns a new instance of the websocket.Router
+func NewRouter() *Router {
+	return &Router{
+		TypeField: "type",
+		routes:    make(map[string]route),
+	}
+}
+
+// Handle registers the handler for the given message type.
+//
+// The handler must have the signature
+// `func(conn websocket.Connection, req *T) error`, where T is the type the
+// message will be decoded into. It panics otherwise.
+func (r *Router) Handle(msgType string, handler interface{}) {
+	h := reflect.ValueOf(handler)
+	t := h.Type()
+	if t.Kind() != reflect.Func || t.NumIn() != 2 || t.NumOut() != 1 ||
+		t.In(0) != connectionType || t.In(1).Kind() != reflect.Ptr || t.Out(0) != errorType {
+		panic(fmt.Sprintf("websocket: invalid handler for %q: expected func(websocket.Connection, *T) error, got %s", msgType, t))
+	}
+	if r.routes == nil {
+		r.routes = make(map[string]route)
+	}
+	r.routes[msgType] = route{
+		handler:     h,
+		requestType: t.In(1).Elem(),
+	}
+}
+
+// OnMessage implements the websocket.MessageHandler, dispatching the message
+// to its handler.
+func (r *Router) OnMessage(conn Connection, opcode MessageType, payload []byte) error {
+	envelope := r.Envelope
+	if envelope == nil {
+		envelope = r.jsonEnvelope
+	}
+	msgType, data, err := envelope(payload)
+	if err != nil {
+		return r.decodeError(conn, payload, err)
+	}
+
+	rt, ok := r.routes[msgType]
+	if !ok {
+		if r.OnUnknownType != nil {
+			return r.OnUnknownType(conn, msgType, payload)
+		}
+		return ErrUnknownMessageType
+	}
+
+	unmarshal := r.Unmarshal
+	if unmarshal == nil {
+		unmarshal = json.Unmarshal
+	}
+	req := reflect.New(rt.requestType)
+	if len(data) > 0 {
+		if err = unmarshal(data, req.Interface()); err != nil {
+			return r.decodeError(conn, payload, err)
+		}
+	}
+	result := rt.handler.Call([]reflect.Value{reflect.ValueOf(&conn).Elem(), req})
+	if err, ok := result[0].Interface().(error); ok {
+		return err
+	}
+	return nil
+}
+
+func (r *Router) decodeError(conn Connection, payload []byte, err error) error {
+	if r.OnDecodeError != nil {
+		return r.OnDecodeError(conn, payload, err)
+	}
+	return err
+}
+
+// jsonEnvelope extracts the type and the data from a JSON message.
+func (r *Router) jsonEnvelope(payload []byte) (string, []byte, error) {
+	typeField := r.TypeField
+	if typeField == "" {
+		typeField = "type"
+	}
+	raw, err := jsonField(payload, typeField)
+	if err != nil {
+		return "", nil, err
+	}
+	if raw == nil {
+		return "", nil, ErrMissingMessageType
+	}
+	var msgType string
+	if err = json.Unmarshal(raw, &msgType); err != nil {
+		return "", nil, err
+	}
+	if r.DataField == "" {
+		return msgType, payload, nil
+	}
+	data, err := jsonField(payload, r.DataField)
+	if err != nil {
+		return "", nil, err
+	}
+	return msgType, data, nil
+}
+
+// jsonField returns the raw value of the field at the dot separated path. It
+// returns nil when the field does not exist.
+func jsonField(payload []byte, path string) (json.RawMessage, error) {
+	raw := json.RawMessage(payload)
+	for _, name := range strings.Split(path, ".") {
+		var fields map[string]json.RawMessage
+		if err := json.Unmarshal(raw, &fields); err != nil {
+			return nil, err
+		}
+		var ok bool
+		if raw, ok = fields[name]; !ok {
+			return nil, nil
+		}
+	}
+	return raw, nil
+}
@@ -0,0 +1,118 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"errors"
+)
+
+type chatSend struct {
+	Room string `json:"room"`
+	Text string `json:"text"`
+}
+
+var _ = Describe("Router", func() {
+	var conn Connection
+
+	BeforeEach(func() {
+		conn = NewSimpleConn(nil)
+	})
+
+	It("should dispatch the message to the handler of its type", func() {
+		router := NewRouter()
+		var received *chatSend
+		router.Handle("chat.send", func(c Connection, req *chatSend) error {
+			Expect(c).To(Equal(conn))
+			received = req
+			return nil
+		})
+		router.Handle("chat.leave", func(c Connection, req *chatSend) error {
+			Fail("wrong handler")
+			return nil
+		})
+		Expect(router.OnMessage(conn, MessageTypeText, []byte(`{"type":"chat.send","room":"general","text":"Hello"}`))).To(Succeed())
+		Expect(received).To(Equal(&chatSend{"general", "Hello"}))
+	})
+
+	It("should use the configured type and data fields", func() {
+		router := NewRouter()
+		router.TypeField = "meta.type"
+		router.DataField = "data"
+		var received *chatSend
+		router.Handle("chat.send", func(c Connection, req *chatSend) error {
+			received = req
+			return nil
+		})
+		Expect(router.OnMessage(conn, MessageTypeText, []byte(`{"meta":{"type":"chat.send"},"data":{"room":"general","text":"Hello"}}`))).To(Succeed())
+		Expect(received).To(Equal(&chatSend{"general", "Hello"}))
+	})
+
+	It("should return the error of the handler", func() {
+		router := NewRouter()
+		errHandler := errors.New("handler error")
+		router.Handle("chat.send", func(c Connection, req *chatSend) error {
+			return errHandler
+		})
+		Expect(router.OnMessage(conn, MessageTypeText, []byte(`{"type":"chat.send"}`))).To(Equal(errHandler))
+	})
+
+	It("should report unknown types", func() {
+		router := NewRouter()
+		Expect(router.OnMessage(conn, MessageTypeText, []byte(`{"type":"chat.send"}`))).To(Equal(ErrUnknownMessageType))
+
+		var unknown string
+		router.OnUnknownType = func(c Connection, msgType string, payload []byte) error {
+			unknown = msgType
+			return nil
+		}
+		Expect(router.OnMessage(conn, MessageTypeText, []byte(`{"type":"chat.send"}`))).To(Succeed())
+		Expect(unknown).To(Equal("chat.send"))
+	})
+
+	It("should report decoding errors", func() {
+		router := NewRouter()
+		router.Handle("chat.send", func(c Connection, req *chatSend) error {
+			Fail("should not be called")
+			return nil
+		})
+		Expect(router.OnMessage(conn, MessageTypeText, []byte(`{"text":"Hello"}`))).To(Equal(ErrMissingMessageType))
+		Expect(router.OnMessage(conn, MessageTypeText, []byte(`not json`))).NotTo(Succeed())
+
+		var decodeErr error
+		router.OnDecodeError = func(c Connection, payload []byte, err error) error {
+			decodeErr = err
+			return nil
+		}
+		Expect(router.OnMessage(conn, MessageTypeText, []byte(`{"type":"chat.send","text":1}`))).To(Succeed())
+		Expect(decodeErr).NotTo(BeNil())
+	})
+
+	It("should use a custom envelope", func() {
+		router := NewRouter()
+		router.Envelope = func(payload []byte) (string, []byte, error) {
+			return "raw", []byte(`{"text":"` + string(payload) + `"}`), nil
+		}
+		var received *chatSend
+		router.Handle("raw", func(c Connection, req *chatSend) error {
+			received = req
+			return nil
+		})
+		Expect(router.OnMessage(conn, MessageTypeText, []byte("Hello"))).To(Succeed())
+		Expect(received.Text).To(Equal("Hello"))
+	})
+
+	It("should not accept invalid handlers", func() {
+		router := NewRouter()
+		Expect(func() {
+			router.Handle("chat.send", func(req *chatSend) error {
+				return nil
+			})
+		}).To(Panic())
+		Expect(func() {
+			router.Handle("chat.send", func(c Connection, req chatSend) error {
+				return nil
+			})
+		}).To(Panic())
+	})
+})
@@ -0,0 +1,255 @@
+package websocket
+
+import (
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ConnectionStats is a snapshot of the counters of a connection.
+type ConnectionStats struct {
+	// ConnectedAt is when the connection was accepted by the manager.
+	ConnectedAt time.Time
+	// LastActivity is when the last frame was received.
+	LastActivity time.Time
+
+	FramesIn    uint64
+	FramesOut   uint64
+	MessagesIn  uint64
+	MessagesOut uint64
+	// BytesIn and BytesOut count the frames on the wire, headers included.
+	BytesIn  uint64
+	BytesOut uint64
+	// CompressedBytesIn and CompressedBytesOut count the payload of the
+	// compressed frames, while RawBytesIn and RawBytesOut count the same
+	// payload decompressed.
+	CompressedBytesIn  uint64
+	CompressedBytesOut uint64
+	RawBytesIn         uint64
+	RawBytesOut        uint64
+
+	PingsIn  uint64
+	PingsOut uint64
+	PongsIn  uint64
+	PongsOut uint64
+}
+
+// add sums the counters of other.
+func (s *ConnectionStats) add(other *ConnectionStats) {
+	s.FramesIn += other.FramesIn
+	s.FramesOut += other.FramesOut
+	s.MessagesIn += other.MessagesIn
+	s.MessagesOut += other.MessagesOut
+	s.BytesIn += other.BytesIn
+	s.BytesOut += other.BytesOut
+	s.CompressedBytesIn += other.CompressedBytesIn
+	s.CompressedBytesOut += other.CompressedBytesOut
+	s.RawBytesIn += other.RawBytesIn
+	s.RawBytesOut += other.RawBytesOut
+	s.PingsIn += other.PingsIn
+	s.PingsOut += other.PingsOut
+	s.PongsIn += other.PongsIn
+	s.PongsOut += other.PongsOut
+}
+
+// connStats holds the counters of a connection. They are updated atomically,
+// since the reading and the writing may happen in different goroutines.
+type connStats struct {
+	connectedAt  int64
+	lastActivity int64
+
+	framesIn, framesOut                   uint64
+	messagesIn, messagesOut               uint64
+	bytesIn, bytesOut                     uint64
+	compressedBytesIn, compressedBytesOut uint64
+	rawBytesIn, rawBytesOut               uint64
+	pingsIn, pingsOut, pongsIn, pongsOut  uint64
+}
+
+func (s *connStats) reset(now time.Time) {
+	*s = connStats{
+		connectedAt: now.UnixNano(),
+	}
+}
+
+// frameSize returns the size on the wire of a frame with the payload length.
+func frameSize(payloadLen uint64, masked bool) int {
+	size := 2 + int(payloadLen)
+	if payloadLen > 65535 {
+		size += 8
+	} else if payloadLen > 125 {
+		size += 2
+	}
+	if masked {
+		size += 4
+	}
+	return size
+}
+
+// frameIn counts a frame received with size bytes on the wire.
+func (s *connStats) frameIn(opcode byte, size int) {
+	atomic.AddUint64(&s.framesIn, 1)
+	atomic.AddUint64(&s.bytesIn, uint64(size))
+	atomic.StoreInt64(&s.lastActivity, time.Now().UnixNano())
+	switch opcode {
+	case OPCodePingFrame:
+		atomic.AddUint64(&s.pingsIn, 1)
+	case OPCodePongFrame:
+		atomic.AddUint64(&s.pongsIn, 1)
+	}
+}
+
+// frameOut counts a frame sent with size bytes on the wire.
+func (s *connStats) frameOut(opcode byte, size int) {
+	atomic.AddUint64(&s.framesOut, 1)
+	atomic.AddUint64(&s.bytesOut, uint64(size))
+	switch opcode {
+	case OPCodePingFrame:
+		atomic.AddUint64(&s.pingsOut, 1)
+	case OPCodePongFrame:
+		atomic.AddUint64(&s.pongsOut, 1)
+	}
+}
+
+func (s *connStats) messageIn() {
+	atomic.AddUint64(&s.messagesIn, 1)
+}
+
+func (s *connStats) messageOut() {
+	atomic.AddUint64(&s.messagesOut, 1)
+}
+
+func (s *connStats) compressedIn(compressed, raw int) {
+	atomic.AddUint64(&s.compressedBytesIn, uint64(compressed))
+	atomic.AddUint64(&s.rawBytesIn, uint64(raw))
+}
+
+func (s *connStats) compressedOut(compressed, raw int) {
+	atomic.AddUint64(&s.compressedBytesOut, uint64(compressed))
+	atomic.AddUint64(&s.rawBytesOut, uint64(raw))
+}
+
+func (s *connStats) snapshot() ConnectionStats {
+	stats := ConnectionStats{
+		FramesIn:           atomic.LoadUint64(&s.framesIn),
+		FramesOut:          atomic.LoadUint64(&s.framesOut),
+		MessagesIn:         atomic.LoadUint64(&s.messagesIn),
+		MessagesOut:        atomic.LoadUint64(&s.messagesOut),
+		BytesIn:            atomic.LoadUint64(&s.bytesIn),
+		BytesOut:           atomic.LoadUint64(&s.bytesOut),
+		CompressedBytesIn:  atomic.LoadUint64(&s.compressedBytesIn),
+		CompressedBytesOut: atomic.LoadUint64(&s.compressedBytesOut),
+		RawBytesIn:         atomic.LoadUint64(&s.rawBytesIn),
+		RawBytesOut:        atomic.LoadUint64(&s.rawBytesOut),
+		PingsIn:            atomic.LoadUint64(&s.pingsIn),
+		PingsOut:           atomic.LoadUint64(&s.pingsOut),
+		PongsIn:            atomic.LoadUint64(&s.pongsIn),
+		PongsOut:           atomic.LoadUint64(&s.pongsOut),
+	}
+	if at := atomic.LoadInt64(&s.connectedAt); at != 0 {
+		stats.ConnectedAt = time.Unix(0, at)
+	}
+	if at := atomic.LoadInt64(&s.lastActivity); at != 0 {
+		stats.LastActivity = time.Unix(0, at)
+	}
+	return stats
+}
+
+// ManagerStats is a snapshot of the counters of a manager.
+type ManagerStats struct {
+	// OpenConnections is the number of connections being managed.
+	OpenConnections int64
+	// AcceptedConnections and ClosedConnections count the connections since
+	// the manager was created.
+	AcceptedConnections uint64
+	ClosedConnections   uint64
+	// Connections sums the counters of all the connections, the open and
+	// the closed ones.
+	Connections ConnectionStats
+}
+
+// managerStats aggregates the counters of the connections of a manager.
+type managerStats struct {
+	mutex    sync.Mutex
+	open     int64
+	accepted uint64
+	closed   uint64
+	// totals sums the counters of the closed connections.
+	totals ConnectionStats
+}
+
+func (s *managerStats) connected() {
+	s.mutex.Lock()
+	s.open++
+	s.accepted++
+	s.mutex.Unlock()
+}
+
+// disconnected counts the connection as closed, keeping its counters.
+func (s *managerStats) disconnected(stats ConnectionStats) {
+	s.mutex.Lock()
+	s.open--
+	s.closed++
+	s.totals.add(&stats)
+	s.mutex.Unlock()
+}
+
+// snapshot returns the counters, adding the ones of the open connections.
+func (s *managerStats) snapshot(open []Connection) ManagerStats {
+	s.mutex.Lock()
+	stats := ManagerStats{
+		OpenConnections:     s.open,
+		AcceptedConnections: s.accepted,
+		ClosedConnections:   s.closed,
+		Connections:         s.totals,
+	}
+	s.mutex.Unlock()
+	for _, c := range open {
+		connStats := c.Stats()
+		stats.Connections.add(&connStats)
+	}
+	return stats
+}
+
+// UpgraderStats is a snapshot of the counters of an Upgrader.
+type UpgraderStats struct {
+	// Upgrades counts the requests upgraded.
+	Upgrades uint64
+	// HandshakeFailures counts the requests rejected by reason.
+	HandshakeFailures map[HandshakeFailure]uint64
+}
+
+// upgraderStats holds the counters of an Upgrader.
+type upgraderStats struct {
+	mutex    sync.Mutex
+	upgrades uint64
+	failures map[HandshakeFailure]uint64
+}
+
+func (s *upgraderStats) upgraded() {
+	s.mutex.Lock()
+	s.upgrades++
+	s.mutex.Unlock()
+}
+
+func (s *upgraderStats) failed(reason HandshakeFailure) {
+	s.mutex.Lock()
+	if s.failures == nil {
+		s.failures = make(map[HandshakeFailure]uint64)
+	}
+	s.failures[reason]++
+	s.mutex.Unlock()
+}
+
+func (s *upgraderStats) snapshot() UpgraderStats {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	stats := UpgraderStats{
+		Upgrades:          s.upgrades,
+		HandshakeFailures: make(map[HandshakeFailure]uint64, len(s.failures)),
+	}
+	for reason, count := range s.failures {
+		stats.HandshakeFailures[reason] = count
+	}
+	return stats
+}
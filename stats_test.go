@@ -0,0 +1,123 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"net"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+var _ = Describe("Stats", func() {
+	It("should count the traffic of a connection", func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		conn := NewSimpleConn(server)
+		before := time.Now()
+		conn.Init(&ConnectionContext{
+			Conn: server,
+		})
+
+		writeFrames(client,
+			maskedFrame(false, OPCodeTextFrame, []byte("Hel")),
+			maskedFrame(true, OPCodeContinuationFrame, []byte("lo")),
+		)
+		opcode, payload, err := conn.ReadMessage()
+		Expect(err).To(BeNil())
+		Expect(opcode).To(Equal(MessageTypeText))
+		Expect(string(payload)).To(Equal("Hello"))
+
+		done := make(chan error, 1)
+		go func() {
+			done <- conn.WriteMessage(MessageTypeText, []byte("World"))
+		}()
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "World"}}))
+		Eventually(done).Should(Receive(BeNil()))
+
+		stats := conn.Stats()
+		Expect(stats.ConnectedAt).To(BeTemporally(">=", before))
+		Expect(stats.LastActivity).To(BeTemporally(">=", stats.ConnectedAt))
+		Expect(stats.FramesIn).To(Equal(uint64(2)))
+		Expect(stats.FramesOut).To(Equal(uint64(1)))
+		Expect(stats.MessagesIn).To(Equal(uint64(1)))
+		Expect(stats.MessagesOut).To(Equal(uint64(1)))
+		Expect(stats.BytesIn).To(Equal(uint64(6 + 3 + 6 + 2)))
+		Expect(stats.BytesOut).To(Equal(uint64(2 + 5)))
+	})
+
+	It("should count the compressed bytes", func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		conn := NewSimpleConn(server)
+		conn.Init(&ConnectionContext{
+			Conn:       server,
+			Compressed: true,
+		})
+		payload := make([]byte, 1000)
+		flated, _, err := Flate(nil, payload)
+		Expect(err).To(BeNil())
+		writeFrames(client, compressedFrame(true, OPCodeBinaryFrame, flated))
+		_, _, err = conn.ReadMessage()
+		Expect(err).To(BeNil())
+
+		stats := conn.Stats()
+		Expect(stats.CompressedBytesIn).To(Equal(uint64(len(flated))))
+		Expect(stats.RawBytesIn).To(Equal(uint64(len(payload))))
+	})
+
+	It("should aggregate the connections of a manager", func() {
+		manager := NewListeableManager()
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			return conn.WriteMessage(opcode, payload)
+		}
+		client1, done1 := acceptPipe(manager)
+		client2, done2 := acceptPipe(manager)
+		writeFrames(client1,
+			maskedFrame(true, OPCodePingFrame, []byte("ping")),
+			maskedFrame(true, OPCodeTextFrame, []byte("Hello")),
+		)
+		Expect(readFrames(client1, 2)).To(HaveLen(2))
+		Eventually(manager.Stats).Should(And(
+			HaveField("OpenConnections", int64(2)),
+			HaveField("AcceptedConnections", uint64(2)),
+			HaveField("Connections.MessagesIn", uint64(1)),
+			HaveField("Connections.PingsIn", uint64(1)),
+			HaveField("Connections.PongsOut", uint64(1)),
+		))
+
+		client1.Close()
+		Eventually(done1).Should(Receive(BeNil()))
+		stats := manager.Stats()
+		Expect(stats.OpenConnections).To(Equal(int64(1)))
+		Expect(stats.ClosedConnections).To(Equal(uint64(1)))
+		Expect(stats.Connections.MessagesIn).To(Equal(uint64(1)))
+		Expect(stats.Connections.MessagesOut).To(Equal(uint64(1)))
+
+		client2.Close()
+		Eventually(done2).Should(Receive(BeNil()))
+		Expect(manager.Stats().OpenConnections).To(BeZero())
+	})
+
+	It("should count the handshakes of an upgrader", func() {
+		upgrader := NewUpgrader(NewListeableManager())
+		client := upgradeThroughServer(func(ctx *fasthttp.RequestCtx) {
+			upgrader.Upgrade(ctx)
+		})
+		defer client.Close()
+		ctx := buildValidCtx()
+		ctx.Request.Header.SetMethod("POST")
+		Expect(upgrader.Upgrade(ctx)).NotTo(Succeed())
+		ctx = buildValidCtx()
+		ctx.Request.Header.Set("Sec-WebSocket-Version", "12")
+		Expect(upgrader.Upgrade(ctx)).NotTo(Succeed())
+		Eventually(upgrader.Stats).Should(Equal(UpgraderStats{
+			Upgrades: 1,
+			HandshakeFailures: map[HandshakeFailure]uint64{
+				HandshakeFailureMethod:  1,
+				HandshakeFailureVersion: 1,
+			},
+		}))
+	})
+})
@@ -0,0 +1,164 @@
+package websocket
+
+import (
+	"context"
+	"sync/atomic"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Tracer receives the lifecycle of the handshakes, the connections and the
+// messages, for correlating them with the downstream calls in a tracing
+// system.
+//
+// The hooks that start a span return the context carrying it, which is the
+// parent of the following ones: the handshake span is the parent of the
+// connection span, which is the parent of the message spans. The handlers
+// retrieve the current span context with Connection.TraceContext.
+//
+// Implementations must be safe for concurrent use.
+type Tracer interface {
+	// HandshakeStart is called when the Upgrader starts processing a request.
+	HandshakeStart(ctx context.Context, req *fasthttp.RequestCtx) context.Context
+	// HandshakeEnd is called when the handshake is done. The failure is empty
+	// when the connection was upgraded.
+	HandshakeEnd(ctx context.Context, failure HandshakeFailure)
+	// ConnectionOpen is called when a manager accepts a connection, before
+	// the OnConnect handler.
+	ConnectionOpen(ctx context.Context) context.Context
+	// ConnectionClose is called when a manager releases a connection, with
+	// its final counters.
+	ConnectionClose(ctx context.Context, stats ConnectionStats)
+	// MessageRead is called when a message is delivered to the OnMessage
+	// handler.
+	MessageRead(ctx context.Context, opcode MessageType, size int) context.Context
+	// MessageHandled is called with the result of the OnMessage handler.
+	MessageHandled(ctx context.Context, err error)
+	// MessageWritten is called when a message is sent, with the span context
+	// of the connection, or of the message being handled.
+	MessageWritten(ctx context.Context, opcode MessageType, size int)
+}
+
+// nopTracer is used when no Tracer is configured.
+type nopTracer struct{}
+
+func (nopTracer) HandshakeStart(ctx context.Context, req *fasthttp.RequestCtx) context.Context {
+	return ctx
+}
+func (nopTracer) HandshakeEnd(ctx context.Context, failure HandshakeFailure) {}
+func (nopTracer) ConnectionOpen(ctx context.Context) context.Context         { return ctx }
+func (nopTracer) ConnectionClose(ctx context.Context, stats ConnectionStats) {}
+func (nopTracer) MessageRead(ctx context.Context, opcode MessageType, size int) context.Context {
+	return ctx
+}
+func (nopTracer) MessageHandled(ctx context.Context, err error)                    {}
+func (nopTracer) MessageWritten(ctx context.Context, opcode MessageType, size int) {}
+
+// tracerOrNop returns the tracer, or a no-op one when it is nil.
+func tracerOrNop(tracer Tracer) Tracer {
+	if tracer == nil {
+		return nopTracer{}
+	}
+	return tracer
+}
+
+// tracedConnection is implemented by the connections that carry a span
+// context, for the managers to trace them.
+type tracedConnection interface {
+	// traceOpen configures the tracer and opens the connection span.
+	traceOpen(tracer Tracer)
+	// traceClose closes the connection span.
+	traceClose(stats ConnectionStats)
+	// traceMessage opens a message span, which becomes the span context of
+	// the connection until the returned function is called with the result
+	// of the handler.
+	traceMessage(opcode MessageType, size int) func(err error)
+}
+
+// traceSpan wraps the span context, since an atomic.Value requires values of
+// the same type.
+type traceSpan struct {
+	ctx context.Context
+}
+
+// connTrace holds the span contexts of a connection. The messages of a
+// connection are handled one at a time, so there is a single message span at
+// once, but it may be read by other goroutines writing to the connection.
+type connTrace struct {
+	tracer  Tracer
+	conn    context.Context
+	message atomic.Value
+}
+
+func (t *connTrace) reset(parent context.Context) {
+	if parent == nil {
+		parent = context.Background()
+	}
+	t.tracer = nopTracer{}
+	t.conn = parent
+	t.message.Store(traceSpan{})
+}
+
+func (t *connTrace) current() context.Context {
+	if span, ok := t.message.Load().(traceSpan); ok && span.ctx != nil {
+		return span.ctx
+	}
+	if t.conn == nil {
+		return context.Background()
+	}
+	return t.conn
+}
+
+func (t *connTrace) written(opcode MessageType, size int) {
+	if t.tracer != nil {
+		t.tracer.MessageWritten(t.current(), opcode, size)
+	}
+}
+
+// TraceContext implements the websocket.Connection.TraceContext method
+func (c *BaseConnection) TraceContext() context.Context {
+	return c.trace.current()
+}
+
+func (c *BaseConnection) traceOpen(tracer Tracer) {
+	c.trace.tracer = tracerOrNop(tracer)
+	c.trace.conn = c.trace.tracer.ConnectionOpen(c.trace.current())
+}
+
+func (c *BaseConnection) traceClose(stats ConnectionStats) {
+	c.trace.tracer.ConnectionClose(c.trace.conn, stats)
+}
+
+// traceHandled is returned by traceMessage when there is no tracer, avoiding
+// the allocation of a closure per message.
+var traceHandled = func(err error) {}
+
+func (c *BaseConnection) traceMessage(opcode MessageType, size int) func(err error) {
+	tracer := c.trace.tracer
+	if _, ok := tracer.(nopTracer); ok {
+		return traceHandled
+	}
+	ctx := tracer.MessageRead(c.trace.conn, opcode, size)
+	c.trace.message.Store(traceSpan{ctx})
+	return func(err error) {
+		c.trace.message.Store(traceSpan{})
+		tracer.MessageHandled(ctx, err)
+	}
+}
+
+// tracedMessageHandler wraps the handler opening a message span around it.
+func tracedMessageHandler(handler MessageHandler, tracer Tracer) MessageHandler {
+	if _, ok := tracer.(nopTracer); ok {
+		return handler
+	}
+	return func(conn Connection, opcode MessageType, payload []byte) error {
+		tc, ok := conn.(tracedConnection)
+		if !ok {
+			return handler(conn, opcode, payload)
+		}
+		done := tc.traceMessage(opcode, len(payload))
+		err := handler(conn, opcode, payload)
+		done(err)
+		return err
+	}
+}
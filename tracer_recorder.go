@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// RecordedSpan is a span recorded by the websocket.TraceRecorder.
+type RecordedSpan struct {
+	// Name is "websocket.handshake", "websocket.connection" or
+	// "websocket.message".
+	Name string
+	// TraceID is shared by the spans of the same handshake. ParentID is zero
+	// for the root spans.
+	TraceID  uint64
+	SpanID   uint64
+	ParentID uint64
+
+	Start time.Time
+	End   time.Time
+
+	Attributes map[string]interface{}
+	Events     []SpanEvent
+	// Err is the error of the OnMessage handler, or the HandshakeError of a
+	// handshake rejected.
+	Err error
+}
+
+// SpanEvent is an event recorded in a websocket.RecordedSpan.
+type SpanEvent struct {
+	Name       string
+	Time       time.Time
+	Attributes map[string]interface{}
+}
+
+type recordedSpanKey struct{}
+
+// TraceRecorder is a Tracer that keeps the spans in memory, following the
+// model of OpenTelemetry, so the tracing of an application can be asserted on
+// tests.
+type TraceRecorder struct {
+	mutex  sync.Mutex
+	lastID uint64
+	spans  []*RecordedSpan
+}
+
+// NewTraceRecorder returns a new instance of the websocket.TraceRecorder.
+func NewTraceRecorder() *TraceRecorder {
+	return &TraceRecorder{}
+}
+
+// Spans returns the spans ended, in the order they ended.
+func (r *TraceRecorder) Spans() []RecordedSpan {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	spans := make([]RecordedSpan, 0, len(r.spans))
+	for _, span := range r.spans {
+		spans = append(spans, copySpan(span))
+	}
+	return spans
+}
+
+// SpanFromContext returns the span carried by the ctx, ended or not. It is
+// meant for the handlers to correlate their work with the span of
+// Connection.TraceContext.
+func (r *TraceRecorder) SpanFromContext(ctx context.Context) (RecordedSpan, bool) {
+	span, ok := ctx.Value(recordedSpanKey{}).(*RecordedSpan)
+	if !ok {
+		return RecordedSpan{}, false
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	return copySpan(span), true
+}
+
+// Reset discards the spans recorded.
+func (r *TraceRecorder) Reset() {
+	r.mutex.Lock()
+	r.spans = nil
+	r.mutex.Unlock()
+}
+
+func (r *TraceRecorder) start(ctx context.Context, name string, attributes map[string]interface{}) context.Context {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	r.lastID++
+	span := &RecordedSpan{
+		Name:       name,
+		TraceID:    r.lastID,
+		SpanID:     r.lastID,
+		Start:      time.Now(),
+		Attributes: attributes,
+	}
+	if parent, ok := ctx.Value(recordedSpanKey{}).(*RecordedSpan); ok {
+		span.TraceID = parent.TraceID
+		span.ParentID = parent.SpanID
+	}
+	return context.WithValue(ctx, recordedSpanKey{}, span)
+}
+
+func (r *TraceRecorder) end(ctx context.Context, err error, attributes map[string]interface{}) {
+	span, ok := ctx.Value(recordedSpanKey{}).(*RecordedSpan)
+	if !ok {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	span.End = time.Now()
+	span.Err = err
+	for key, value := range attributes {
+		span.Attributes[key] = value
+	}
+	r.spans = append(r.spans, span)
+}
+
+// HandshakeStart implements the websocket.Tracer.HandshakeStart method
+func (r *TraceRecorder) HandshakeStart(ctx context.Context, req *fasthttp.RequestCtx) context.Context {
+	return r.start(ctx, "websocket.handshake", map[string]interface{}{
+		"http.method": string(req.Method()),
+		"http.target": string(req.RequestURI()),
+	})
+}
+
+// HandshakeEnd implements the websocket.Tracer.HandshakeEnd method
+func (r *TraceRecorder) HandshakeEnd(ctx context.Context, failure HandshakeFailure) {
+	if failure == "" {
+		r.end(ctx, nil, nil)
+		return
+	}
+	r.end(ctx, HandshakeError{string(failure)}, map[string]interface{}{
+		"handshake.failure": string(failure),
+	})
+}
+
+// ConnectionOpen implements the websocket.Tracer.ConnectionOpen method
+func (r *TraceRecorder) ConnectionOpen(ctx context.Context) context.Context {
+	return r.start(ctx, "websocket.connection", map[string]interface{}{})
+}
+
+// ConnectionClose implements the websocket.Tracer.ConnectionClose method
+func (r *TraceRecorder) ConnectionClose(ctx context.Context, stats ConnectionStats) {
+	r.end(ctx, nil, map[string]interface{}{
+		"messages.in":  stats.MessagesIn,
+		"messages.out": stats.MessagesOut,
+		"bytes.in":     stats.BytesIn,
+		"bytes.out":    stats.BytesOut,
+	})
+}
+
+// MessageRead implements the websocket.Tracer.MessageRead method
+func (r *TraceRecorder) MessageRead(ctx context.Context, opcode MessageType, size int) context.Context {
+	return r.start(ctx, "websocket.message", map[string]interface{}{
+		"message.type": messageTypeName(opcode),
+		"message.size": size,
+	})
+}
+
+// MessageHandled implements the websocket.Tracer.MessageHandled method
+func (r *TraceRecorder) MessageHandled(ctx context.Context, err error) {
+	r.end(ctx, err, nil)
+}
+
+// MessageWritten implements the websocket.Tracer.MessageWritten method
+func (r *TraceRecorder) MessageWritten(ctx context.Context, opcode MessageType, size int) {
+	span, ok := ctx.Value(recordedSpanKey{}).(*RecordedSpan)
+	if !ok {
+		return
+	}
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+	span.Events = append(span.Events, SpanEvent{
+		Name: "message.written",
+		Time: time.Now(),
+		Attributes: map[string]interface{}{
+			"message.type": messageTypeName(opcode),
+			"message.size": size,
+		},
+	})
+}
+
+func copySpan(span *RecordedSpan) RecordedSpan {
+	c := *span
+	c.Attributes = make(map[string]interface{}, len(span.Attributes))
+	for key, value := range span.Attributes {
+		c.Attributes[key] = value
+	}
+	c.Events = append([]SpanEvent(nil), span.Events...)
+	return c
+}
@@ -0,0 +1,110 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"context"
+	"errors"
+	"net"
+)
+
+var _ = Describe("Tracer", func() {
+	It("should trace the handshakes rejected", func() {
+		recorder := NewTraceRecorder()
+		upgrader := &Upgrader{
+			Tracer: recorder,
+		}
+		ctx := buildValidCtx()
+		ctx.Request.Header.SetMethod("POST")
+		Expect(upgrader.Upgrade(ctx)).NotTo(Succeed())
+		spans := recorder.Spans()
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0].Name).To(Equal("websocket.handshake"))
+		Expect(spans[0].ParentID).To(BeZero())
+		Expect(spans[0].Err).NotTo(BeNil())
+		Expect(spans[0].Attributes).To(HaveKeyWithValue("handshake.failure", "method"))
+		Expect(spans[0].Attributes).To(HaveKeyWithValue("http.method", "POST"))
+	})
+
+	It("should trace the handshakes upgraded", func() {
+		recorder := NewTraceRecorder()
+		upgrader := &Upgrader{
+			Tracer: recorder,
+		}
+		Expect(upgrader.Upgrade(buildValidCtx())).To(Succeed())
+		spans := recorder.Spans()
+		Expect(spans).To(HaveLen(1))
+		Expect(spans[0].Err).To(BeNil())
+		Expect(spans[0].End).To(BeTemporally(">=", spans[0].Start))
+	})
+
+	It("should trace the connections and the messages of a manager", func() {
+		recorder := NewTraceRecorder()
+		handshake := recorder.HandshakeStart(context.Background(), buildValidCtx())
+		recorder.HandshakeEnd(handshake, "")
+		handshakeSpan, ok := recorder.SpanFromContext(handshake)
+		Expect(ok).To(BeTrue())
+
+		manager := NewListeableManager()
+		manager.Tracer = recorder
+		handled := make(chan RecordedSpan, 2)
+		manager.OnMessage = func(conn Connection, opcode MessageType, payload []byte) error {
+			span, _ := recorder.SpanFromContext(conn.TraceContext())
+			handled <- span
+			if string(payload) == "fail" {
+				return errors.New("failed")
+			}
+			return conn.WriteMessage(opcode, payload)
+		}
+		server, client := net.Pipe()
+		done := make(chan error, 1)
+		go func() {
+			done <- manager.Accept(&ConnectionContext{
+				Conn:         server,
+				TraceContext: handshake,
+			})
+		}()
+		writeFrames(client,
+			maskedFrame(true, OPCodeTextFrame, []byte("Hello")),
+			maskedFrame(true, OPCodeTextFrame, []byte("fail")),
+		)
+		Expect(readFrames(client, 1)).To(Equal([]testFrame{{OPCodeTextFrame, "Hello"}}))
+		var span RecordedSpan
+		Eventually(handled).Should(Receive(&span))
+		Expect(span.Name).To(Equal("websocket.message"))
+		Expect(span.TraceID).To(Equal(handshakeSpan.TraceID))
+		Eventually(handled).Should(Receive())
+		client.Close()
+		Eventually(done).Should(Receive())
+
+		spans := recorder.Spans()
+		Expect(spans).To(HaveLen(4))
+		Expect(spans[0].SpanID).To(Equal(handshakeSpan.SpanID))
+		hello, fail, connection := spans[1], spans[2], spans[3]
+		Expect(connection.Name).To(Equal("websocket.connection"))
+		Expect(connection.ParentID).To(Equal(handshakeSpan.SpanID))
+		Expect(connection.Attributes).To(HaveKeyWithValue("messages.in", uint64(2)))
+		Expect(hello.SpanID).To(Equal(span.SpanID))
+		Expect(hello.ParentID).To(Equal(connection.SpanID))
+		Expect(hello.Attributes).To(HaveKeyWithValue("message.size", 5))
+		Expect(hello.Err).To(BeNil())
+		Expect(hello.Events).To(HaveLen(1))
+		Expect(hello.Events[0].Name).To(Equal("message.written"))
+		Expect(fail.ParentID).To(Equal(connection.SpanID))
+		Expect(fail.Err).To(MatchError("failed"))
+	})
+
+	It("should use the span of the connection out of the handlers", func() {
+		server, client := net.Pipe()
+		defer client.Close()
+		conn := NewSimpleConn(server)
+		Expect(conn.TraceContext()).To(Equal(context.Background()))
+		parent := context.WithValue(context.Background(), recordedSpanKey{}, &RecordedSpan{})
+		conn.Init(&ConnectionContext{
+			Conn:         server,
+			TraceContext: parent,
+		})
+		Expect(conn.TraceContext()).To(Equal(parent))
+	})
+})
@@ -2,11 +2,11 @@ package websocket
 
 import (
 	"bytes"
+	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"fmt"
 	"github.com/valyala/fasthttp"
-	"log"
 	"net"
 	"strings"
 )
@@ -26,6 +26,32 @@ var (
 	strPerMessageDeflate      = []byte("permessage-deflate")
 )
 
+// HandshakeFailure identifies why a handshake was rejected. Differently from
+// the HandshakeError message, it has a fixed set of values, so it can be used
+// for labelling metrics.
+type HandshakeFailure string
+
+const (
+	// HandshakeFailureMethod is a request with a method other than GET.
+	HandshakeFailureMethod HandshakeFailure = "method"
+	// HandshakeFailureConnection is a request without "Connection: Upgrade".
+	HandshakeFailureConnection HandshakeFailure = "connection"
+	// HandshakeFailureUpgrade is a request upgrading to another protocol.
+	HandshakeFailureUpgrade HandshakeFailure = "upgrade"
+	// HandshakeFailureKey is a request without the Sec-WebSocket-Key.
+	HandshakeFailureKey HandshakeFailure = "key"
+	// HandshakeFailureVersion is a request with a missing or unsupported
+	// Sec-WebSocket-Version.
+	HandshakeFailureVersion HandshakeFailure = "version"
+	// HandshakeFailureRateLimited is a request over the HandshakesPerSecond.
+	HandshakeFailureRateLimited HandshakeFailure = "rate_limited"
+	// HandshakeFailureMaxConnections is a request over the MaxConnections.
+	HandshakeFailureMaxConnections HandshakeFailure = "max_connections"
+	// HandshakeFailureMaxConnectionsPerIP is a request over the
+	// MaxConnectionsPerIP.
+	HandshakeFailureMaxConnectionsPerIP HandshakeFailure = "max_connections_per_ip"
+)
+
 // HandshakeError represents an handshake error while upgrading a connection.
 type HandshakeError struct {
 	message string
@@ -40,6 +66,33 @@ func (e HandshakeError) Error() string {
 type Upgrader struct {
 	manager Manager
 	Error   func(ctx *fasthttp.RequestCtx, reason error)
+	// MaxConnections is the maximum number of connections upgraded at the
+	// same time. Requests over it are rejected with 503. Zero means no limit.
+	MaxConnections int
+	// MaxConnectionsPerIP is the maximum number of connections upgraded at
+	// the same time for a single client address. Requests over it are
+	// rejected with 429. Zero means no limit.
+	MaxConnectionsPerIP int
+	// HandshakesPerSecond is the rate of handshakes allowed for a single
+	// client address. Requests over it are rejected with 429. Zero means no
+	// limit.
+	HandshakesPerSecond float64
+	// HandshakesBurst is the number of handshakes a single client address can
+	// attempt at once. Default: the HandshakesPerSecond, at least 1.
+	HandshakesBurst int
+	// TrustedProxies are the networks of the proxies allowed to inform the
+	// client address through the X-Forwarded-For header.
+	TrustedProxies []*net.IPNet
+	// Metrics, when set, receives the handshakes processed.
+	Metrics MetricsSink
+	// Logger, when set, receives the handshakes rejected and the errors of
+	// the manager accepting the connections.
+	Logger Logger
+	// Tracer, when set, receives the handshakes and is forwarded to the
+	// manager as the parent span of the connections.
+	Tracer    Tracer
+	admission admission
+	stats     upgraderStats
 }
 
 // NewUpgrader returns a new instance of an websocket.Upgrader
@@ -49,7 +102,11 @@ func NewUpgrader(manager Manager) *Upgrader {
 	}
 }
 
-func (u *Upgrader) reportError(ctx *fasthttp.RequestCtx, status int, reason string) error {
+func (u *Upgrader) reportError(ctx *fasthttp.RequestCtx, traceCtx context.Context, failure HandshakeFailure, status int, reason string) error {
+	u.stats.failed(failure)
+	tracerOrNop(u.Tracer).HandshakeEnd(traceCtx, failure)
+	metricsOrNop(u.Metrics).Handshake(failure)
+	loggerOrNop(u.Logger).Debug("websocket: handshake rejected", "remote", clientIP(ctx, u.TrustedProxies), "reason", failure)
 	err := HandshakeError{reason}
 	ctx.Response.SetStatusCode(status)
 	if u.Error != nil {
@@ -65,35 +122,41 @@ func (u *Upgrader) reportError(ctx *fasthttp.RequestCtx, status int, reason stri
 //
 // TODO To document
 func (u *Upgrader) Upgrade(ctx *fasthttp.RequestCtx) error {
+	tracer := tracerOrNop(u.Tracer)
+	traceCtx := tracer.HandshakeStart(context.Background(), ctx)
+	ip := clientIP(ctx, u.TrustedProxies).String()
+	if !u.admission.allowHandshake(ip, u.HandshakesPerSecond, u.HandshakesBurst) {
+		return u.reportError(ctx, traceCtx, HandshakeFailureRateLimited, fasthttp.StatusTooManyRequests, "Too many handshakes")
+	}
+
 	if !ctx.IsGet() {
-		return u.reportError(ctx, fasthttp.StatusMethodNotAllowed, "Method not allowed")
+		return u.reportError(ctx, traceCtx, HandshakeFailureMethod, fasthttp.StatusMethodNotAllowed, "Method not allowed")
 	}
 
 	if !bytes.Equal(ctx.Request.Header.PeekBytes(strConnection), strUpgrade) {
-		return u.reportError(ctx, fasthttp.StatusBadRequest, "Invalid connection type")
+		return u.reportError(ctx, traceCtx, HandshakeFailureConnection, fasthttp.StatusBadRequest, "Invalid connection type")
 	}
 
 	upgradeTo := strings.ToLower(string(ctx.Request.Header.PeekBytes(strUpgrade)))
 	if upgradeTo != strstrwebsocket {
-		return u.reportError(ctx, fasthttp.StatusBadRequest, fmt.Sprintf("This connection cannot be upgraded to '%s'", upgradeTo))
+		return u.reportError(ctx, traceCtx, HandshakeFailureUpgrade, fasthttp.StatusBadRequest, fmt.Sprintf("This connection cannot be upgraded to '%s'", upgradeTo))
 	}
 
 	key := ctx.Request.Header.PeekBytes(strSecWebSocketKey)
 	if key == nil {
-		return u.reportError(ctx, fasthttp.StatusBadRequest, "The key is missing.")
+		return u.reportError(ctx, traceCtx, HandshakeFailureKey, fasthttp.StatusBadRequest, "The key is missing.")
 	}
 
 	version := ctx.Request.Header.PeekBytes(strSecWebSocketVersion)
 	if version == nil {
-		return u.reportError(ctx, fasthttp.StatusBadRequest, "No version provided.")
+		return u.reportError(ctx, traceCtx, HandshakeFailureVersion, fasthttp.StatusBadRequest, "No version provided.")
 	}
 	if !bytes.Equal(version, strSecWebSocketVersion13) {
-		return u.reportError(ctx, fasthttp.StatusBadRequest, "The version is not supported.")
+		return u.reportError(ctx, traceCtx, HandshakeFailureVersion, fasthttp.StatusBadRequest, "The version is not supported.")
 	}
 
 	compress := false
 	headerVisit(ctx.Request.Header.PeekBytes(strSecWebSocketExtensions), func(k, v []byte) bool {
-		log.Println(string(v))
 		if bytes.Equal(v, strPerMessageDeflate) {
 			compress = true
 			return false
@@ -103,12 +166,23 @@ func (u *Upgrader) Upgrade(ctx *fasthttp.RequestCtx) error {
 
 	// TODO: Check origin
 
+	// The slot is only taken once the connection is hijacked: fasthttp does
+	// not call the hijack handler when, for instance, the response cannot be
+	// written, and the slot would never be released.
+	switch failure := u.admission.check(ip, u.MaxConnections, u.MaxConnectionsPerIP); failure {
+	case HandshakeFailureMaxConnections:
+		return u.reportError(ctx, traceCtx, failure, fasthttp.StatusServiceUnavailable, "Too many connections")
+	case HandshakeFailureMaxConnectionsPerIP:
+		return u.reportError(ctx, traceCtx, failure, fasthttp.StatusTooManyRequests, "Too many connections from the address")
+	}
+
 	ctx.Response.SetStatusCode(fasthttp.StatusSwitchingProtocols)
 	ctx.Response.Header.AddBytesKV(strUpgrade, strwebsocket)
 	ctx.Response.Header.AddBytesKV(strConnection, strUpgrade)
 	if acceptKey, err := generateAcceptFromKey(key); err == nil {
 		ctx.Response.Header.AddBytesKV(strSecWebSocketAccept, acceptKey)
 	} else {
+		tracer.HandshakeEnd(traceCtx, HandshakeFailureKey)
 		return err
 	}
 
@@ -118,18 +192,47 @@ func (u *Upgrader) Upgrade(ctx *fasthttp.RequestCtx) error {
 		// ctx.Response.Header.AddBytesK(strSecWebSocketExtensions, "server_no_context_takeover; client_no_context_takeover")
 	}
 
+	metricsOrNop(u.Metrics).Handshake("")
+	tracer.HandshakeEnd(traceCtx, "")
+	logger := loggerOrNop(u.Logger)
+	logger.Debug("websocket: connection upgraded", "remote", ip, "compressed", compress)
 	ctx.Hijack(func(c net.Conn) {
+		if failure := u.admission.acquire(ip, u.MaxConnections, u.MaxConnectionsPerIP); failure != "" {
+			// The last slots were taken by concurrent handshakes.
+			u.stats.failed(failure)
+			logger.Debug("websocket: handshake rejected", "remote", ip, "reason", failure)
+			conn := NewConn(c)
+			conn.CloseWithReason(ConnectionCloseReasonTryAgainLater)
+			conn.Terminate()
+			return
+		}
+		u.stats.upgraded()
 		err := u.manager.Accept(&ConnectionContext{
-			Compressed: compress,
-			Conn:       c,
+			Compressed:   compress,
+			Conn:         c,
+			TraceContext: traceCtx,
+			release: func() {
+				u.admission.release(ip)
+			},
 		})
 		if err != nil {
-			log.Println(err)
+			logger.Error("websocket: accept failed", "remote", ip, "error", err)
 		}
 	})
 	return nil
 }
 
+// Connections returns the number of connections upgraded that were not
+// released by the manager yet.
+func (u *Upgrader) Connections() int {
+	return u.admission.count()
+}
+
+// Stats returns the counters of the handshakes.
+func (u *Upgrader) Stats() UpgraderStats {
+	return u.stats.snapshot()
+}
+
 func generateAcceptFromKey(key []byte) ([]byte, error) {
 	s := sha1.New()
 	_, err := s.Write(key)
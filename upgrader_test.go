@@ -4,16 +4,12 @@ import (
 	. "github.com/onsi/ginkgo"
 	. "github.com/onsi/gomega"
 
+	"encoding/binary"
 	"fmt"
 	"github.com/valyala/fasthttp"
-	"testing"
+	"net"
 )
 
-func TestFasthttpWebsocket(t *testing.T) {
-	RegisterFailHandler(Fail)
-	RunSpecs(t, "FasthttpWebsocket Suite")
-}
-
 func buildValidCtx() *fasthttp.RequestCtx {
 	ctx := &fasthttp.RequestCtx{}
 	ctx.Request.Header.SetMethod("GET")
@@ -100,6 +96,118 @@ var _ = Describe("Upgrader", func() {
 		Expect(fmt.Sprintf("%s", err)).To(Equal("The version is not supported."))
 	})
 
+	Describe("admission", func() {
+		ctxFrom := func(ip string, forwardedFor string) *fasthttp.RequestCtx {
+			ctx := buildValidCtx()
+			if forwardedFor != "" {
+				ctx.Request.Header.Set("X-Forwarded-For", forwardedFor)
+			}
+			req := &fasthttp.Request{}
+			ctx.Request.CopyTo(req)
+			ctx.Init(req, &net.TCPAddr{IP: net.ParseIP(ip), Port: 1234}, nil)
+			return ctx
+		}
+
+		It("should reject connections over the global limit", func() {
+			upgrader := &Upgrader{
+				MaxConnections: 2,
+			}
+			Expect(upgrader.admission.acquire("10.0.0.1", 2, 0)).To(BeEmpty())
+			Expect(upgrader.admission.acquire("10.0.0.2", 2, 0)).To(BeEmpty())
+			ctx := ctxFrom("10.0.0.3", "")
+			Expect(upgrader.Upgrade(ctx)).To(Equal(HandshakeError{"Too many connections"}))
+			Expect(ctx.Response.StatusCode()).To(Equal(fasthttp.StatusServiceUnavailable))
+			Expect(upgrader.Connections()).To(Equal(2))
+		})
+
+		It("should reject connections over the limit per IP", func() {
+			upgrader := &Upgrader{
+				MaxConnectionsPerIP: 1,
+			}
+			Expect(upgrader.admission.acquire("10.0.0.1", 0, 1)).To(BeEmpty())
+			ctx := ctxFrom("10.0.0.1", "")
+			Expect(upgrader.Upgrade(ctx)).To(Equal(HandshakeError{"Too many connections from the address"}))
+			Expect(ctx.Response.StatusCode()).To(Equal(fasthttp.StatusTooManyRequests))
+			Expect(upgrader.Upgrade(ctxFrom("10.0.0.2", ""))).To(Succeed())
+		})
+
+		It("should free the slots released by the managers", func() {
+			upgrader := &Upgrader{
+				MaxConnectionsPerIP: 1,
+			}
+			Expect(upgrader.admission.acquire("10.0.0.1", 0, 1)).To(BeEmpty())
+			connCtx := &ConnectionContext{
+				release: func() {
+					upgrader.admission.release("10.0.0.1")
+				},
+			}
+			connCtx.Release()
+			connCtx.Release()
+			Expect(upgrader.Connections()).To(BeZero())
+			Expect(upgrader.Upgrade(ctxFrom("10.0.0.1", ""))).To(Succeed())
+		})
+
+		It("should take the slots only for the connections hijacked", func() {
+			manager := NewListeableManager()
+			upgrader := NewUpgrader(manager)
+			upgrader.MaxConnections = 1
+			// Without a server, the connection is never hijacked.
+			Expect(upgrader.Upgrade(buildValidCtx())).To(Succeed())
+			Expect(upgrader.Connections()).To(BeZero())
+			Expect(upgrader.Stats().Upgrades).To(BeZero())
+
+			client := upgradeThroughServer(func(ctx *fasthttp.RequestCtx) {
+				upgrader.Upgrade(ctx)
+			})
+			Eventually(upgrader.Connections).Should(Equal(1))
+			Expect(upgrader.Stats().Upgrades).To(Equal(uint64(1)))
+			client.Close()
+			Eventually(upgrader.Connections).Should(BeZero())
+		})
+
+		It("should reject the connections hijacked over the limit", func() {
+			upgrader := NewUpgrader(NewListeableManager())
+			upgrader.MaxConnections = 1
+			client := upgradeThroughServer(func(ctx *fasthttp.RequestCtx) {
+				defer GinkgoRecover()
+				Expect(upgrader.Upgrade(ctx)).To(Succeed())
+				// A concurrent handshake takes the last slot before the
+				// connection is hijacked.
+				Expect(upgrader.admission.acquire("10.0.0.1", 0, 0)).To(BeEmpty())
+			})
+			frames := readFrames(client, 1)
+			Expect(frames[0].opcode).To(Equal(OPCodeConnectionCloseFrame))
+			Expect(ConnectionCloseReason(binary.BigEndian.Uint16([]byte(frames[0].payload)))).To(Equal(ConnectionCloseReasonTryAgainLater))
+			Expect(upgrader.Connections()).To(Equal(1))
+			Expect(upgrader.Stats().HandshakeFailures).To(HaveKeyWithValue(HandshakeFailureMaxConnections, uint64(1)))
+		})
+
+		It("should reject handshakes over the rate per IP", func() {
+			upgrader := &Upgrader{
+				HandshakesPerSecond: 0.1,
+				HandshakesBurst:     2,
+			}
+			Expect(upgrader.Upgrade(ctxFrom("10.0.0.1", ""))).To(Succeed())
+			ctx := ctxFrom("10.0.0.1", "")
+			ctx.Request.Header.SetMethod("POST")
+			Expect(upgrader.Upgrade(ctx)).To(Equal(HandshakeError{"Method not allowed"}))
+			ctx = ctxFrom("10.0.0.1", "")
+			Expect(upgrader.Upgrade(ctx)).To(Equal(HandshakeError{"Too many handshakes"}))
+			Expect(ctx.Response.StatusCode()).To(Equal(fasthttp.StatusTooManyRequests))
+			Expect(upgrader.Upgrade(ctxFrom("10.0.0.2", ""))).To(Succeed())
+		})
+
+		It("should only trust the X-Forwarded-For of trusted proxies", func() {
+			_, proxies, err := net.ParseCIDR("192.168.0.0/16")
+			Expect(err).To(BeNil())
+			trusted := []*net.IPNet{proxies}
+			Expect(clientIP(ctxFrom("10.0.0.1", "10.0.0.2"), trusted).String()).To(Equal("10.0.0.1"))
+			Expect(clientIP(ctxFrom("192.168.0.1", "10.0.0.2"), trusted).String()).To(Equal("10.0.0.2"))
+			Expect(clientIP(ctxFrom("192.168.0.1", "10.0.0.3, 10.0.0.2, 192.168.0.2"), trusted).String()).To(Equal("10.0.0.2"))
+			Expect(clientIP(ctxFrom("192.168.0.1", ""), trusted).String()).To(Equal("192.168.0.1"))
+		})
+	})
+
 	Describe("headerVisit", func() {
 		It("should not visit any value on an empty string", func() {
 			list := make([]string, 0)
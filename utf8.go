@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"unicode/utf8"
+)
+
+// utf8Validator validates a text message as its fragments arrive, so invalid
+// messages fail fast instead of being buffered until the last fragment (RFC
+// 6455, section 8.1). The bytes of a code point split between fragments are
+// kept until the next one.
+type utf8Validator struct {
+	pending [utf8.UTFMax]byte
+	n       int
+}
+
+// Reset prepares the validator for a new message.
+func (v *utf8Validator) Reset() {
+	v.n = 0
+}
+
+// Write validates the next bytes of the message. It returns false as soon as
+// the message cannot be valid UTF-8, whatever bytes come next.
+func (v *utf8Validator) Write(p []byte) bool {
+	// Completes the code point split by the previous fragment.
+	for v.n > 0 && len(p) > 0 {
+		v.pending[v.n] = p[0]
+		v.n++
+		p = p[1:]
+		if utf8.FullRune(v.pending[:v.n]) {
+			if r, size := utf8.DecodeRune(v.pending[:v.n]); r == utf8.RuneError && size == 1 {
+				return false
+			}
+			v.n = 0
+		}
+	}
+	if v.n > 0 {
+		// The fragment ended before completing the code point.
+		return true
+	}
+
+	// Looks for a code point split at the end of this fragment.
+	end := len(p)
+	for i := len(p) - 1; i >= 0 && i > len(p)-utf8.UTFMax; i-- {
+		if utf8.RuneStart(p[i]) {
+			if !utf8.FullRune(p[i:]) {
+				end = i
+			}
+			break
+		}
+	}
+	if !utf8.Valid(p[:end]) {
+		return false
+	}
+	v.n = copy(v.pending[:], p[end:])
+	return true
+}
+
+// Done checks the message does not end in the middle of a code point.
+func (v *utf8Validator) Done() bool {
+	return v.n == 0
+}
@@ -0,0 +1,72 @@
+package websocket
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+)
+
+var _ = Describe("utf8Validator", func() {
+	validate := func(fragments ...string) (bool, bool) {
+		var v utf8Validator
+		for _, fragment := range fragments {
+			if !v.Write([]byte(fragment)) {
+				return false, false
+			}
+		}
+		return true, v.Done()
+	}
+
+	It("should accept valid text in a single fragment", func() {
+		valid, done := validate("Hello-\xc2\xb5@\xc3\x9f\xc3\xb6\xc3\xa4\xc3\xbc\xc3\xa0\xc3\xa1-UTF-8!!")
+		Expect(valid).To(BeTrue())
+		Expect(done).To(BeTrue())
+	})
+
+	It("should accept code points split across fragments", func() {
+		valid, done := validate("\xce", "\xba\xe1", "\xbd", "\xb9\xcf\x83", "\xf0\x90", "\x80", "\x80", "")
+		Expect(valid).To(BeTrue())
+		Expect(done).To(BeTrue())
+	})
+
+	It("should accept the replacement character", func() {
+		valid, done := validate("\xef\xbf", "\xbd")
+		Expect(valid).To(BeTrue())
+		Expect(done).To(BeTrue())
+	})
+
+	It("should not be done in the middle of a code point", func() {
+		valid, done := validate("Hello", "\xe1\xbd")
+		Expect(valid).To(BeTrue())
+		Expect(done).To(BeFalse())
+	})
+
+	It("should fail on the first invalid byte", func() {
+		var v utf8Validator
+		Expect(v.Write([]byte("\xce\xba\xe1\xbd\xb9\xcf\x83\xce\xbc\xce\xb5"))).To(BeTrue())
+		Expect(v.Write([]byte("\xf4"))).To(BeTrue())
+		Expect(v.Write([]byte("\x90"))).To(BeFalse())
+	})
+
+	It("should fail on invalid sequences within a fragment", func() {
+		for _, invalid := range []string{"\x80", "\xc0\xaf", "\xed\xa0\x80", "\xf4\x90\x80\x80", "\xff", "\xe0a"} {
+			valid, _ := validate("Hello" + invalid)
+			Expect(valid).To(BeFalse(), "%q", invalid)
+		}
+	})
+
+	It("should fail on invalid sequences split across fragments", func() {
+		valid, _ := validate("Hello\xed", "\xa0", "\x80")
+		Expect(valid).To(BeFalse())
+		valid, _ = validate("\xe0", "a")
+		Expect(valid).To(BeFalse())
+	})
+
+	It("should start over after a reset", func() {
+		var v utf8Validator
+		Expect(v.Write([]byte("\xe1\xbd"))).To(BeTrue())
+		v.Reset()
+		Expect(v.Done()).To(BeTrue())
+		Expect(v.Write([]byte("Hello"))).To(BeTrue())
+		Expect(v.Done()).To(BeTrue())
+	})
+})
@@ -0,0 +1,412 @@
+// Package wstest provides the client side of websocket connections for
+// testing managers and handlers without a real fasthttp.Server and TCP
+// listener.
+//
+// Pipe connects a Client straight to a websocket.Manager, while the Server
+// goes through the handshake of a websocket.Upgrader over an in-memory
+// listener:
+//
+//	client := wstest.Pipe(manager)
+//	client.SendText("Hello")
+//	err := client.ExpectText("Hello")
+//
+// Besides the regular messages, the Client can send malformed frames, send
+// frames slowly or not read at all, for simulating misbehaving peers.
+//
+// Since the connections are in memory, they cannot be used with the
+// websocket.EpollManager, which requires a file descriptor.
+package wstest
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"time"
+
+	"github.com/jamillosantos/websocket"
+)
+
+// DefaultTimeout is the default deadline of the reads and writes of a Client.
+const DefaultTimeout = time.Second
+
+var (
+	ErrNotPiped      = errors.New("Client not connected by Pipe")
+	ErrAcceptTimeout = errors.New("Accept did not return within the timeout")
+)
+
+// Frame is a frame sent or received by the Client.
+type Frame struct {
+	Fin    bool
+	Rsv1   bool
+	Rsv2   bool
+	Rsv3   bool
+	OPCode byte
+	// Payload is unmasked, the Client masks it when sending.
+	Payload []byte
+}
+
+// Client is the client side of a websocket connection.
+type Client struct {
+	// Timeout is the deadline of each read and write. Zero means
+	// DefaultTimeout.
+	Timeout time.Duration
+
+	conn       net.Conn
+	reader     io.Reader
+	compressed bool
+	accepted   chan error
+	parser     websocket.FrameParser
+	frame      *Frame
+	frames     []Frame
+	buff       []byte
+}
+
+func newClient(conn net.Conn, reader io.Reader, compressed bool) *Client {
+	c := &Client{
+		conn:       conn,
+		reader:     reader,
+		compressed: compressed,
+		buff:       make([]byte, 4096),
+	}
+	c.parser.OnHeader = c.onHeader
+	c.parser.OnPayload = c.onPayload
+	return c
+}
+
+// Pipe connects a new Client to the manager over a net.Pipe. The manager
+// accepts the connection in another goroutine, its result is returned by
+// Wait.
+func Pipe(manager websocket.Manager) *Client {
+	return PipeContext(manager, &websocket.ConnectionContext{})
+}
+
+// PipeContext is the Pipe with a given websocket.ConnectionContext, whose
+// Conn is replaced by the server side of the net.Pipe. Setting Compressed
+// makes the Client behave as if the permessage-deflate was negotiated.
+func PipeContext(manager websocket.Manager, ctx *websocket.ConnectionContext) *Client {
+	server, client := net.Pipe()
+	ctx.Conn = server
+	c := newClient(client, client, ctx.Compressed)
+	c.accepted = make(chan error, 1)
+	go func() {
+		c.accepted <- manager.Accept(ctx)
+	}()
+	return c
+}
+
+// Conn returns the client side of the connection.
+func (c *Client) Conn() net.Conn {
+	return c.conn
+}
+
+// Compressed returns whether the permessage-deflate is used.
+func (c *Client) Compressed() bool {
+	return c.compressed
+}
+
+// Wait waits the manager to return from Accept, returning its result. It
+// fails with ErrAcceptTimeout if the manager does not return within the
+// Timeout.
+func (c *Client) Wait() error {
+	if c.accepted == nil {
+		return ErrNotPiped
+	}
+	select {
+	case err := <-c.accepted:
+		// Wait can be called again.
+		c.accepted <- err
+		return err
+	case <-time.After(c.timeout()):
+		return ErrAcceptTimeout
+	}
+}
+
+func (c *Client) timeout() time.Duration {
+	if c.Timeout <= 0 {
+		return DefaultTimeout
+	}
+	return c.Timeout
+}
+
+// Terminate closes the connection without the close handshake, like a peer
+// that is gone.
+func (c *Client) Terminate() error {
+	return c.conn.Close()
+}
+
+// SendRaw writes the data as it is. It does not need to be a valid frame.
+func (c *Client) SendRaw(data []byte) error {
+	if err := c.conn.SetWriteDeadline(time.Now().Add(c.timeout())); err != nil {
+		return err
+	}
+	_, err := c.conn.Write(data)
+	return err
+}
+
+// SendFrame writes the frame masked, as it is. It is meant for sending frames
+// that break the protocol, for valid messages use Send.
+func (c *Client) SendFrame(frame Frame) error {
+	return c.SendRaw(c.encode(frame))
+}
+
+// SendSlowly writes a masked frame in chunks of the given size, waiting the
+// interval between them, like a peer trickling the data.
+func (c *Client) SendSlowly(frame Frame, chunk int, interval time.Duration) error {
+	data := c.encode(frame)
+	if chunk <= 0 {
+		chunk = 1
+	}
+	for len(data) > 0 {
+		n := chunk
+		if n > len(data) {
+			n = len(data)
+		}
+		if err := c.SendRaw(data[:n]); err != nil {
+			return err
+		}
+		data = data[n:]
+		if len(data) > 0 {
+			time.Sleep(interval)
+		}
+	}
+	return nil
+}
+
+func (c *Client) encode(frame Frame) []byte {
+	var mask [4]byte
+	rand.Read(mask[:])
+	masked := make([]byte, len(frame.Payload))
+	copy(masked, frame.Payload)
+	websocket.Unmask(masked, mask[:])
+	packet, _ := websocket.EncodePacket(frame.Fin, frame.Rsv1, frame.Rsv2, frame.Rsv3, frame.OPCode, uint64(len(masked)), mask[:], masked)
+	return packet
+}
+
+// Send sends a message in a single frame, compressed when the
+// permessage-deflate is used.
+func (c *Client) Send(opcode websocket.MessageType, payload []byte) error {
+	return c.SendFragments(opcode, payload)
+}
+
+// SendText sends a text message.
+func (c *Client) SendText(text string) error {
+	return c.Send(websocket.MessageTypeText, []byte(text))
+}
+
+// SendBinary sends a binary message.
+func (c *Client) SendBinary(payload []byte) error {
+	return c.Send(websocket.MessageTypeBinary, payload)
+}
+
+// SendFragments sends a message fragmented in a frame per fragment. When the
+// permessage-deflate is used, the message is compressed as a whole and the
+// compressed data is split in as many frames as fragments.
+func (c *Client) SendFragments(opcode websocket.MessageType, fragments ...[]byte) error {
+	if len(fragments) == 0 {
+		fragments = [][]byte{nil}
+	}
+	compressed := c.compressed && opcode < websocket.MessageTypeConnectionClose
+	if compressed {
+		flated, _, err := websocket.Flate(nil, bytes.Join(fragments, nil))
+		if err != nil {
+			return err
+		}
+		fragments = split(flated, len(fragments))
+	}
+	for i, fragment := range fragments {
+		frame := Frame{
+			Fin:     i == len(fragments)-1,
+			Rsv1:    compressed && i == 0,
+			OPCode:  byte(opcode),
+			Payload: fragment,
+		}
+		if i > 0 {
+			frame.OPCode = websocket.OPCodeContinuationFrame
+		}
+		if err := c.SendFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// split splits the data in n parts of about the same size.
+func split(data []byte, n int) [][]byte {
+	parts := make([][]byte, n)
+	size := len(data) / n
+	for i := range parts[:n-1] {
+		parts[i] = data[i*size : (i+1)*size]
+	}
+	parts[n-1] = data[(n-1)*size:]
+	return parts
+}
+
+// Ping sends a ping frame.
+func (c *Client) Ping(payload []byte) error {
+	return c.SendFrame(Frame{
+		Fin:     true,
+		OPCode:  websocket.OPCodePingFrame,
+		Payload: payload,
+	})
+}
+
+// Close sends a close frame with the reason and the text.
+func (c *Client) Close(reason websocket.ConnectionCloseReason, text string) error {
+	payload := make([]byte, 2, 2+len(text))
+	binary.BigEndian.PutUint16(payload, uint16(reason))
+	payload = append(payload, text...)
+	return c.SendFrame(Frame{
+		Fin:     true,
+		OPCode:  websocket.OPCodeConnectionCloseFrame,
+		Payload: payload,
+	})
+}
+
+func (c *Client) onHeader(header *websocket.FrameHeader) error {
+	c.frame = &Frame{
+		Fin:     header.Fin,
+		Rsv1:    header.Rsv1,
+		Rsv2:    header.Rsv2,
+		Rsv3:    header.Rsv3,
+		OPCode:  header.OPCode,
+		Payload: make([]byte, 0, header.PayloadLen),
+	}
+	return nil
+}
+
+func (c *Client) onPayload(header *websocket.FrameHeader, segment []byte, final bool) error {
+	c.frame.Payload = append(c.frame.Payload, segment...)
+	if final {
+		c.frames = append(c.frames, *c.frame)
+		c.frame = nil
+	}
+	return nil
+}
+
+// ReadFrame reads the next frame sent by the server, as it is.
+func (c *Client) ReadFrame() (Frame, error) {
+	return c.readFrame(c.timeout())
+}
+
+func (c *Client) readFrame(timeout time.Duration) (Frame, error) {
+	for len(c.frames) == 0 {
+		if err := c.conn.SetReadDeadline(time.Now().Add(timeout)); err != nil {
+			return Frame{}, err
+		}
+		n, err := c.reader.Read(c.buff)
+		if n > 0 {
+			if err := c.parser.Feed(c.buff[:n]); err != nil {
+				return Frame{}, err
+			}
+			continue
+		}
+		if err != nil {
+			return Frame{}, err
+		}
+	}
+	frame := c.frames[0]
+	c.frames = c.frames[1:]
+	return frame, nil
+}
+
+// ReadMessage reads the next message sent by the server. The fragments are
+// joined and decompressed. Control frames are returned as they arrive, even
+// in the middle of a fragmented message.
+func (c *Client) ReadMessage() (websocket.MessageType, []byte, error) {
+	return c.ReadMessageTimeout(c.timeout())
+}
+
+// ReadMessageTimeout is the ReadMessage with the given deadline for each
+// read, instead of the Timeout.
+func (c *Client) ReadMessageTimeout(timeout time.Duration) (websocket.MessageType, []byte, error) {
+	var message *Frame
+	for {
+		frame, err := c.readFrame(timeout)
+		if err != nil {
+			return 0, nil, err
+		}
+		if frame.OPCode >= websocket.OPCodeConnectionCloseFrame {
+			return websocket.MessageType(frame.OPCode), frame.Payload, nil
+		}
+		if message == nil {
+			if frame.OPCode == websocket.OPCodeContinuationFrame {
+				return 0, nil, errors.New("wstest: continuation frame without a message")
+			}
+			message = &frame
+		} else {
+			if frame.OPCode != websocket.OPCodeContinuationFrame {
+				return 0, nil, errors.New("wstest: message interrupted by another message")
+			}
+			message.Payload = append(message.Payload, frame.Payload...)
+		}
+		if frame.Fin {
+			break
+		}
+	}
+	if message.Rsv1 {
+		payload, err := websocket.Deflate(nil, message.Payload)
+		if err != nil {
+			return 0, nil, err
+		}
+		message.Payload = payload
+	}
+	return websocket.MessageType(message.OPCode), message.Payload, nil
+}
+
+// ExpectMessage reads the next message, failing if it is not the given one.
+func (c *Client) ExpectMessage(opcode websocket.MessageType, payload []byte) error {
+	gotOpcode, gotPayload, err := c.ReadMessage()
+	if err != nil {
+		return err
+	}
+	if gotOpcode != opcode || !bytes.Equal(gotPayload, payload) {
+		return fmt.Errorf("wstest: expected message %d %q, got %d %q", opcode, payload, gotOpcode, gotPayload)
+	}
+	return nil
+}
+
+// ExpectText reads the next message, failing if it is not the given text.
+func (c *Client) ExpectText(text string) error {
+	return c.ExpectMessage(websocket.MessageTypeText, []byte(text))
+}
+
+// ExpectNoMessage fails if a frame arrives within the duration.
+func (c *Client) ExpectNoMessage(d time.Duration) error {
+	frame, err := c.readFrame(d)
+	if err == nil {
+		return fmt.Errorf("wstest: expected no message, got frame %d %q", frame.OPCode, frame.Payload)
+	}
+	if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		return nil
+	}
+	return err
+}
+
+// ExpectClose reads the messages until a close frame, failing if its reason
+// is not the given one. The close frame is answered, completing the close
+// handshake.
+func (c *Client) ExpectClose(reason websocket.ConnectionCloseReason) error {
+	for {
+		opcode, payload, err := c.ReadMessage()
+		if err != nil {
+			return err
+		}
+		if opcode != websocket.MessageTypeConnectionClose {
+			continue
+		}
+		got := websocket.ConnectionCloseReasonNormal
+		if len(payload) >= 2 {
+			got = websocket.ConnectionCloseReason(binary.BigEndian.Uint16(payload))
+		}
+		// The server may be gone already.
+		c.Close(got, "")
+		if got != reason {
+			return fmt.Errorf("wstest: expected close reason %d, got %d", reason, got)
+		}
+		return nil
+	}
+}
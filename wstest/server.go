@@ -0,0 +1,144 @@
+package wstest
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base64"
+	"fmt"
+	"sort"
+
+	"github.com/jamillosantos/websocket"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttputil"
+)
+
+var (
+	globalUID = []byte("258EAFA5-E914-47DA-95CA-C5AB0DC85B11")
+)
+
+// DialError is returned by Server.Dial when the handshake is rejected.
+type DialError struct {
+	StatusCode int
+	Body       []byte
+}
+
+func (e *DialError) Error() string {
+	return fmt.Sprintf("wstest: handshake rejected with status %d: %s", e.StatusCode, e.Body)
+}
+
+// Server serves the websocket.Upgrader over an in-memory listener, so the
+// Clients go through the whole handshake.
+type Server struct {
+	listener *fasthttputil.InmemoryListener
+	server   *fasthttp.Server
+	done     chan error
+}
+
+// NewServer returns a new instance of the wstest.Server, already serving the
+// upgrader on every path. It must be closed after the test.
+func NewServer(upgrader *websocket.Upgrader) *Server {
+	s := &Server{
+		listener: fasthttputil.NewInmemoryListener(),
+		server: &fasthttp.Server{
+			Handler: func(ctx *fasthttp.RequestCtx) {
+				upgrader.Upgrade(ctx)
+			},
+		},
+		done: make(chan error, 1),
+	}
+	go func() {
+		s.done <- s.server.Serve(s.listener)
+	}()
+	return s
+}
+
+// Dial connects a new Client, sending the handshake request to the path. The
+// header is added to the request, replacing the default values of the
+// handshake (the names are in the canonical form), while empty values remove
+// them:
+//
+//	// Requests the permessage-deflate.
+//	client, err := server.Dial("/", map[string]string{
+//		"Sec-WebSocket-Extensions": "permessage-deflate",
+//	})
+//
+// A rejected handshake is reported as a *DialError.
+func (s *Server) Dial(path string, header map[string]string) (*Client, error) {
+	nonce := make([]byte, 16)
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	key := base64.StdEncoding.EncodeToString(nonce)
+	fields := map[string]string{
+		"Host":                  "wstest",
+		"Upgrade":               "websocket",
+		"Connection":            "Upgrade",
+		"Sec-WebSocket-Key":     key,
+		"Sec-WebSocket-Version": "13",
+	}
+	for name, value := range header {
+		if value == "" {
+			delete(fields, name)
+			continue
+		}
+		fields[name] = value
+	}
+	names := make([]string, 0, len(fields))
+	for name := range fields {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	var request bytes.Buffer
+	fmt.Fprintf(&request, "GET %s HTTP/1.1\r\n", path)
+	for _, name := range names {
+		fmt.Fprintf(&request, "%s: %s\r\n", name, fields[name])
+	}
+	request.WriteString("\r\n")
+
+	conn, err := s.listener.Dial()
+	if err != nil {
+		return nil, err
+	}
+	if _, err = conn.Write(request.Bytes()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	// The reader may hold the first frames, sent along with the response.
+	reader := bufio.NewReader(conn)
+	var response fasthttp.Response
+	if err = response.Read(reader); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.StatusCode() != fasthttp.StatusSwitchingProtocols {
+		conn.Close()
+		return nil, &DialError{
+			StatusCode: response.StatusCode(),
+			Body:       append([]byte(nil), response.Body()...),
+		}
+	}
+	if accept := response.Header.Peek("Sec-WebSocket-Accept"); !bytes.Equal(accept, acceptKey(fields["Sec-WebSocket-Key"])) {
+		conn.Close()
+		return nil, fmt.Errorf("wstest: invalid Sec-WebSocket-Accept %q", accept)
+	}
+	compressed := bytes.Contains(response.Header.Peek("Sec-WebSocket-Extensions"), []byte("permessage-deflate"))
+	return newClient(conn, reader, compressed), nil
+}
+
+// Close stops serving. The Clients already connected are not closed.
+func (s *Server) Close() error {
+	err := s.listener.Close()
+	<-s.done
+	return err
+}
+
+func acceptKey(key string) []byte {
+	h := sha1.New()
+	h.Write([]byte(key))
+	h.Write(globalUID)
+	accept := make([]byte, base64.StdEncoding.EncodedLen(h.Size()))
+	base64.StdEncoding.Encode(accept, h.Sum(nil))
+	return accept
+}
@@ -0,0 +1,154 @@
+package wstest
+
+import (
+	. "github.com/onsi/ginkgo"
+	. "github.com/onsi/gomega"
+
+	"io"
+	"testing"
+	"time"
+
+	"github.com/jamillosantos/websocket"
+)
+
+func TestWSTest(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "wstest Suite")
+}
+
+func newEchoManager() *websocket.ListenableManager {
+	manager := websocket.NewListeableManager()
+	manager.OnMessage = func(conn websocket.Connection, opcode websocket.MessageType, payload []byte) error {
+		return conn.WriteMessage(opcode, payload)
+	}
+	return manager
+}
+
+var _ = Describe("Client", func() {
+	It("should exchange messages with a manager", func() {
+		client := Pipe(newEchoManager())
+		Expect(client.SendText("Hello")).To(Succeed())
+		Expect(client.ExpectText("Hello")).To(Succeed())
+		Expect(client.SendBinary([]byte{1, 2, 3})).To(Succeed())
+		Expect(client.ExpectMessage(websocket.MessageTypeBinary, []byte{1, 2, 3})).To(Succeed())
+		Expect(client.SendFragments(websocket.MessageTypeText, []byte("Hel"), []byte("lo"))).To(Succeed())
+		Expect(client.ExpectText("Hello")).To(Succeed())
+		Expect(client.ExpectNoMessage(20 * time.Millisecond)).To(Succeed())
+
+		Expect(client.Close(websocket.ConnectionCloseReasonNormal, "")).To(Succeed())
+		Expect(client.ExpectClose(websocket.ConnectionCloseReasonNormal)).To(Succeed())
+		Expect(client.Wait()).To(Succeed())
+	})
+
+	It("should report unexpected messages", func() {
+		client := Pipe(newEchoManager())
+		defer client.Terminate()
+		Expect(client.SendText("Hello")).To(Succeed())
+		Expect(client.ExpectText("World")).To(MatchError(ContainSubstring(`expected message 1 "World", got 1 "Hello"`)))
+		Expect(client.SendText("Hello")).To(Succeed())
+		Expect(client.ExpectNoMessage(time.Second)).NotTo(Succeed())
+	})
+
+	It("should answer pings", func() {
+		client := Pipe(newEchoManager())
+		defer client.Terminate()
+		Expect(client.Ping([]byte("ping"))).To(Succeed())
+		frame, err := client.ReadFrame()
+		Expect(err).To(BeNil())
+		Expect(frame).To(Equal(Frame{
+			Fin:     true,
+			OPCode:  websocket.OPCodePongFrame,
+			Payload: []byte("ping"),
+		}))
+	})
+
+	It("should exchange compressed messages", func() {
+		client := PipeContext(newEchoManager(), &websocket.ConnectionContext{
+			Compressed: true,
+		})
+		defer client.Terminate()
+		Expect(client.Compressed()).To(BeTrue())
+		Expect(client.SendText("Hello")).To(Succeed())
+		frame, err := client.ReadFrame()
+		Expect(err).To(BeNil())
+		Expect(frame.Rsv1).To(BeTrue())
+		Expect(frame.Payload).NotTo(Equal([]byte("Hello")))
+	})
+
+	It("should simulate misbehaving peers", func() {
+		client := Pipe(newEchoManager())
+		Expect(client.SendFrame(Frame{
+			Fin:     false,
+			OPCode:  websocket.OPCodePingFrame,
+			Payload: []byte("ping"),
+		})).To(Succeed())
+		Expect(client.ExpectClose(websocket.ConnectionCloseReasonProtocolError)).To(Succeed())
+		Expect(client.Wait()).To(Succeed())
+	})
+
+	It("should send frames slowly", func() {
+		client := Pipe(newEchoManager())
+		defer client.Terminate()
+		Expect(client.SendSlowly(Frame{
+			Fin:     true,
+			OPCode:  websocket.OPCodeTextFrame,
+			Payload: []byte("Hello"),
+		}, 2, 5*time.Millisecond)).To(Succeed())
+		Expect(client.ExpectText("Hello")).To(Succeed())
+	})
+
+	It("should report the peer gone", func() {
+		client := Pipe(newEchoManager())
+		Expect(client.Terminate()).To(Succeed())
+		Expect(client.Wait()).To(Succeed())
+		_, err := client.ReadFrame()
+		Expect(err).To(MatchError(io.ErrClosedPipe))
+	})
+})
+
+var _ = Describe("Server", func() {
+	var server *Server
+
+	BeforeEach(func() {
+		server = NewServer(websocket.NewUpgrader(newEchoManager()))
+	})
+
+	AfterEach(func() {
+		Expect(server.Close()).To(Succeed())
+	})
+
+	It("should upgrade the connections", func() {
+		client, err := server.Dial("/", nil)
+		Expect(err).To(BeNil())
+		defer client.Terminate()
+		Expect(client.Compressed()).To(BeFalse())
+		Expect(client.Wait()).To(Equal(ErrNotPiped))
+		Expect(client.SendText("Hello")).To(Succeed())
+		Expect(client.ExpectText("Hello")).To(Succeed())
+	})
+
+	It("should negotiate the compression", func() {
+		client, err := server.Dial("/", map[string]string{
+			"Sec-WebSocket-Extensions": "permessage-deflate",
+		})
+		Expect(err).To(BeNil())
+		defer client.Terminate()
+		Expect(client.Compressed()).To(BeTrue())
+		Expect(client.SendText("Hello")).To(Succeed())
+		Expect(client.ExpectText("Hello")).To(Succeed())
+	})
+
+	It("should report the handshakes rejected", func() {
+		_, err := server.Dial("/", map[string]string{
+			"Sec-WebSocket-Version": "12",
+		})
+		Expect(err).To(Equal(&DialError{
+			StatusCode: 400,
+			Body:       []byte("The version is not supported."),
+		}))
+		_, err = server.Dial("/", map[string]string{
+			"Sec-WebSocket-Key": "",
+		})
+		Expect(err).To(HaveField("StatusCode", 400))
+	})
+})